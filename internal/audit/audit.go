@@ -0,0 +1,143 @@
+package audit
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// ActionPreReboot is a pre-reboot lock decision.
+	ActionPreReboot = "pre-reboot"
+	// ActionSteadyState is a steady-state unlock decision.
+	ActionSteadyState = "steady-state"
+	// ActionReportFailure is a failed update reported by a node.
+	ActionReportFailure = "report-failure"
+	// ActionAutoPause is a group paused by the server, e.g. on an
+	// exhausted failure budget.
+	ActionAutoPause = "auto-pause"
+	// ActionResume is a paused group resumed by an operator.
+	ActionResume = "resume"
+	// ActionMigrate is a semaphore upgraded to the current schema version
+	// by an operator.
+	ActionMigrate = "migrate"
+	// ActionForgetNode is a node dropped from a group by an operator,
+	// e.g. after it got decommissioned.
+	ActionForgetNode = "forget-node"
+
+	// OutcomeGranted means that a slot has been granted.
+	OutcomeGranted = "granted"
+	// OutcomeReleased means that a slot has been released.
+	OutcomeReleased = "released"
+	// OutcomeRetained means that a slot has been kept on failure.
+	OutcomeRetained = "retained"
+	// OutcomeRefused means that the request has been refused.
+	OutcomeRefused = "refused"
+	// OutcomeFailed means that the request failed on server side.
+	OutcomeFailed = "failed"
+	// OutcomeDone means that an admin action has been performed.
+	OutcomeDone = "done"
+)
+
+var (
+	// ErrNilLog is returned on nil audit log.
+	ErrNilLog = errors.New("nil audit Log")
+)
+
+// Entry is a single record in the audit trail.
+type Entry struct {
+	Timestamp time.Time `json:"timestamp"`
+	Action    string    `json:"action"`
+	Group     string    `json:"group,omitempty"`
+	// Groups are all groups of a multi-group request, including Group.
+	Groups []string `json:"groups,omitempty"`
+	Node   string   `json:"node,omitempty"`
+	// Version is the attempted version, for failure reports.
+	Version   string `json:"version,omitempty"`
+	Outcome   string `json:"outcome"`
+	ErrorKind string `json:"error_kind,omitempty"`
+	Requester string `json:"requester,omitempty"`
+	Message   string `json:"message,omitempty"`
+}
+
+// Filter selects entries from the audit trail.
+type Filter struct {
+	Group string
+	Node  string
+	Since time.Time
+	Until time.Time
+	// Limit caps the result to the most recent entries, if non-zero.
+	Limit int
+}
+
+// Log is an append-only audit trail.
+type Log interface {
+	// Append records a new entry.
+	Append(ctx context.Context, entry Entry) error
+	// Query returns all matching entries, in chronological order.
+	Query(ctx context.Context, filter Filter) ([]Entry, error)
+	// Prune removes all entries older than the given time.
+	Prune(ctx context.Context, before time.Time) error
+	// Close releases all resources held by the log.
+	Close() error
+}
+
+// Match returns whether an entry is selected by the filter.
+func (f Filter) Match(e Entry) bool {
+	if f.Group != "" && f.Group != e.Group && !containsString(e.Groups, f.Group) {
+		return false
+	}
+	if f.Node != "" && f.Node != e.Node {
+		return false
+	}
+	if !f.Since.IsZero() && e.Timestamp.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !e.Timestamp.Before(f.Until) {
+		return false
+	}
+
+	return true
+}
+
+// limit trims a chronologically ordered result to the most recent entries.
+func (f Filter) limit(entries []Entry) []Entry {
+	if f.Limit > 0 && len(entries) > f.Limit {
+		return entries[len(entries)-f.Limit:]
+	}
+	return entries
+}
+
+// RunRetention periodically prunes entries older than `retention`,
+// until the context is canceled.
+func RunRetention(ctx context.Context, log Log, retention, interval time.Duration) {
+	if log == nil || retention <= 0 || interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := log.Prune(ctx, time.Now().Add(-retention)); err != nil {
+			logrus.Errorln("failed to prune audit log: ", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// containsString returns whether a string is in a list.
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
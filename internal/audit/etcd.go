@@ -0,0 +1,212 @@
+package audit
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"go.etcd.io/etcd/clientv3"
+)
+
+const (
+	// defaultKeyPrefix is the root of all keys, when none is configured.
+	defaultKeyPrefix = "com.coreos.locksmith2/"
+	auditSegment     = "audit/v1/"
+
+	// pageSize is the number of entries read at once when scanning.
+	pageSize = 256
+	// maxTxnOps is the number of deletions per transaction when pruning,
+	// as allowed by etcd by default.
+	maxTxnOps = 128
+	// maxClockSkew is the tolerance on the timestamps of entries recorded
+	// by different servers, which stop scans by time.
+	maxClockSkew = time.Minute
+)
+
+// EtcdLog is an audit trail stored as a key range in etcd.
+//
+// Each log writes entries under its own random writer ID and a local
+// sequence number, so that servers never contend on appends. Entries are
+// ordered by the revision at which etcd committed them, regardless of
+// clock skew between servers, and queries and pruning scan the range in
+// pages of revisions from the relevant end.
+type EtcdLog struct {
+	client   *clientv3.Client
+	prefix   string
+	writerID string
+	sequence uint64
+}
+
+// NewEtcdLog returns an audit trail backed by etcd, storing entries
+// under `keyPrefix` (default "com.coreos.locksmith2/").
+func NewEtcdLog(client *clientv3.Client, keyPrefix string) (*EtcdLog, error) {
+	if client == nil {
+		return nil, errors.New("nil etcd client")
+	}
+	if keyPrefix == "" {
+		keyPrefix = defaultKeyPrefix
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	return &EtcdLog{client: client, prefix: keyPrefix + auditSegment, writerID: hex.EncodeToString(id)}, nil
+}
+
+// Append records a new entry, under the next sequence number of this log.
+func (l *EtcdLog) Append(ctx context.Context, entry Entry) error {
+	if l == nil {
+		return ErrNilLog
+	}
+	if entry.Timestamp.IsZero() {
+		entry.Timestamp = time.Now()
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	_, err = l.client.Put(ctx, l.entryKey(atomic.AddUint64(&l.sequence, 1)), string(data))
+	return err
+}
+
+// Query returns all matching entries, in chronological order.
+//
+// Entries are scanned from the most recent one, until `filter.Limit`
+// matches are found or entries get older than `filter.Since`.
+func (l *EtcdLog) Query(ctx context.Context, filter Filter) ([]Entry, error) {
+	if l == nil {
+		return nil, ErrNilLog
+	}
+
+	entries := []Entry{}
+	// maxRevision is the newest revision of the next page, zero at first.
+	var maxRevision int64
+	for {
+		opts := []clientv3.OpOption{
+			clientv3.WithPrefix(),
+			clientv3.WithSort(clientv3.SortByModRevision, clientv3.SortDescend),
+			clientv3.WithLimit(pageSize),
+		}
+		if maxRevision > 0 {
+			opts = append(opts, clientv3.WithMaxModRev(maxRevision))
+		}
+		resp, err := l.client.Get(ctx, l.prefix, opts...)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, kv := range resp.Kvs {
+			var e Entry
+			if err := json.Unmarshal(kv.Value, &e); err != nil {
+				return nil, err
+			}
+			if !filter.Since.IsZero() && e.Timestamp.Before(filter.Since.Add(-maxClockSkew)) {
+				return reverseEntries(entries), nil
+			}
+			if filter.Match(e) {
+				entries = append(entries, e)
+				if filter.Limit > 0 && len(entries) == filter.Limit {
+					return reverseEntries(entries), nil
+				}
+			}
+		}
+		if !resp.More || len(resp.Kvs) == 0 {
+			return reverseEntries(entries), nil
+		}
+		maxRevision = resp.Kvs[len(resp.Kvs)-1].ModRevision - 1
+	}
+}
+
+// Prune removes all entries older than the given time, up to the
+// first one which is not.
+func (l *EtcdLog) Prune(ctx context.Context, before time.Time) error {
+	if l == nil {
+		return ErrNilLog
+	}
+
+	// minRevision is the oldest revision of the next page, zero at first.
+	var minRevision int64
+	for {
+		opts := []clientv3.OpOption{
+			clientv3.WithPrefix(),
+			clientv3.WithSort(clientv3.SortByModRevision, clientv3.SortAscend),
+			clientv3.WithLimit(pageSize),
+		}
+		if minRevision > 0 {
+			opts = append(opts, clientv3.WithMinModRev(minRevision))
+		}
+		resp, err := l.client.Get(ctx, l.prefix, opts...)
+		if err != nil {
+			return err
+		}
+
+		keys := make([]string, 0, len(resp.Kvs))
+		for _, kv := range resp.Kvs {
+			var e Entry
+			if err := json.Unmarshal(kv.Value, &e); err != nil {
+				return err
+			}
+			if !e.Timestamp.Before(before) {
+				return l.deleteKeys(ctx, keys)
+			}
+			keys = append(keys, string(kv.Key))
+		}
+		if err := l.deleteKeys(ctx, keys); err != nil {
+			return err
+		}
+		if !resp.More || len(resp.Kvs) == 0 {
+			return nil
+		}
+		minRevision = resp.Kvs[len(resp.Kvs)-1].ModRevision + 1
+	}
+}
+
+// Close releases all resources held by the log.
+//
+// The etcd client is owned by the caller, thus it is left open.
+func (l *EtcdLog) Close() error {
+	return nil
+}
+
+// deleteKeys removes the given entries, in batches of transactions.
+func (l *EtcdLog) deleteKeys(ctx context.Context, keys []string) error {
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > maxTxnOps {
+			n = maxTxnOps
+		}
+		ops := make([]clientv3.Op, 0, n)
+		for _, key := range keys[:n] {
+			ops = append(ops, clientv3.OpDelete(key))
+		}
+		if _, err := l.client.Txn(ctx).Then(ops...).Commit(); err != nil {
+			return err
+		}
+		keys = keys[n:]
+	}
+
+	return nil
+}
+
+// entryKey returns the key of the entry of this log with sequence
+// number `seq`.
+func (l *EtcdLog) entryKey(seq uint64) string {
+	return fmt.Sprintf("%s%s/%020d", l.prefix, l.writerID, seq)
+}
+
+// reverseEntries reverses a list of entries in place.
+func reverseEntries(entries []Entry) []Entry {
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries
+}
@@ -0,0 +1,167 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// FileLog is an audit trail stored as a local JSON-lines file.
+type FileLog struct {
+	path string
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewFileLog returns an audit trail appending to the file at `path`.
+func NewFileLog(path string) (*FileLog, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileLog{path: path, file: file}, nil
+}
+
+// Append records a new entry.
+func (l *FileLog) Append(ctx context.Context, entry Entry) error {
+	if l == nil {
+		return ErrNilLog
+	}
+	if entry.Timestamp.IsZero() {
+		entry.Timestamp = time.Now()
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.file.Write(data); err != nil {
+		return err
+	}
+
+	return l.file.Sync()
+}
+
+// Query returns all matching entries, in chronological order.
+func (l *FileLog) Query(ctx context.Context, filter Filter) ([]Entry, error) {
+	if l == nil {
+		return nil, ErrNilLog
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entries := []Entry{}
+	err := l.scan(func(e Entry) {
+		if filter.Match(e) {
+			entries = append(entries, e)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return filter.limit(entries), nil
+}
+
+// Prune removes all entries older than the given time.
+//
+// Retained entries are written to a temporary file, which then
+// atomically replaces the current one.
+func (l *FileLog) Prune(ctx context.Context, before time.Time) error {
+	if l == nil {
+		return ErrNilLog
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	tmp, err := ioutil.TempFile(filepath.Dir(l.path), filepath.Base(l.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	writer := bufio.NewWriter(tmp)
+	encoder := json.NewEncoder(writer)
+	var encodeErr error
+	err = l.scan(func(e Entry) {
+		if encodeErr == nil && !e.Timestamp.Before(before) {
+			encodeErr = encoder.Encode(e)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if encodeErr != nil {
+		return encodeErr
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), l.path); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	l.file.Close()
+	l.file = file
+
+	return nil
+}
+
+// Close releases all resources held by the log.
+func (l *FileLog) Close() error {
+	if l == nil {
+		return ErrNilLog
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+// scan decodes all entries in the file, in order.
+func (l *FileLog) scan(fn func(Entry)) error {
+	file, err := os.Open(l.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return err
+		}
+		fn(e)
+	}
+
+	return scanner.Err()
+}
@@ -0,0 +1,68 @@
+package audit
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "locksmith2-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	log, err := NewFileLog(filepath.Join(dir, "audit.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+
+	ctx := context.Background()
+	now := time.Now()
+	entries := []Entry{
+		{Timestamp: now.Add(-3 * time.Hour), Action: ActionPreReboot, Group: "g1", Node: "a", Outcome: OutcomeGranted},
+		{Timestamp: now.Add(-2 * time.Hour), Action: ActionPreReboot, Group: "g1", Node: "b", Outcome: OutcomeRefused, ErrorKind: "semaphore_full"},
+		{Timestamp: now.Add(-1 * time.Hour), Action: ActionSteadyState, Group: "g2", Node: "a", Outcome: OutcomeReleased},
+	}
+	for _, e := range entries {
+		if err := log.Append(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	all, err := log.Query(ctx, Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 3 {
+		t.Fatalf("unexpected number of entries: %d", len(all))
+	}
+
+	byGroup, err := log.Query(ctx, Filter{Group: "g1", Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(byGroup) != 1 || byGroup[0].Node != "b" {
+		t.Errorf("unexpected filtered entries: %v", byGroup)
+	}
+
+	if err := log.Prune(ctx, now.Add(-150*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := log.Append(ctx, Entry{Action: ActionPreReboot, Group: "g2", Node: "c", Outcome: OutcomeGranted}); err != nil {
+		t.Fatal(err)
+	}
+
+	pruned, err := log.Query(ctx, Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pruned) != 3 || pruned[0].Node != "b" || pruned[2].Node != "c" {
+		t.Errorf("unexpected entries after pruning: %v", pruned)
+	}
+}
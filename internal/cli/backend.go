@@ -0,0 +1,163 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/lucab/exp-locksmith2/internal/audit"
+	"github.com/lucab/exp-locksmith2/internal/lock"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"go.etcd.io/etcd/clientv3"
+)
+
+var (
+	lockBackend = "etcd"
+	lockDir     = "/var/lib/locksmith2/semaphores"
+
+	etcdURLs         = []string{"http://127.0.0.1:2379"}
+	etcdCAFile       = ""
+	etcdCertFile     = ""
+	etcdKeyFile      = ""
+	etcdUsername     = ""
+	etcdPasswordFile = ""
+	etcdPrefix       = lock.DefaultKeyPrefix
+	tenant           = ""
+
+	k8sServer    = ""
+	k8sNamespace = ""
+	k8sConfigMap = "locksmith2-semaphores"
+	k8sTokenFile = ""
+	k8sCAFile    = ""
+)
+
+// addBackendFlags registers the flags selecting and configuring the
+// semaphore storage backend.
+func addBackendFlags(flags *pflag.FlagSet) {
+	flags.StringVar(&lockBackend, "lock-backend", lockBackend, "semaphore storage backend (etcd, file, kubernetes, memory)")
+	flags.StringVar(&lockDir, "lock-dir", lockDir, "directory of semaphore files, for the file backend")
+	flags.StringSliceVar(&etcdURLs, "etcd-endpoints", etcdURLs, "etcd endpoints")
+	flags.StringVar(&etcdCAFile, "etcd-ca", etcdCAFile, "CA bundle for verifying etcd server certificates")
+	flags.StringVar(&etcdCertFile, "etcd-cert", etcdCertFile, "client certificate for etcd")
+	flags.StringVar(&etcdKeyFile, "etcd-key", etcdKeyFile, "client private key for etcd")
+	flags.StringVar(&etcdUsername, "etcd-username", etcdUsername, "etcd RBAC username")
+	flags.StringVar(&etcdPasswordFile, "etcd-password-file", etcdPasswordFile, "file containing the etcd RBAC password")
+	flags.StringVar(&etcdPrefix, "etcd-prefix", etcdPrefix, "root of all etcd keys")
+	flags.StringVar(&tenant, "tenant", tenant, "confine all etcd keys to the subtree of this tenant")
+	flags.StringVar(&k8sServer, "k8s-server", k8sServer, "Kubernetes API server URL (default in-cluster)")
+	flags.StringVar(&k8sNamespace, "k8s-namespace", k8sNamespace, "Kubernetes namespace of the semaphores ConfigMap (default in-cluster)")
+	flags.StringVar(&k8sConfigMap, "k8s-configmap", k8sConfigMap, "name of the semaphores ConfigMap")
+	flags.StringVar(&k8sTokenFile, "k8s-token-file", k8sTokenFile, "Kubernetes bearer token file (default service account)")
+	flags.StringVar(&k8sCAFile, "k8s-ca", k8sCAFile, "CA bundle for the Kubernetes API server (default service account)")
+}
+
+// connectEtcd returns a client for the configured etcd cluster, after
+// checking that it can access semaphores.
+func connectEtcd(ctx context.Context, cfg lock.ClientConfig) (*clientv3.Client, error) {
+	client, err := lock.NewClient(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	checkCtx, checkCancel := context.WithTimeout(ctx, lockTimeout)
+	defer checkCancel()
+	if err := lock.CheckAccess(checkCtx, client, cfg); err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	return client, nil
+}
+
+// openStorage returns the configured semaphore storage and audit trail
+// (nil if disabled), for ctl commands talking directly to them instead of
+// the server. The returned function closes both, and the etcd client.
+func openStorage(ctx context.Context) (lock.Backend, audit.Log, func(), error) {
+	etcdConfig, err := newEtcdConfig()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var client *clientv3.Client
+	if lockBackend == "etcd" || auditBackend == "etcd" {
+		client, err = connectEtcd(ctx, etcdConfig)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	closeClient := func() {
+		if client != nil {
+			client.Close()
+		}
+	}
+
+	backend, err := newLockBackend(client, etcdConfig.KeyPrefix)
+	if err != nil {
+		closeClient()
+		return nil, nil, nil, err
+	}
+	auditLog, err := newAuditLog(client, etcdConfig.KeyPrefix)
+	if err != nil {
+		closeClient()
+		return nil, nil, nil, err
+	}
+
+	closeAll := func() {
+		if auditLog != nil {
+			auditLog.Close()
+		}
+		closeClient()
+	}
+	return backend, auditLog, closeAll, nil
+}
+
+// newLockBackend returns the configured semaphore storage.
+func newLockBackend(client *clientv3.Client, keyPrefix string) (lock.Backend, error) {
+	switch lockBackend {
+	case "etcd":
+		return lock.NewEtcdBackend(client, keyPrefix)
+	case "file":
+		return lock.NewFileBackend(lockDir)
+	case "kubernetes":
+		return lock.NewKubernetesBackend(lock.KubernetesConfig{
+			Server:    k8sServer,
+			Namespace: k8sNamespace,
+			ConfigMap: k8sConfigMap,
+			TokenFile: k8sTokenFile,
+			CAFile:    k8sCAFile,
+		})
+	case "memory":
+		logrus.Warn("using in-memory lock backend, semaphores will not survive restarts")
+		return lock.NewMemoryBackend(), nil
+	default:
+		return nil, fmt.Errorf("unknown lock backend %q", lockBackend)
+	}
+}
+
+// newEtcdConfig returns the etcd client settings from flags.
+func newEtcdConfig() (lock.ClientConfig, error) {
+	cfg := lock.ClientConfig{
+		Endpoints: etcdURLs,
+		CAFile:    etcdCAFile,
+		CertFile:  etcdCertFile,
+		KeyFile:   etcdKeyFile,
+		Username:  etcdUsername,
+	}
+
+	keyPrefix, err := lock.KeyPrefix(etcdPrefix, tenant)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.KeyPrefix = keyPrefix
+
+	if etcdPasswordFile != "" {
+		password, err := ioutil.ReadFile(etcdPasswordFile)
+		if err != nil {
+			return cfg, fmt.Errorf("failed to read etcd password: %s", err)
+		}
+		cfg.Password = strings.TrimSpace(string(password))
+	}
+
+	return cfg, nil
+}
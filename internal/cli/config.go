@@ -0,0 +1,448 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lucab/exp-locksmith2/internal/lock"
+	"github.com/lucab/exp-locksmith2/internal/server"
+	"github.com/lucab/exp-locksmith2/internal/webhook"
+)
+
+// fileConfig is the on-disk JSON configuration for `serve`.
+type fileConfig struct {
+	Auth *authFileConfig `json:"auth,omitempty"`
+	// RestrictGroups rejects requests for groups not listed in `Groups`.
+	RestrictGroups bool `json:"restrict_groups,omitempty"`
+	// DisableImplicitGroups rejects requests for groups whose semaphore
+	// does not exist yet, instead of creating it.
+	DisableImplicitGroups bool `json:"disable_implicit_groups,omitempty"`
+	// RateLimits configures rate limiting of lock requests.
+	RateLimits *rateLimitsFileConfig `json:"rate_limits,omitempty"`
+	// Groups maps group names to their settings.
+	Groups map[string]groupFileConfig `json:"groups,omitempty"`
+	// Rollouts maps rollout names to their ordered stages.
+	Rollouts map[string]rolloutFileConfig `json:"rollouts,omitempty"`
+	// Webhooks lists outbound notifications of lock events.
+	Webhooks []webhookFileConfig `json:"webhooks,omitempty"`
+}
+
+// webhookFileConfig configures an outbound webhook.
+type webhookFileConfig struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	// Events lists the event kinds to deliver, all if empty.
+	Events []string `json:"events,omitempty"`
+	// Template is a Go text/template rendering the JSON body from the event.
+	Template string `json:"template,omitempty"`
+	// SecretFile contains the HMAC secret signing deliveries.
+	SecretFile string `json:"secret_file,omitempty"`
+	// QueueSize bounds pending deliveries, MaxAttempts retries.
+	QueueSize   int `json:"queue_size,omitempty"`
+	MaxAttempts int `json:"max_attempts,omitempty"`
+	// Timeout bounds a single delivery attempt (e.g. "10s").
+	Timeout string `json:"timeout,omitempty"`
+}
+
+// rolloutFileConfig configures a rollout.
+type rolloutFileConfig struct {
+	// Stages are lists of groups, in rollout order.
+	Stages [][]string `json:"stages"`
+}
+
+// groupFileConfig configures a single group.
+type groupFileConfig struct {
+	// Slots is the number of semaphore slots, overriding `--semaphore-slots`.
+	Slots uint64 `json:"slots,omitempty"`
+	// NodePattern is a regular expression which must fully match node UUIDs.
+	NodePattern string `json:"node_pattern,omitempty"`
+	// CertIdentities lists the client certificate identities allowed in the group.
+	CertIdentities []string `json:"cert_identities,omitempty"`
+	// RateLimit overrides the per-node rate limit for nodes in the group.
+	RateLimit *rateLimitFileConfig `json:"rate_limit,omitempty"`
+	// Parent is a declared group whose slots are taken together with this one.
+	Parent string `json:"parent,omitempty"`
+	// MaxHold is how long a node may hold a slot before this counts as a failure (e.g. "2h").
+	MaxHold string `json:"max_hold,omitempty"`
+	// FailureBudget is the number of failures which pauses the group.
+	FailureBudget uint64 `json:"failure_budget,omitempty"`
+	// FailurePolicy is "release" (default) or "retain" the slot of nodes reporting a failure.
+	FailurePolicy string `json:"failure_policy,omitempty"`
+	// Gates are external checks which must pass before granting a slot.
+	Gates []gateFileConfig `json:"gates,omitempty"`
+	// Spread limits holders sharing a node label value (e.g. one per rack).
+	Spread []spreadFileConfig `json:"spread,omitempty"`
+	// DisruptionBudget keeps a minimum of nodes available, according to heartbeats.
+	DisruptionBudget *disruptionBudgetFileConfig `json:"disruption_budget,omitempty"`
+}
+
+// disruptionBudgetFileConfig configures a disruption budget.
+type disruptionBudgetFileConfig struct {
+	// MinAvailable is a number (e.g. "3") or a percentage (e.g. "80%") of known nodes.
+	MinAvailable string `json:"min_available"`
+	// HeartbeatTTL and ForgetAfter are durations (e.g. "2m").
+	HeartbeatTTL string `json:"heartbeat_ttl,omitempty"`
+	ForgetAfter  string `json:"forget_after,omitempty"`
+}
+
+// spreadFileConfig configures a spread constraint.
+type spreadFileConfig struct {
+	Label      string `json:"label"`
+	MaxHolders int    `json:"max_holders"`
+}
+
+// gateFileConfig configures a gate, either an HTTP check or an exec hook.
+type gateFileConfig struct {
+	Name string `json:"name"`
+	// URL is requested with GET, expecting `expect_status` (default 200) and,
+	// if `json_field` is set, its value to be `json_value` (default "true").
+	URL          string `json:"url,omitempty"`
+	ExpectStatus int    `json:"expect_status,omitempty"`
+	JSONField    string `json:"json_field,omitempty"`
+	JSONValue    string `json:"json_value,omitempty"`
+	// Command is run without a shell, and must exit with 0.
+	Command []string `json:"command,omitempty"`
+	// Timeout and CacheTTL are durations (e.g. "5s").
+	Timeout  string `json:"timeout,omitempty"`
+	CacheTTL string `json:"cache_ttl,omitempty"`
+}
+
+// rateLimitsFileConfig configures rate limiting.
+type rateLimitsFileConfig struct {
+	Global  rateLimitFileConfig `json:"global"`
+	PerIP   rateLimitFileConfig `json:"per_ip"`
+	PerNode rateLimitFileConfig `json:"per_node"`
+	// Heartbeat limits heartbeats per node, instead of PerNode and Global.
+	Heartbeat rateLimitFileConfig `json:"heartbeat"`
+	// MaxKeys bounds the number of tracked client IPs and nodes.
+	MaxKeys int `json:"max_keys,omitempty"`
+}
+
+// rateLimitFileConfig is a token bucket, with a rate in requests per second.
+type rateLimitFileConfig struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+// authFileConfig configures request authentication.
+type authFileConfig struct {
+	// Required rejects unauthenticated requests for groups without credentials.
+	Required bool `json:"required,omitempty"`
+	// MaxClockSkew is the tolerance on signed request timestamps (e.g. "5m").
+	MaxClockSkew string `json:"max_clock_skew,omitempty"`
+	// Groups and Nodes map group names and node UUIDs to credentials.
+	Groups map[string]credentialFiles `json:"groups,omitempty"`
+	Nodes  map[string]credentialFiles `json:"nodes,omitempty"`
+	// Admin holds the credentials for status, events, audit and other
+	// queries which are not lock requests.
+	Admin *credentialFiles `json:"admin,omitempty"`
+}
+
+// credentialFiles references files containing secrets.
+type credentialFiles struct {
+	// TokenFiles contain bearer tokens, one per file (not for nodes).
+	TokenFiles []string `json:"token_files,omitempty"`
+	// SecretFile contains an HMAC shared secret.
+	SecretFile string `json:"secret_file,omitempty"`
+}
+
+// loadFileConfig parses the JSON configuration file at `path`.
+func loadFileConfig(path string) (*fileConfig, error) {
+	cfg := &fileConfig{}
+	if path == "" {
+		return cfg, nil
+	}
+
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	decoder := json.NewDecoder(fp)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config %q: %s", path, err)
+	}
+
+	return cfg, nil
+}
+
+// authenticator builds the request authenticator, loading secrets from
+// referenced files. It returns nil if authentication is not configured.
+func (fc *fileConfig) authenticator() (*server.Authenticator, error) {
+	if fc == nil || fc.Auth == nil {
+		return nil, nil
+	}
+
+	cfg := server.AuthConfig{
+		GroupTokens:  map[string][]string{},
+		GroupSecrets: map[string][]byte{},
+		NodeSecrets:  map[string][]byte{},
+		Required:     fc.Auth.Required,
+	}
+	if fc.Auth.MaxClockSkew != "" {
+		skew, err := time.ParseDuration(fc.Auth.MaxClockSkew)
+		if err != nil {
+			return nil, fmt.Errorf("invalid max_clock_skew: %s", err)
+		}
+		cfg.MaxClockSkew = skew
+	}
+
+	for group, creds := range fc.Auth.Groups {
+		for _, path := range creds.TokenFiles {
+			token, err := readSecretFile(path)
+			if err != nil {
+				return nil, err
+			}
+			cfg.GroupTokens[group] = append(cfg.GroupTokens[group], token)
+		}
+		if creds.SecretFile != "" {
+			secret, err := readSecretFile(creds.SecretFile)
+			if err != nil {
+				return nil, err
+			}
+			cfg.GroupSecrets[group] = []byte(secret)
+		}
+	}
+	for node, creds := range fc.Auth.Nodes {
+		if len(creds.TokenFiles) > 0 {
+			return nil, fmt.Errorf("bearer tokens are only supported per group, not for node %q", node)
+		}
+		if creds.SecretFile != "" {
+			secret, err := readSecretFile(creds.SecretFile)
+			if err != nil {
+				return nil, err
+			}
+			cfg.NodeSecrets[node] = []byte(secret)
+		}
+	}
+	if admin := fc.Auth.Admin; admin != nil {
+		for _, path := range admin.TokenFiles {
+			token, err := readSecretFile(path)
+			if err != nil {
+				return nil, err
+			}
+			cfg.AdminTokens = append(cfg.AdminTokens, token)
+		}
+		if admin.SecretFile != "" {
+			secret, err := readSecretFile(admin.SecretFile)
+			if err != nil {
+				return nil, err
+			}
+			cfg.AdminSecrets = append(cfg.AdminSecrets, []byte(secret))
+		}
+	}
+
+	return server.NewAuthenticator(cfg), nil
+}
+
+// groups builds per-group settings, compiling node patterns.
+func (fc *fileConfig) groups() (map[string]server.GroupConfig, error) {
+	groups := map[string]server.GroupConfig{}
+	if fc == nil {
+		return groups, nil
+	}
+
+	for name, gfc := range fc.Groups {
+		gc := server.GroupConfig{
+			Slots:          gfc.Slots,
+			CertIdentities: gfc.CertIdentities,
+			Parent:         gfc.Parent,
+			FailureBudget:  gfc.FailureBudget,
+			FailurePolicy:  gfc.FailurePolicy,
+		}
+		if gfc.MaxHold != "" {
+			maxHold, err := time.ParseDuration(gfc.MaxHold)
+			if err != nil || maxHold <= 0 {
+				return nil, fmt.Errorf("invalid max_hold for group %q: %q", name, gfc.MaxHold)
+			}
+			gc.MaxHold = maxHold
+		}
+		for _, spread := range gfc.Spread {
+			gc.Spread = append(gc.Spread, lock.Spread{Label: spread.Label, MaxHolders: spread.MaxHolders})
+		}
+		if gfc.DisruptionBudget != nil {
+			budget, err := gfc.DisruptionBudget.budget()
+			if err != nil {
+				return nil, fmt.Errorf("invalid disruption_budget for group %q: %s", name, err)
+			}
+			gc.DisruptionBudget = budget
+		}
+		for _, gate := range gfc.Gates {
+			g, err := gate.gate()
+			if err != nil {
+				return nil, fmt.Errorf("invalid gate %q for group %q: %s", gate.Name, name, err)
+			}
+			gc.Gates = append(gc.Gates, g)
+		}
+		if gfc.RateLimit != nil {
+			gc.RateLimit = &server.RateLimit{Rate: gfc.RateLimit.Rate, Burst: gfc.RateLimit.Burst}
+		}
+		if gfc.NodePattern != "" {
+			pattern, err := regexp.Compile("^(?:" + gfc.NodePattern + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("invalid node_pattern for group %q: %s", name, err)
+			}
+			gc.NodePattern = pattern
+		}
+		groups[name] = gc
+	}
+
+	return groups, nil
+}
+
+// budget builds a disruption budget, parsing its minimum and durations.
+func (dfc disruptionBudgetFileConfig) budget() (*lock.DisruptionBudget, error) {
+	budget := &lock.DisruptionBudget{}
+	min := strings.TrimSuffix(dfc.MinAvailable, "%")
+	n, err := strconv.Atoi(min)
+	if err != nil || n <= 0 {
+		return nil, fmt.Errorf("invalid min_available %q", dfc.MinAvailable)
+	}
+	if min != dfc.MinAvailable {
+		budget.MinAvailablePercent = n
+	} else {
+		budget.MinAvailable = n
+	}
+
+	if dfc.HeartbeatTTL != "" {
+		ttl, err := time.ParseDuration(dfc.HeartbeatTTL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid heartbeat_ttl: %s", err)
+		}
+		budget.HeartbeatTTL = ttl
+	}
+	if dfc.ForgetAfter != "" {
+		forgetAfter, err := time.ParseDuration(dfc.ForgetAfter)
+		if err != nil {
+			return nil, fmt.Errorf("invalid forget_after: %s", err)
+		}
+		budget.ForgetAfter = forgetAfter
+	}
+
+	return budget, nil
+}
+
+// gate builds a group gate, parsing its durations.
+func (gfc gateFileConfig) gate() (*server.Gate, error) {
+	gate := &server.Gate{
+		Name:         gfc.Name,
+		URL:          gfc.URL,
+		ExpectStatus: gfc.ExpectStatus,
+		JSONField:    gfc.JSONField,
+		JSONValue:    gfc.JSONValue,
+		Command:      gfc.Command,
+	}
+	if gfc.Timeout != "" {
+		timeout, err := time.ParseDuration(gfc.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timeout: %s", err)
+		}
+		gate.Timeout = timeout
+	}
+	if gfc.CacheTTL != "" {
+		ttl, err := time.ParseDuration(gfc.CacheTTL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cache_ttl: %s", err)
+		}
+		gate.CacheTTL = ttl
+	}
+
+	return gate, nil
+}
+
+// rollouts builds the rollout stages.
+func (fc *fileConfig) rollouts() map[string]server.RolloutConfig {
+	rollouts := map[string]server.RolloutConfig{}
+	if fc == nil {
+		return rollouts
+	}
+
+	for name, rfc := range fc.Rollouts {
+		rollouts[name] = server.RolloutConfig{Stages: rfc.Stages}
+	}
+
+	return rollouts
+}
+
+// webhooks builds the webhook dispatcher, loading secrets from referenced
+// files. It returns nil if no webhook is configured.
+func (fc *fileConfig) webhooks() (*webhook.Dispatcher, error) {
+	if fc == nil || len(fc.Webhooks) == 0 {
+		return nil, nil
+	}
+
+	hooks := []webhook.Hook{}
+	for _, wfc := range fc.Webhooks {
+		hook := webhook.Hook{
+			Name:        wfc.Name,
+			URL:         wfc.URL,
+			Events:      wfc.Events,
+			QueueSize:   wfc.QueueSize,
+			MaxAttempts: wfc.MaxAttempts,
+		}
+		if wfc.Template != "" {
+			tmpl, err := webhook.NewTemplate(wfc.Name, wfc.Template)
+			if err != nil {
+				return nil, fmt.Errorf("invalid template for webhook %q: %s", wfc.Name, err)
+			}
+			hook.Template = tmpl
+		}
+		if wfc.SecretFile != "" {
+			secret, err := readSecretFile(wfc.SecretFile)
+			if err != nil {
+				return nil, err
+			}
+			hook.Secret = []byte(secret)
+		}
+		if wfc.Timeout != "" {
+			timeout, err := time.ParseDuration(wfc.Timeout)
+			if err != nil {
+				return nil, fmt.Errorf("invalid timeout for webhook %q: %s", wfc.Name, err)
+			}
+			hook.Timeout = timeout
+		}
+		hooks = append(hooks, hook)
+	}
+
+	return webhook.NewDispatcher(hooks)
+}
+
+// rateLimiter builds the request rate limiter. It returns nil if rate
+// limiting is not configured.
+func (fc *fileConfig) rateLimiter() *server.RateLimiter {
+	if fc == nil || fc.RateLimits == nil {
+		return nil
+	}
+
+	rl := fc.RateLimits
+	return server.NewRateLimiter(server.RateLimitConfig{
+		Global:    server.RateLimit{Rate: rl.Global.Rate, Burst: rl.Global.Burst},
+		PerIP:     server.RateLimit{Rate: rl.PerIP.Rate, Burst: rl.PerIP.Burst},
+		PerNode:   server.RateLimit{Rate: rl.PerNode.Rate, Burst: rl.PerNode.Burst},
+		Heartbeat: server.RateLimit{Rate: rl.Heartbeat.Rate, Burst: rl.Heartbeat.Burst},
+		MaxKeys:   rl.MaxKeys,
+	})
+}
+
+// readSecretFile returns the trimmed content of a secret file.
+func readSecretFile(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret file: %s", err)
+	}
+
+	secret := strings.TrimSpace(string(data))
+	if secret == "" {
+		return "", fmt.Errorf("empty secret file %q", path)
+	}
+
+	return secret, nil
+}
@@ -0,0 +1,99 @@
+package cli
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/lucab/exp-locksmith2/internal/server"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdCtl = &cobra.Command{
+		Use:   "ctl",
+		Short: "Inspect and manage a locksmith2 deployment",
+	}
+	serverURL   = "http://127.0.0.1:9999"
+	ctlCAFile   = ""
+	ctlCertFile = ""
+	ctlKeyFile  = ""
+	// Credentials for endpoints behind authentication.
+	ctlTokenFile  = ""
+	ctlSecretFile = ""
+)
+
+func init() {
+	locksmith2Cmd.AddCommand(cmdCtl)
+
+	cmdCtl.PersistentFlags().StringVar(&serverURL, "server", serverURL, "base URL of the locksmith2 server")
+	cmdCtl.PersistentFlags().StringVar(&ctlCAFile, "tls-ca", ctlCAFile, "CA bundle for verifying the server certificate")
+	cmdCtl.PersistentFlags().StringVar(&ctlCertFile, "tls-cert", ctlCertFile, "client certificate, for mutual TLS")
+	cmdCtl.PersistentFlags().StringVar(&ctlKeyFile, "tls-key", ctlKeyFile, "client private key, for mutual TLS")
+	cmdCtl.PersistentFlags().StringVar(&ctlTokenFile, "token-file", ctlTokenFile, "file containing an admin bearer token for the server")
+	cmdCtl.PersistentFlags().StringVar(&ctlSecretFile, "secret-file", ctlSecretFile, "file containing an admin HMAC secret for signing requests to the server")
+}
+
+// ctlAuthorize adds the configured credentials to a request without
+// body, either a bearer token or an HMAC signature.
+func ctlAuthorize(req *http.Request) error {
+	if ctlTokenFile != "" && ctlSecretFile != "" {
+		return errors.New("only one of --token-file and --secret-file can be set")
+	}
+
+	if ctlTokenFile != "" {
+		token, err := readSecretFile(ctlTokenFile)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if ctlSecretFile != "" {
+		secret, err := readSecretFile(ctlSecretFile)
+		if err != nil {
+			return err
+		}
+		nonce := make([]byte, 16)
+		if _, err := rand.Read(nonce); err != nil {
+			return err
+		}
+		server.SignRequest(req, nil, []byte(secret), hex.EncodeToString(nonce))
+	}
+
+	return nil
+}
+
+// ctlHTTPClient returns an HTTP client for talking to the server.
+func ctlHTTPClient() (*http.Client, error) {
+	if ctlCAFile == "" && ctlCertFile == "" && ctlKeyFile == "" {
+		return http.DefaultClient, nil
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if ctlCAFile != "" {
+		pem, err := ioutil.ReadFile(ctlCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no valid certificates in CA bundle")
+		}
+	}
+	if ctlCertFile != "" || ctlKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(ctlCertFile, ctlKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}
+	return client, nil
+}
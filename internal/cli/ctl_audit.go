@@ -0,0 +1,117 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/lucab/exp-locksmith2/internal/audit"
+	"github.com/lucab/exp-locksmith2/internal/server"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdCtlAudit = &cobra.Command{
+		Use:   "audit",
+		Short: "Query the audit trail of lock decisions",
+		RunE:  runCtlAudit,
+	}
+	auditGroup = ""
+	auditNode  = ""
+	auditSince = time.Duration(0)
+	auditLimit = 0
+)
+
+func init() {
+	cmdCtl.AddCommand(cmdCtlAudit)
+
+	cmdCtlAudit.Flags().StringVar(&auditGroup, "group", auditGroup, "only show entries for this group")
+	cmdCtlAudit.Flags().StringVar(&auditNode, "node", auditNode, "only show entries for this node UUID")
+	cmdCtlAudit.Flags().DurationVar(&auditSince, "since", auditSince, "only show entries newer than this (e.g. 24h)")
+	cmdCtlAudit.Flags().IntVar(&auditLimit, "limit", auditLimit, "only show this many of the most recent entries (0 for all)")
+}
+
+func runCtlAudit(cmd *cobra.Command, cmdArgs []string) error {
+	query := url.Values{}
+	if auditGroup != "" {
+		query.Set("group", auditGroup)
+	}
+	if auditNode != "" {
+		query.Set("node", auditNode)
+	}
+	if auditSince > 0 {
+		query.Set("since", time.Now().Add(-auditSince).Format(time.RFC3339))
+	}
+
+	client, err := ctlHTTPClient()
+	if err != nil {
+		return err
+	}
+
+	// The server caps the entries of a query, thus older ones are fetched
+	// page by page, each ending before the oldest entry of the previous.
+	entries := []audit.Entry{}
+	for auditLimit <= 0 || len(entries) < auditLimit {
+		pageLimit := server.MaxAuditLimit
+		if auditLimit > 0 && auditLimit-len(entries) < pageLimit {
+			pageLimit = auditLimit - len(entries)
+		}
+		query.Set("limit", strconv.Itoa(pageLimit))
+		if len(entries) > 0 {
+			query.Set("until", entries[0].Timestamp.Format(time.RFC3339Nano))
+		}
+
+		page, err := queryAudit(client, query)
+		if err != nil {
+			return err
+		}
+		entries = append(page, entries...)
+		if len(page) < pageLimit {
+			break
+		}
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIMESTAMP\tACTION\tGROUP\tNODE\tOUTCOME\tERROR\tREQUESTER")
+	for _, e := range entries {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			e.Timestamp.Format(time.RFC3339), e.Action, e.Group, e.Node, e.Outcome, e.ErrorKind, e.Requester)
+	}
+
+	return tw.Flush()
+}
+
+// queryAudit returns a page of entries of the audit trail, in
+// chronological order.
+func queryAudit(client *http.Client, query url.Values) ([]audit.Entry, error) {
+	endpoint := strings.TrimSuffix(serverURL, "/") + server.AuditEndpoint + "?" + query.Encode()
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctlAuthorize(req); err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("audit query failed (%s): %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var entries []audit.Entry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
@@ -0,0 +1,76 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/lucab/exp-locksmith2/internal/audit"
+	"github.com/lucab/exp-locksmith2/internal/lock"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdCtlForgetNode = &cobra.Command{
+		Use:   "forget-node",
+		Short: "Release the slot and forget the version of a node in a group",
+		Long: `Release the slot and forget the version of a node in a group.
+
+This is meant for decommissioned nodes, which would otherwise hold their
+slot forever and block later rollout stages until their version expires.
+Run it for every group of the node, parents included.
+
+This talks directly to the semaphore storage backend, not to the server.`,
+		RunE: runCtlForgetNode,
+	}
+	forgetGroup = ""
+	forgetNode  = ""
+)
+
+func init() {
+	cmdCtl.AddCommand(cmdCtlForgetNode)
+
+	cmdCtlForgetNode.Flags().StringVar(&forgetGroup, "group", forgetGroup, "group of the node")
+	cmdCtlForgetNode.Flags().StringVar(&forgetNode, "node", forgetNode, "UUID of the node to forget")
+	addBackendFlags(cmdCtlForgetNode.Flags())
+	addAuditFlags(cmdCtlForgetNode.Flags())
+}
+
+func runCtlForgetNode(cmd *cobra.Command, cmdArgs []string) error {
+	if forgetGroup == "" {
+		return errors.New("missing group")
+	}
+	if forgetNode == "" {
+		return errors.New("missing node")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	backend, auditLog, closeStorage, err := openStorage(ctx)
+	if err != nil {
+		return err
+	}
+	defer closeStorage()
+
+	manager, err := lock.OpenManager(ctx, backend, forgetGroup)
+	if err != nil {
+		return fmt.Errorf("failed to open group %q: %s", forgetGroup, err)
+	}
+	forgotten, err := manager.ForgetNode(ctx, forgetNode)
+	recordAdminAction(ctx, auditLog, audit.Entry{
+		Action: audit.ActionForgetNode,
+		Group:  forgetGroup,
+		Node:   forgetNode,
+	}, err)
+	if err != nil {
+		return err
+	}
+
+	if !forgotten {
+		fmt.Printf("node %q unknown in group %q\n", forgetNode, forgetGroup)
+		return nil
+	}
+	fmt.Printf("node %q forgotten in group %q\n", forgetNode, forgetGroup)
+	return nil
+}
@@ -0,0 +1,80 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/lucab/exp-locksmith2/internal/audit"
+	"github.com/lucab/exp-locksmith2/internal/lock"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdCtlMigrate = &cobra.Command{
+		Use:   "migrate",
+		Short: "Upgrade stored semaphores to the current schema version",
+		Long: `Upgrade stored semaphores to the current schema version.
+
+This talks directly to the semaphore storage backend, not to the server.`,
+		RunE: runCtlMigrate,
+	}
+	migrateDryRun = false
+)
+
+func init() {
+	cmdCtl.AddCommand(cmdCtlMigrate)
+
+	cmdCtlMigrate.Flags().BoolVar(&migrateDryRun, "dry-run", migrateDryRun, "only report what would change")
+	addBackendFlags(cmdCtlMigrate.Flags())
+	addAuditFlags(cmdCtlMigrate.Flags())
+}
+
+func runCtlMigrate(cmd *cobra.Command, cmdArgs []string) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	backend, auditLog, closeStorage, err := openStorage(ctx)
+	if err != nil {
+		return err
+	}
+	defer closeStorage()
+
+	results, err := lock.Migrate(ctx, backend, migrateDryRun)
+	if !migrateDryRun {
+		for _, r := range results {
+			recordAdminAction(ctx, auditLog, audit.Entry{
+				Action:  audit.ActionMigrate,
+				Group:   r.Group,
+				Message: fmt.Sprintf("schema version %d to %d: %s", r.From, r.To, strings.Join(r.Steps, "; ")),
+			}, nil)
+		}
+		if err != nil {
+			recordAdminAction(ctx, auditLog, audit.Entry{Action: audit.ActionMigrate}, err)
+		}
+	}
+	if len(results) > 0 {
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "GROUP\tFROM\tTO\tCHANGES")
+		for _, r := range results {
+			fmt.Fprintf(w, "%s\t%d\t%d\t%s\n", r.Group, r.From, r.To, strings.Join(r.Steps, "; "))
+		}
+		w.Flush()
+	}
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case len(results) == 0:
+		fmt.Printf("all semaphores are at schema version %d\n", lock.CurrentSchemaVersion)
+	case migrateDryRun:
+		fmt.Printf("%d semaphores would be migrated (dry run)\n", len(results))
+	default:
+		fmt.Printf("%d semaphores migrated\n", len(results))
+	}
+
+	return nil
+}
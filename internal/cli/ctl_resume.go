@@ -0,0 +1,65 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/lucab/exp-locksmith2/internal/audit"
+	"github.com/lucab/exp-locksmith2/internal/lock"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdCtlResume = &cobra.Command{
+		Use:   "resume",
+		Short: "Resume a paused group, resetting its failure count",
+		Long: `Resume a paused group, resetting its failure count.
+
+Holders which exceeded the maximum hold duration keep their slot, and
+are not counted as failures again.
+
+This talks directly to the semaphore storage backend, not to the server.`,
+		RunE: runCtlResume,
+	}
+	resumeGroup = ""
+)
+
+func init() {
+	cmdCtl.AddCommand(cmdCtlResume)
+
+	cmdCtlResume.Flags().StringVar(&resumeGroup, "group", resumeGroup, "group to resume")
+	addBackendFlags(cmdCtlResume.Flags())
+	addAuditFlags(cmdCtlResume.Flags())
+}
+
+func runCtlResume(cmd *cobra.Command, cmdArgs []string) error {
+	if resumeGroup == "" {
+		return errors.New("missing group")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	backend, auditLog, closeStorage, err := openStorage(ctx)
+	if err != nil {
+		return err
+	}
+	defer closeStorage()
+
+	manager, err := lock.OpenManager(ctx, backend, resumeGroup)
+	if err != nil {
+		return fmt.Errorf("failed to open group %q: %s", resumeGroup, err)
+	}
+	err = manager.Resume(ctx)
+	recordAdminAction(ctx, auditLog, audit.Entry{
+		Action: audit.ActionResume,
+		Group:  resumeGroup,
+	}, err)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("group %q resumed\n", resumeGroup)
+	return nil
+}
@@ -1,13 +1,24 @@
 package cli
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
+	"os"
+	"os/signal"
+	"regexp"
+	"syscall"
 	"time"
 
+	"github.com/lucab/exp-locksmith2/internal/audit"
+	"github.com/lucab/exp-locksmith2/internal/lock"
 	"github.com/lucab/exp-locksmith2/internal/server"
+	"github.com/lucab/exp-locksmith2/internal/tlsutil"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"go.etcd.io/etcd/clientv3"
 )
 
 var (
@@ -17,13 +28,47 @@ var (
 	}
 	address        = "0.0.0.0"
 	port           = 9999
-	etcdURLs       = []string{"http://127.0.0.1:2379"}
 	lockTimeout    = 3 * time.Second
 	semaphoreSlots = uint64(1)
+	versionTTL     = 30 * 24 * time.Hour
+
+	maxBodyBytes    = int64(server.DefaultMaxBodyBytes)
+	nodeUUIDPattern = server.DefaultNodeUUIDPattern
+
+	configFile = ""
+
+	auditBackend       = "none"
+	auditFile          = "/var/lib/locksmith2/audit.jsonl"
+	auditRetention     = time.Duration(0)
+	auditPruneInterval = time.Hour
+
+	shutdownDelay       = 5 * time.Second
+	shutdownTimeout     = 30 * time.Second
+	webhookDrainTimeout = 10 * time.Second
+
+	tlsCertFile       = ""
+	tlsKeyFile        = ""
+	tlsClientCAFile   = ""
+	tlsCertIdentity   = server.CertIdentityNone
+	tlsReloadInterval = time.Minute
 )
 
 func init() {
 	locksmith2Cmd.AddCommand(cmdServe)
+
+	cmdServe.Flags().StringVar(&configFile, "config", configFile, "path to the JSON configuration file")
+	addBackendFlags(cmdServe.Flags())
+	cmdServe.Flags().Int64Var(&maxBodyBytes, "max-body-bytes", maxBodyBytes, "maximum size of lock request bodies")
+	cmdServe.Flags().StringVar(&nodeUUIDPattern, "node-uuid-pattern", nodeUUIDPattern, "regular expression which node UUIDs must fully match")
+	addAuditFlags(cmdServe.Flags())
+	cmdServe.Flags().DurationVar(&auditRetention, "audit-retention", auditRetention, "how long to keep audit entries (0 keeps them forever)")
+	cmdServe.Flags().DurationVar(&versionTTL, "version-ttl", versionTTL, "how long to track the version of a node without a new report (0 tracks it forever)")
+	cmdServe.Flags().DurationVar(&shutdownDelay, "shutdown-delay", shutdownDelay, "how long to report not-ready before shutting down")
+	cmdServe.Flags().StringVar(&tlsCertFile, "tls-cert", tlsCertFile, "server certificate, enables HTTPS")
+	cmdServe.Flags().StringVar(&tlsKeyFile, "tls-key", tlsKeyFile, "server private key")
+	cmdServe.Flags().StringVar(&tlsClientCAFile, "tls-client-ca", tlsClientCAFile, "CA bundle for client certificates, enables mutual TLS")
+	cmdServe.Flags().StringVar(&tlsCertIdentity, "tls-cert-identity", tlsCertIdentity, "bind node UUIDs to client certificates (cn, san)")
+	cmdServe.Flags().DurationVar(&tlsReloadInterval, "tls-reload-interval", tlsReloadInterval, "how often to check TLS files for changes")
 }
 
 func runServe(cmd *cobra.Command, cmdArgs []string) error {
@@ -33,13 +78,257 @@ func runServe(cmd *cobra.Command, cmdArgs []string) error {
 		"port":    port,
 	}).Info("starting service")
 
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fileCfg, err := loadFileConfig(configFile)
+	if err != nil {
+		return err
+	}
+	authenticator, err := fileCfg.authenticator()
+	if err != nil {
+		return err
+	}
+	groups, err := fileCfg.groups()
+	if err != nil {
+		return err
+	}
+	webhooks, err := fileCfg.webhooks()
+	if err != nil {
+		return err
+	}
+	nodePattern, err := regexp.Compile("^(?:" + nodeUUIDPattern + ")$")
+	if err != nil {
+		return fmt.Errorf("invalid node UUID pattern: %s", err)
+	}
+
+	tlsReloader, err := newServerTLS()
+	if err != nil {
+		return err
+	}
+	if tlsReloader != nil {
+		go tlsReloader.Run(ctx, tlsReloadInterval)
+	}
+
+	etcdConfig, err := newEtcdConfig()
+	if err != nil {
+		return err
+	}
+	var client *clientv3.Client
+	if lockBackend == "etcd" || auditBackend == "etcd" {
+		client, err = connectEtcd(ctx, etcdConfig)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+	}
+	backend, err := newLockBackend(client, etcdConfig.KeyPrefix)
+	if err != nil {
+		return err
+	}
+	checkCtx, checkCancel := context.WithTimeout(ctx, lockTimeout)
+	defer checkCancel()
+	if err := lock.CheckSchema(checkCtx, backend); err != nil {
+		return err
+	}
+
 	config := server.ServerConfig{
-		EtcdURLs:       etcdURLs,
+		Etcd:           etcdConfig,
 		LockTimeout:    lockTimeout,
 		SemaphoreSlots: semaphoreSlots,
+		Backend:        backend,
+		EtcdClient:     client,
+		CertIdentity:   tlsCertIdentity,
+		Auth:           authenticator,
+
+		MaxBodyBytes:    maxBodyBytes,
+		NodeUUIDPattern: nodePattern,
+		RateLimiter:     fileCfg.rateLimiter(),
+
+		Groups:                groups,
+		RestrictGroups:        fileCfg.RestrictGroups,
+		DisableImplicitGroups: fileCfg.DisableImplicitGroups,
+		Rollouts:              fileCfg.rollouts(),
+		VersionTTL:            versionTTL,
+		Webhooks:              webhooks,
+	}
+	auditLog, err := newAuditLog(client, etcdConfig.KeyPrefix)
+	if err != nil {
+		return err
+	}
+	if auditLog != nil {
+		defer auditLog.Close()
+		config.AuditLog = auditLog
+		go audit.RunRetention(ctx, auditLog, auditRetention, auditPruneInterval)
+	}
+
+	config.EnableWebhookEvents()
+
+	initCtx, initCancel := context.WithTimeout(ctx, lockTimeout)
+	defer initCancel()
+	if err := config.EnsureGroups(initCtx); err != nil {
+		return err
+	}
+	go config.WatchGroupMetrics(ctx)
+	go config.EnforceBudgets(ctx)
+	webhooksDone := make(chan struct{})
+	go func() {
+		webhooks.Run(ctx, webhookDrainTimeout)
+		close(webhooksDone)
+	}()
+
+	handlers := map[string]http.Handler{
+		server.PreRebootEndpoint:     config.PreReboot(),
+		server.SteadyStateEndpoint:   config.SteadyState(),
+		server.ReportFailureEndpoint: config.ReportFailure(),
+		server.HeartbeatEndpoint:     config.Heartbeat(),
+		server.VerifyEndpoint:        config.Verify(),
+		server.RolloutsEndpoint:      config.RolloutsStatus(),
+		server.GroupsEndpoint:        config.GroupsStatus(),
+		server.EventsEndpoint:        config.Events(),
+		server.AuditEndpoint:         config.Audit(),
+		server.MetricsEndpoint:       config.Metrics(),
+		server.LivenessEndpoint:      config.Liveness(),
+		server.ReadinessEndpoint:     config.Readiness(),
+	}
+	// Probes and metrics scrapers connect without a client certificate.
+	public := map[string]bool{
+		server.MetricsEndpoint:   true,
+		server.LivenessEndpoint:  true,
+		server.ReadinessEndpoint: true,
+	}
+	// Lock requests are authenticated for their node and groups, and
+	// probes not at all.
+	unauthenticated := map[string]bool{
+		server.PreRebootEndpoint:     true,
+		server.SteadyStateEndpoint:   true,
+		server.ReportFailureEndpoint: true,
+		server.HeartbeatEndpoint:     true,
+		server.VerifyEndpoint:        true,
+		server.LivenessEndpoint:      true,
+		server.ReadinessEndpoint:     true,
+	}
+	mux := http.NewServeMux()
+	for endpoint, handler := range handlers {
+		if !unauthenticated[endpoint] {
+			handler = server.RequireAuth(authenticator, handler)
+		}
+		if tlsClientCAFile != "" && !public[endpoint] {
+			handler = server.RequireClientCert(handler)
+		}
+		mux.Handle(endpoint, server.Instrument(endpoint, handler))
+	}
+
+	// Event streams end once draining starts, other requests are
+	// completed on shutdown.
+	httpServer := &http.Server{
+		Addr:    listenAddr,
+		Handler: mux,
+	}
+	serveErr := make(chan error, 1)
+	go func() {
+		if tlsReloader != nil {
+			httpServer.TLSConfig = tlsReloader.ServerConfig()
+			serveErr <- httpServer.ListenAndServeTLS("", "")
+			return
+		}
+		serveErr <- httpServer.ListenAndServe()
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-serveErr:
+		return err
+	case sig := <-signals:
+		logrus.WithField("signal", sig).Info("draining before shutdown")
+	}
+
+	// Fail readiness first, so that load balancers stop routing
+	// requests here before the listener goes away.
+	config.StartDraining()
+	time.Sleep(shutdownDelay)
+
+	logrus.Info("shutting down")
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer shutdownCancel()
+	err = httpServer.Shutdown(shutdownCtx)
+
+	// Background tasks stop once no request can queue webhook events
+	// anymore, which are then delivered within a bounded time.
+	cancel()
+	<-webhooksDone
+	return err
+}
+
+// addAuditFlags registers the flags selecting and configuring the audit
+// trail, which records lock decisions and admin actions.
+func addAuditFlags(flags *pflag.FlagSet) {
+	flags.StringVar(&auditBackend, "audit-backend", auditBackend, "audit trail backend (none, etcd, file)")
+	flags.StringVar(&auditFile, "audit-file", auditFile, "path of the JSON-lines audit trail, for the file backend")
+}
+
+// newAuditLog returns the configured audit trail, or nil if disabled.
+func newAuditLog(client *clientv3.Client, keyPrefix string) (audit.Log, error) {
+	switch auditBackend {
+	case "", "none":
+		return nil, nil
+	case "file":
+		return audit.NewFileLog(auditFile)
+	case "etcd":
+		return audit.NewEtcdLog(client, keyPrefix)
+	default:
+		return nil, fmt.Errorf("unknown audit backend %q", auditBackend)
+	}
+}
+
+// recordAdminAction appends an entry for an admin action run by `ctl` to
+// the audit trail, if enabled. Failures to record are only logged, as the
+// action itself already happened.
+func recordAdminAction(ctx context.Context, auditLog audit.Log, entry audit.Entry, err error) {
+	if auditLog == nil {
+		return
+	}
+
+	entry.Outcome = audit.OutcomeDone
+	if err != nil {
+		entry.Outcome = audit.OutcomeFailed
+		entry.Message = err.Error()
+	}
+	entry.Requester = "ctl"
+	if user := os.Getenv("USER"); user != "" {
+		entry.Requester += ":" + user
+	}
+	if host, herr := os.Hostname(); herr == nil {
+		entry.Requester += "@" + host
+	}
+
+	if aerr := auditLog.Append(ctx, entry); aerr != nil {
+		logrus.WithFields(logrus.Fields{
+			"action": entry.Action,
+			"group":  entry.Group,
+		}).Errorf("failed to record audit entry: %s", aerr)
+	}
+}
+
+// newServerTLS returns a reloader for the HTTPS key pair and client CA,
+// or nil if TLS is disabled.
+func newServerTLS() (*tlsutil.Reloader, error) {
+	switch tlsCertIdentity {
+	case server.CertIdentityNone, server.CertIdentityCN, server.CertIdentitySAN:
+	default:
+		return nil, fmt.Errorf("unknown certificate identity binding %q", tlsCertIdentity)
+	}
+
+	if tlsCertFile == "" && tlsKeyFile == "" {
+		if tlsClientCAFile != "" || tlsCertIdentity != server.CertIdentityNone {
+			return nil, errors.New("mutual TLS requires a server certificate and key")
+		}
+		return nil, nil
+	}
+	if tlsCertIdentity != server.CertIdentityNone && tlsClientCAFile == "" {
+		return nil, errors.New("certificate identity binding requires a client CA")
 	}
 
-	http.Handle(server.PreRebootEndpoint, config.PreReboot())
-	http.Handle(server.SteadyStateEndpoint, config.SteadyState())
-	return http.ListenAndServe(listenAddr, nil)
+	return tlsutil.NewReloader(tlsCertFile, tlsKeyFile, tlsClientCAFile)
 }
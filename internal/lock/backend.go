@@ -0,0 +1,216 @@
+package lock
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+)
+
+var (
+	// ErrNilBackend is returned on nil lock backend.
+	ErrNilBackend = errors.New("nil lock backend")
+	// ErrCompacted is returned when watching from a revision which is no
+	// longer available.
+	ErrCompacted = errors.New("requested revision has been compacted")
+)
+
+// Backend stores the semaphores of all groups, and the member records of
+// their nodes.
+//
+// Each semaphore has a version, increasing on every write, which is used
+// for compare-and-swap updates. Writes also advance a backend-wide
+// revision, which orders changes across groups.
+//
+// Member records are stored apart from semaphores, one per node, so that
+// heartbeats neither rewrite semaphores nor show up in their watches.
+type Backend interface {
+	// Get returns the semaphore of a group and its version,
+	// or ErrUnknownGroup if it does not exist.
+	Get(ctx context.Context, group string) (*Semaphore, int64, error)
+	// CompareAndSwap atomically writes all updates, if the version of
+	// every semaphore still matches, returning the revision of the write.
+	// A zero version means that the semaphore must not exist yet, and a
+	// nil semaphore only compares the version without writing.
+	// It returns ErrConflict if any version does not match.
+	CompareAndSwap(ctx context.Context, updates ...Update) (int64, error)
+	// List returns the semaphores of all groups, together with the
+	// revision they have been read at.
+	List(ctx context.Context) (map[string]*Semaphore, int64, error)
+	// Watch streams semaphore changes to `fn`, optionally filtered by
+	// group, starting from the given revision (or from now, if zero),
+	// until the context is canceled or an error occurs.
+	Watch(ctx context.Context, group string, fromRevision int64, fn func(Change) error) error
+	// Members returns the unexpired member records of a group, by node.
+	Members(ctx context.Context, group string) (map[string]Member, error)
+	// SetMember writes the member record of a node in a group, and drops
+	// the records of the group which expired before its heartbeat.
+	SetMember(ctx context.Context, group, node string, member Member) error
+}
+
+// Update is a conditional write of a semaphore.
+type Update struct {
+	Group string
+	// Semaphore is the value to write, or nil to only compare the version.
+	Semaphore *Semaphore
+	// Version is the expected current version, or zero for creation.
+	Version int64
+	// Members, if not nil, are the expected health of all unexpired
+	// member records of the group, by node, which is compared but not
+	// written. Records added or dropped since conflict too, but mere
+	// refreshes of a heartbeat do not.
+	Members map[string]bool
+}
+
+// Member is the last heartbeat of a node in a group.
+type Member struct {
+	Heartbeat
+	// Expires is the time (in Unix seconds) after which the record is dropped.
+	Expires int64 `json:"expires"`
+	// Version changes on every write of the record, for backends which
+	// compare records in transactions.
+	Version int64 `json:"version,omitempty"`
+}
+
+// Change is a semaphore write, as observed by a watch.
+type Change struct {
+	Group string
+	// Prev is the previous semaphore, nil on creation.
+	Prev *Semaphore
+	// Cur is the new semaphore, nil on removal.
+	Cur      *Semaphore
+	Revision int64
+}
+
+// storedSemaphore is a semaphore together with its version and the
+// revision of its last write, as persisted by backends storing whole documents.
+type storedSemaphore struct {
+	Version   int64      `json:"version"`
+	Revision  int64      `json:"revision"`
+	Semaphore *Semaphore `json:"semaphore"`
+}
+
+// expired returns whether a member record expired at `now` (in Unix seconds).
+func (m Member) expired(now int64) bool {
+	return m.Expires < now
+}
+
+// checkMembers returns ErrConflict unless the expected member records
+// are still unexpired at `now` (in Unix seconds) with the same health,
+// and no other record is.
+func checkMembers(expected map[string]bool, members map[string]Member, now int64) error {
+	for node, healthy := range expected {
+		member, ok := members[node]
+		if !ok || member.expired(now) || member.Healthy != healthy {
+			return ErrConflict
+		}
+	}
+	for node, member := range members {
+		if _, ok := expected[node]; !ok && !member.expired(now) {
+			return ErrConflict
+		}
+	}
+
+	return nil
+}
+
+// decodeMember parses a persisted member record.
+func decodeMember(data []byte) (Member, error) {
+	member := Member{}
+	err := json.Unmarshal(data, &member)
+	return member, err
+}
+
+// decodeStoredSemaphore parses a persisted semaphore.
+func decodeStoredSemaphore(data []byte) (*storedSemaphore, error) {
+	record := &storedSemaphore{}
+	if err := json.Unmarshal(data, record); err != nil {
+		return nil, err
+	}
+	if record.Semaphore == nil {
+		return nil, ErrNilSemaphore
+	}
+
+	return record, nil
+}
+
+// watchSnapshots implements Watch for backends without a change history,
+// by diffing snapshots of all semaphores taken periodically and whenever
+// the channel returned by `wakeup` is closed. Past changes cannot be
+// replayed, thus it returns ErrCompacted if any semaphore has been written
+// at or after `fromRevision`.
+func watchSnapshots(ctx context.Context, group string, fromRevision int64, interval time.Duration,
+	snapshot func() (map[string]*storedSemaphore, int64, error), wakeup func() <-chan struct{}, fn func(Change) error) error {
+	notify := wakeup()
+	seen, revision, err := snapshot()
+	if err != nil {
+		return err
+	}
+	if fromRevision > 0 && fromRevision <= revision {
+		for _, record := range seen {
+			if record.Revision >= fromRevision {
+				return ErrCompacted
+			}
+		}
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-notify:
+		case <-ticker.C:
+		}
+
+		notify = wakeup()
+		records, revision, err := snapshot()
+		if err != nil {
+			return err
+		}
+		for _, change := range diffRecords(seen, records, revision) {
+			if group != "" && change.Group != group {
+				continue
+			}
+			if err := fn(change); err != nil {
+				return err
+			}
+		}
+		seen = records
+	}
+}
+
+// diffRecords returns the changes between two snapshots of semaphores,
+// ordered by revision. Removed semaphores have no revision of their own,
+// and are reported at the latest one.
+func diffRecords(prev, cur map[string]*storedSemaphore, revision int64) []Change {
+	changes := []Change{}
+	for group, old := range prev {
+		if _, ok := cur[group]; !ok {
+			changes = append(changes, Change{Group: group, Prev: old.Semaphore, Revision: revision})
+		}
+	}
+	for group, record := range cur {
+		old, existed := prev[group]
+		if existed && old.Revision == record.Revision {
+			continue
+		}
+		change := Change{Group: group, Cur: record.Semaphore, Revision: record.Revision}
+		if existed {
+			change.Prev = old.Semaphore
+		}
+		changes = append(changes, change)
+	}
+
+	// Groups written together share a revision.
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].Revision != changes[j].Revision {
+			return changes[i].Revision < changes[j].Revision
+		}
+		return changes[i].Group < changes[j].Group
+	})
+
+	return changes
+}
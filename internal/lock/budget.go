@@ -0,0 +1,236 @@
+package lock
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	// maxVersionFailures bounds the number of attempted versions tracked
+	// per semaphore.
+	maxVersionFailures = 32
+	// maxNodeFailures bounds the number of nodes whose last failure is
+	// tracked per semaphore.
+	maxNodeFailures = 32
+)
+
+// Budget bounds how long holders may keep their slot in a group, and how
+// many failures the group tolerates before being paused.
+type Budget struct {
+	// MaxHold is the maximum hold duration, zero meaning unbounded.
+	MaxHold time.Duration
+	// MaxFailures is the number of failures which pauses the group,
+	// zero meaning never.
+	MaxFailures uint64
+}
+
+// EnforceBudget counts holders of the group of the manager which exceeded
+// the maximum hold duration as failures, each one once, pausing the group
+// when its failure budget is exhausted. Holders without an acquisition
+// time are timed from now on.
+//
+// It returns the pause reason if this check paused the group, or an empty
+// string otherwise.
+func (m *Manager) EnforceBudget(ctx context.Context, budget Budget, now time.Time) (string, error) {
+	var reason string
+	err := m.retryOnConflict(func() error {
+		var err error
+		reason, err = m.enforceBudget(ctx, budget, now)
+		return err
+	})
+
+	return reason, err
+}
+
+func (m *Manager) enforceBudget(ctx context.Context, budget Budget, now time.Time) (string, error) {
+	if budget.MaxHold <= 0 {
+		return "", nil
+	}
+	updates, err := m.get(ctx, m.groups[:1])
+	if err != nil {
+		return "", err
+	}
+	sem := updates[0].Semaphore
+
+	changed, paused := false, false
+	for _, h := range sem.Holders {
+		if _, ok := sem.Acquired[h]; !ok {
+			sem.setAcquired(h, now)
+			changed = true
+		}
+	}
+	for _, h := range sem.OverdueHolders(budget.MaxHold, now) {
+		if containsHolder(sem.Overdue, h) {
+			continue
+		}
+		sem.Overdue = insertString(sem.Overdue, h)
+		cause := fmt.Sprintf("node %s held its slot for more than %s", h, budget.MaxHold)
+		paused = sem.recordFailure(budget.MaxFailures, cause) || paused
+		changed = true
+	}
+	if !changed {
+		return "", nil
+	}
+
+	if _, err := m.set(ctx, updates); err != nil {
+		return "", err
+	}
+	if paused {
+		return sem.PauseReason, nil
+	}
+
+	return "", nil
+}
+
+// Pause stops granting new slots in all groups of the manager, recording
+// the reason. Groups already paused keep their original reason.
+func (m *Manager) Pause(ctx context.Context, reason string) error {
+	return m.retryOnConflict(func() error {
+		return m.setPaused(ctx, true, reason)
+	})
+}
+
+// Resume grants new slots again in all groups of the manager, resetting
+// their failure counts.
+func (m *Manager) Resume(ctx context.Context) error {
+	return m.retryOnConflict(func() error {
+		return m.setPaused(ctx, false, "")
+	})
+}
+
+func (m *Manager) setPaused(ctx context.Context, paused bool, reason string) error {
+	updates, err := m.get(ctx, m.groups)
+	if err != nil {
+		return err
+	}
+
+	changed := false
+	for _, u := range updates {
+		sem := u.Semaphore
+		switch {
+		case paused && !sem.Paused:
+			sem.Paused, sem.PauseReason = true, reason
+			changed = true
+		case !paused && (sem.Paused || sem.Failures > 0):
+			sem.Paused, sem.PauseReason, sem.Failures = false, "", 0
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	_, err = m.set(ctx, updates)
+	return err
+}
+
+// Failure is a failed update reported by a node.
+type Failure struct {
+	// Version is the version the node attempted to update to.
+	Version string
+	// Description is the error reported by the node.
+	Description string
+	// Release gives back the slots of the node in all groups.
+	Release bool
+	// Budgets are the limits of the groups in which the failure is
+	// counted, by group name.
+	Budgets map[string]Budget
+}
+
+// NodeFailure is the last failure reported by a node.
+type NodeFailure struct {
+	// Version is the version the node attempted to update to.
+	Version string `json:"version"`
+	// Time is when the failure was reported, in Unix seconds.
+	Time int64 `json:"time"`
+}
+
+// ReportFailure records a failure reported by this lock id in a single
+// update of all groups, optionally releasing its slots. The failure is
+// counted against the budget of each group in `failure.Budgets`, per
+// attempted version and per node.
+//
+// It returns the pause reasons of the groups paused by this failure.
+func (m *Manager) ReportFailure(ctx context.Context, id string, failure Failure) (map[string]string, error) {
+	var paused map[string]string
+	err := m.retryOnConflict(func() error {
+		var err error
+		paused, err = m.reportFailure(ctx, id, failure)
+		return err
+	})
+
+	return paused, err
+}
+
+func (m *Manager) reportFailure(ctx context.Context, id string, failure Failure) (map[string]string, error) {
+	updates, err := m.get(ctx, m.groups)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	paused := map[string]string{}
+	cause := fmt.Sprintf("node %s failed to update to %q: %s", id, failure.Version, failure.Description)
+	for _, u := range updates {
+		sem := u.Semaphore
+		if failure.Release {
+			if err := sem.UnlockIfHeld(id); err != nil {
+				return nil, err
+			}
+		}
+		budget, ok := failure.Budgets[u.Group]
+		if !ok {
+			continue
+		}
+		sem.recordVersionFailure(failure.Version)
+		sem.recordNodeFailure(id, failure.Version, now)
+		if sem.recordFailure(budget.MaxFailures, cause) {
+			paused[u.Group] = sem.PauseReason
+		}
+	}
+
+	if _, err := m.set(ctx, updates); err != nil {
+		return nil, err
+	}
+
+	return paused, nil
+}
+
+// recordVersionFailure counts a failure against an attempted version.
+// Only the `maxVersionFailures` versions with most failures are kept,
+// evicting the one with fewest failures (the lowest one on ties).
+func (s *Semaphore) recordVersionFailure(version string) {
+	if s.VersionFailures == nil {
+		s.VersionFailures = map[string]uint64{}
+	}
+	if _, ok := s.VersionFailures[version]; !ok && len(s.VersionFailures) >= maxVersionFailures {
+		evict := ""
+		for v, n := range s.VersionFailures {
+			if evict == "" || n < s.VersionFailures[evict] || (n == s.VersionFailures[evict] && v < evict) {
+				evict = v
+			}
+		}
+		delete(s.VersionFailures, evict)
+	}
+	s.VersionFailures[version]++
+}
+
+// recordNodeFailure records the last failure of a node. Only the
+// `maxNodeFailures` most recent nodes are kept, evicting the one with the
+// oldest failure (the lowest one on ties).
+func (s *Semaphore) recordNodeFailure(node string, version string, at time.Time) {
+	if s.NodeFailures == nil {
+		s.NodeFailures = map[string]NodeFailure{}
+	}
+	if _, ok := s.NodeFailures[node]; !ok && len(s.NodeFailures) >= maxNodeFailures {
+		evict := ""
+		for n, f := range s.NodeFailures {
+			if evict == "" || f.Time < s.NodeFailures[evict].Time || (f.Time == s.NodeFailures[evict].Time && n < evict) {
+				evict = n
+			}
+		}
+		delete(s.NodeFailures, evict)
+	}
+	s.NodeFailures[node] = NodeFailure{Version: version, Time: at.Unix()}
+}
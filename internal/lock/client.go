@@ -0,0 +1,158 @@
+package lock
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+	"github.com/lucab/exp-locksmith2/internal/tlsutil"
+	"go.etcd.io/etcd/clientv3"
+)
+
+const (
+	// defaultDialTimeout bounds the initial connection to etcd.
+	defaultDialTimeout = 5 * time.Second
+	// defaultCertReloadInterval is how often client certificates are checked for rotation.
+	defaultCertReloadInterval = time.Minute
+)
+
+// ClientConfig holds settings for connecting to etcd.
+type ClientConfig struct {
+	Endpoints []string
+	// CAFile is the CA bundle for verifying etcd server certificates.
+	CAFile string
+	// CertFile and KeyFile are the client key pair, for TLS authentication.
+	CertFile string
+	KeyFile  string
+	// Username and Password are the credentials of an etcd RBAC user.
+	Username string
+	Password string
+	// DialTimeout bounds the initial connection (default 5s).
+	DialTimeout time.Duration
+	// CertReloadInterval is how often the client key pair is reloaded (default 1m).
+	CertReloadInterval time.Duration
+	// KeyPrefix is the root of all keys (default DefaultKeyPrefix, see KeyPrefix).
+	KeyPrefix string
+}
+
+// NewClient returns a new etcd client. Rotated client certificates and CA
+// bundles are picked up on new connections, until the context is canceled.
+func NewClient(ctx context.Context, cfg ClientConfig) (*clientv3.Client, error) {
+	if len(cfg.Endpoints) == 0 {
+		return nil, errors.New("no etcd endpoints configured")
+	}
+	if (cfg.Username == "") != (cfg.Password == "") {
+		return nil, errors.New("etcd username and password must be specified together")
+	}
+
+	clientCfg := clientv3.Config{
+		Endpoints:   cfg.Endpoints,
+		DialTimeout: cfg.DialTimeout,
+		Username:    cfg.Username,
+		Password:    cfg.Password,
+	}
+	if clientCfg.DialTimeout == 0 {
+		clientCfg.DialTimeout = defaultDialTimeout
+	}
+
+	if cfg.CAFile != "" || cfg.CertFile != "" || cfg.KeyFile != "" {
+		reloader, err := tlsutil.NewReloader(cfg.CertFile, cfg.KeyFile, cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load etcd TLS files: %s", err)
+		}
+		interval := cfg.CertReloadInterval
+		if interval == 0 {
+			interval = defaultCertReloadInterval
+		}
+		go reloader.Run(ctx, interval)
+
+		clientCfg.TLS = clientTLSConfig(reloader)
+	}
+
+	client, err := clientv3.New(clientCfg)
+	if err != nil {
+		return nil, describeClientError(cfg, err)
+	}
+
+	return client, nil
+}
+
+// clientTLSConfig returns a TLS configuration presenting the current client
+// key pair of a reloader, if any, and verifying servers against its current
+// CA bundle (or the system roots, if none).
+func clientTLSConfig(reloader *tlsutil.Reloader) *tls.Config {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// The built-in verification is bound to a fixed `RootCAs` pool,
+		// it is replaced by `VerifyConnection` below.
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("etcd server presented no certificate")
+			}
+			opts := x509.VerifyOptions{
+				DNSName:       cs.ServerName,
+				Roots:         reloader.CAPool(),
+				Intermediates: x509.NewCertPool(),
+			}
+			for _, cert := range cs.PeerCertificates[1:] {
+				opts.Intermediates.AddCert(cert)
+			}
+			_, err := cs.PeerCertificates[0].Verify(opts)
+			return err
+		},
+	}
+	if reloader.Certificate() != nil {
+		cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return reloader.Certificate(), nil
+		}
+	}
+
+	return cfg
+}
+
+// CheckAccess verifies that the client can read semaphores, returning
+// a descriptive error on authentication or authorization failures.
+func CheckAccess(ctx context.Context, client *clientv3.Client, cfg ClientConfig) error {
+	if client == nil {
+		return ErrNilClient
+	}
+
+	_, err := client.Get(ctx, cfg.groupsPrefix(), clientv3.WithPrefix(), clientv3.WithCountOnly())
+	if err != nil {
+		return describeClientError(cfg, err)
+	}
+
+	return nil
+}
+
+// groupsPrefix returns the key prefix of all semaphores.
+func (cfg ClientConfig) groupsPrefix() string {
+	if cfg.KeyPrefix == "" {
+		return DefaultKeyPrefix + groupsSegment
+	}
+	return cfg.KeyPrefix + groupsSegment
+}
+
+// describeClientError turns etcd connection and authentication errors
+// into actionable ones.
+func describeClientError(cfg ClientConfig, err error) error {
+	switch rpctypes.Error(err) {
+	case rpctypes.ErrAuthFailed:
+		return fmt.Errorf("etcd authentication failed for user %q: invalid username or password", cfg.Username)
+	case rpctypes.ErrUserEmpty:
+		return errors.New("etcd requires authentication, but no username was configured")
+	case rpctypes.ErrInvalidAuthToken:
+		return fmt.Errorf("etcd rejected the authentication token for user %q", cfg.Username)
+	case rpctypes.ErrPermissionDenied:
+		return fmt.Errorf("etcd user %q is not allowed to access %q", cfg.Username, cfg.groupsPrefix())
+	case context.DeadlineExceeded:
+		return fmt.Errorf("timed out connecting to etcd at %v, check endpoints and TLS settings", cfg.Endpoints)
+	default:
+		return fmt.Errorf("failed to connect to etcd at %v: %s", cfg.Endpoints, err)
+	}
+}
@@ -0,0 +1,164 @@
+package lock
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lucab/exp-locksmith2/internal/tlsutil"
+)
+
+// testPKI is a throw-away CA with leaf key pairs, written to a directory.
+type testPKI struct {
+	dir    string
+	caCert *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+	caFile string
+}
+
+func newTestPKI(t *testing.T, dir string) *testPKI {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "locksmith2 test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return &testPKI{dir, cert, key, caFile}
+}
+
+// issue writes a leaf key pair for `cn`, valid for localhost.
+func (p *testPKI) issue(t *testing.T, cn string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, p.caCert, &key.PublicKey, p.caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(p.dir, cn+".pem")
+	keyFile := filepath.Join(p.dir, cn+"-key.pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return certFile, keyFile
+}
+
+func TestClientCARotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "locksmith2-etcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldDir, newDir := filepath.Join(dir, "old"), filepath.Join(dir, "new")
+	for _, d := range []string{oldDir, newDir} {
+		if err := os.Mkdir(d, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	oldPKI, newPKI := newTestPKI(t, oldDir), newTestPKI(t, newDir)
+	certFile, keyFile := newPKI.issue(t, "localhost")
+	serverCert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caFile := filepath.Join(dir, "ca.pem")
+	copyFile := func(src string) {
+		pem, err := ioutil.ReadFile(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(caFile, pem, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	copyFile(oldPKI.caFile)
+	reloader, err := tlsutil.NewReloader("", "", caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := clientTLSConfig(reloader)
+
+	handshake := func(serverName string) error {
+		clientConn, serverConn := net.Pipe()
+		defer clientConn.Close()
+		defer serverConn.Close()
+		go tls.Server(serverConn, &tls.Config{Certificates: []tls.Certificate{serverCert}}).Handshake()
+
+		clientCfg := cfg.Clone()
+		clientCfg.ServerName = serverName
+		return tls.Client(clientConn, clientCfg).Handshake()
+	}
+
+	if err := handshake("localhost"); err == nil {
+		t.Error("unexpected handshake success with an untrusted CA")
+	}
+
+	copyFile(newPKI.caFile)
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(caFile, future, future); err != nil {
+		t.Fatal(err)
+	}
+	if reloaded, err := reloader.Reload(); err != nil || !reloaded {
+		t.Fatalf("failed to reload CA bundle: %t %v", reloaded, err)
+	}
+	if err := handshake("localhost"); err != nil {
+		t.Errorf("unexpected handshake failure after CA rotation: %s", err)
+	}
+	if err := handshake("other.example.com"); err == nil {
+		t.Error("unexpected handshake success with a mismatched server name")
+	}
+}
@@ -0,0 +1,175 @@
+package lock
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	// DefaultHeartbeatTTL is the default age after which a heartbeat
+	// is not recent anymore.
+	DefaultHeartbeatTTL = 2 * time.Minute
+	// DefaultForgetAfter is the default age after which a node without
+	// heartbeats is not a known member of a group anymore.
+	DefaultForgetAfter = 24 * time.Hour
+
+	// minHeartbeatInterval coalesces frequent heartbeats without a
+	// health change, sparing writes which conflict with taking slots.
+	minHeartbeatInterval = 10 * time.Second
+)
+
+// Heartbeat is the last heartbeat of a node in a group.
+type Heartbeat struct {
+	// Time is in Unix seconds.
+	Time    int64 `json:"time"`
+	Healthy bool  `json:"healthy"`
+}
+
+// DisruptionBudget requires a minimum number of the known nodes of a
+// group to stay available, i.e. to have a recent healthy heartbeat and
+// not to hold a slot, after granting a slot.
+type DisruptionBudget struct {
+	// MinAvailable is a number of nodes. If zero, MinAvailablePercent is
+	// a percentage of known nodes, rounded up.
+	MinAvailable        int
+	MinAvailablePercent int
+	// HeartbeatTTL is how recent a healthy heartbeat must be (default
+	// `DefaultHeartbeatTTL`).
+	HeartbeatTTL time.Duration
+	// ForgetAfter is how long a node without heartbeats stays known
+	// (default `DefaultForgetAfter`).
+	ForgetAfter time.Duration
+}
+
+// DisruptionError is returned when taking a slot would leave fewer
+// available nodes in a group than its disruption budget requires.
+type DisruptionError struct {
+	Group string
+	// Required and Available are numbers of nodes, out of Known ones.
+	Required  int
+	Available int
+	Known     int
+}
+
+func (e *DisruptionError) Error() string {
+	return fmt.Sprintf("group %q requires %d available nodes, only %d of %d known would remain", e.Group, e.Required, e.Available, e.Known)
+}
+
+// Required returns the number of nodes which must stay available, out of
+// `known` ones.
+func (b DisruptionBudget) Required(known int) int {
+	if b.MinAvailable > 0 {
+		return b.MinAvailable
+	}
+	return (known*b.MinAvailablePercent + 99) / 100
+}
+
+func (b DisruptionBudget) heartbeatTTL() time.Duration {
+	if b.HeartbeatTTL > 0 {
+		return b.HeartbeatTTL
+	}
+	return DefaultHeartbeatTTL
+}
+
+func (b DisruptionBudget) forgetAfter() time.Duration {
+	if b.ForgetAfter > 0 {
+		return b.ForgetAfter
+	}
+	return DefaultForgetAfter
+}
+
+// WithDisruptionBudget returns a copy of the manager which enforces a
+// disruption budget on a group, in the same transaction taking the slot.
+func (m *Manager) WithDisruptionBudget(group string, budget DisruptionBudget) *Manager {
+	if m == nil {
+		return nil
+	}
+
+	budgeted := *m
+	budgeted.disruptions = map[string]DisruptionBudget{}
+	for g, b := range m.disruptions {
+		budgeted.disruptions[g] = b
+	}
+	budgeted.disruptions[groupName(group)] = budget
+	return &budgeted
+}
+
+// Availability returns the numbers of known and available nodes of a
+// semaphore at `now`, given the member records of its group. Known nodes
+// are current holders, and nodes with a heartbeat within `ForgetAfter`;
+// available ones are known nodes, not holding a slot, with a healthy
+// heartbeat within `HeartbeatTTL`.
+func (s *Semaphore) Availability(members map[string]Member, budget DisruptionBudget, now time.Time) (int, int) {
+	if s == nil {
+		return 0, 0
+	}
+
+	known, available := len(s.Holders), 0
+	for node, member := range members {
+		if containsHolder(s.Holders, node) {
+			continue
+		}
+		age := now.Sub(time.Unix(member.Time, 0))
+		if age > budget.forgetAfter() {
+			continue
+		}
+		known++
+		if member.Healthy && age <= budget.heartbeatTTL() {
+			available++
+		}
+	}
+
+	return known, available
+}
+
+// checkDisruption returns a DisruptionError if a semaphore, including the
+// holder just added, leaves fewer available nodes than the budget requires.
+func checkDisruption(group string, sem *Semaphore, members map[string]Member, budget DisruptionBudget, now time.Time) error {
+	known, available := sem.Availability(members, budget, now)
+	if required := budget.Required(known); available < required {
+		return &DisruptionError{group, required, available, known}
+	}
+
+	return nil
+}
+
+// memberHealth returns the health of member records, to be compared
+// when taking a slot. Availability only changes with the set of members
+// and their health, besides time passing, so heartbeats refreshing a
+// record do not conflict.
+func memberHealth(members map[string]Member) map[string]bool {
+	health := make(map[string]bool, len(members))
+	for node, member := range members {
+		health[node] = member.Healthy
+	}
+	return health
+}
+
+// Heartbeat records a heartbeat of this lock id in all groups, as the
+// membership view of disruption budgets. Member records are written
+// apart from semaphores, and expire `ForgetAfter` after the heartbeat.
+func (m *Manager) Heartbeat(ctx context.Context, id string, healthy bool, now time.Time) error {
+	if m == nil {
+		return ErrNilManager
+	}
+
+	hb := Heartbeat{now.Unix(), healthy}
+	for _, group := range m.groups {
+		members, err := m.backend.Members(ctx, group)
+		if err != nil {
+			return err
+		}
+		prev, ok := members[id]
+		if ok && prev.Healthy == hb.Healthy && hb.Time-prev.Time < int64(minHeartbeatInterval/time.Second) {
+			continue
+		}
+
+		expires := hb.Time + int64(m.disruptions[group].forgetAfter()/time.Second)
+		if err := m.backend.SetMember(ctx, group, id, Member{Heartbeat: hb, Expires: expires}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,347 @@
+package lock
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.etcd.io/etcd/clientv3"
+)
+
+const (
+	// DefaultKeyPrefix is the default root of all etcd keys.
+	DefaultKeyPrefix = "com.coreos.locksmith2/"
+
+	groupsSegment   = "groups/"
+	membersSegment  = "members/"
+	tenantsSegment  = "tenants/"
+	semaphoreSuffix = "/v1/semaphore"
+)
+
+var (
+	// tenantPattern restricts tenant names to a single key segment.
+	tenantPattern = regexp.MustCompile("^[A-Za-z0-9][A-Za-z0-9._-]*$")
+)
+
+// EtcdBackend stores semaphores in etcd, one key per group, confined
+// to a key prefix. Member records are stored under a separate prefix,
+// one key per node, so that semaphore watches do not see them.
+type EtcdBackend struct {
+	client        *clientv3.Client
+	groupsPrefix  string
+	membersPrefix string
+}
+
+// KeyPrefix returns the root of all etcd keys of a deployment, optionally
+// confined to the subtree of a tenant. An empty prefix means DefaultKeyPrefix.
+func KeyPrefix(prefix, tenant string) (string, error) {
+	if prefix == "" {
+		prefix = DefaultKeyPrefix
+	}
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	if tenant == "" {
+		return prefix, nil
+	}
+	if !tenantPattern.MatchString(tenant) {
+		return "", fmt.Errorf("invalid tenant name %q", tenant)
+	}
+
+	return prefix + tenantsSegment + tenant + "/", nil
+}
+
+// NewEtcdBackend returns a backend on top of an etcd client, storing
+// semaphores under `keyPrefix` (see KeyPrefix). The client is owned by
+// the caller.
+func NewEtcdBackend(client *clientv3.Client, keyPrefix string) (*EtcdBackend, error) {
+	if client == nil {
+		return nil, ErrNilClient
+	}
+	if keyPrefix == "" {
+		keyPrefix = DefaultKeyPrefix
+	}
+
+	return &EtcdBackend{client, keyPrefix + groupsSegment, keyPrefix + membersSegment}, nil
+}
+
+// Get returns the semaphore of a group and its version.
+func (b *EtcdBackend) Get(ctx context.Context, group string) (*Semaphore, int64, error) {
+	resp, err := b.client.Get(ctx, b.groupKey(group))
+	if err != nil {
+		etcdErrors.Inc("get")
+		return nil, 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, 0, ErrUnknownGroup
+	}
+
+	kv := resp.Kvs[0]
+	sem, err := decodeSemaphore(kv.Value)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return sem, kv.Version, nil
+}
+
+// CompareAndSwap writes all updates in a single transaction.
+//
+// Expected member records are checked against a fresh read of the records
+// of their group, and the transaction fails if any record of the group has
+// been written since that read. This only happens if a heartbeat races
+// this very call, and the caller retries.
+func (b *EtcdBackend) CompareAndSwap(ctx context.Context, updates ...Update) (int64, error) {
+	cmps := make([]clientv3.Cmp, 0, len(updates))
+	ops := make([]clientv3.Op, 0, len(updates))
+	for _, u := range updates {
+		key := b.groupKey(u.Group)
+		// version=0 means that the key does not exist.
+		cmps = append(cmps, clientv3.Compare(clientv3.Version(key), "=", u.Version))
+		if u.Members != nil {
+			memberCmps, err := b.compareMembers(ctx, u.Group, u.Members)
+			if err != nil {
+				return 0, err
+			}
+			cmps = append(cmps, memberCmps...)
+		}
+		if u.Semaphore == nil {
+			continue
+		}
+		value, err := u.Semaphore.String()
+		if err != nil {
+			return 0, err
+		}
+		ops = append(ops, clientv3.OpPut(key, value))
+	}
+
+	// If any condition is not met, the transaction will return as "not succeeding".
+	resp, err := b.client.Txn(ctx).If(cmps...).Then(ops...).Commit()
+	if err != nil {
+		etcdErrors.Inc("set")
+		return 0, err
+	}
+	if !resp.Succeeded {
+		return 0, ErrConflict
+	}
+
+	return resp.Header.Revision, nil
+}
+
+// List returns the semaphores of all groups.
+func (b *EtcdBackend) List(ctx context.Context) (map[string]*Semaphore, int64, error) {
+	resp, err := b.client.Get(ctx, b.groupsPrefix, clientv3.WithPrefix())
+	if err != nil {
+		etcdErrors.Inc("list")
+		return nil, 0, err
+	}
+
+	sems := make(map[string]*Semaphore, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		group, ok := b.groupFromKey(string(kv.Key))
+		if !ok {
+			continue
+		}
+		sem, err := decodeSemaphore(kv.Value)
+		if err != nil {
+			return nil, 0, err
+		}
+		sems[group] = sem
+	}
+
+	return sems, resp.Header.Revision, nil
+}
+
+// Watch streams semaphore changes from etcd.
+func (b *EtcdBackend) Watch(ctx context.Context, group string, fromRevision int64, fn func(Change) error) error {
+	key := b.groupsPrefix
+	opts := []clientv3.OpOption{clientv3.WithPrevKV()}
+	if group != "" {
+		key = b.groupKey(group)
+	} else {
+		opts = append(opts, clientv3.WithPrefix())
+	}
+	if fromRevision > 0 {
+		opts = append(opts, clientv3.WithRev(fromRevision))
+	}
+
+	watchCtx, cancel := context.WithCancel(clientv3.WithRequireLeader(ctx))
+	defer cancel()
+	for resp := range b.client.Watch(watchCtx, key, opts...) {
+		if resp.CompactRevision != 0 {
+			return ErrCompacted
+		}
+		if err := resp.Err(); err != nil {
+			etcdErrors.Inc("watch")
+			return err
+		}
+
+		for _, ev := range resp.Events {
+			evGroup, ok := b.groupFromKey(string(ev.Kv.Key))
+			if !ok {
+				continue
+			}
+
+			change := Change{Group: evGroup, Revision: ev.Kv.ModRevision}
+			var err error
+			if ev.PrevKv != nil {
+				if change.Prev, err = decodeSemaphore(ev.PrevKv.Value); err != nil {
+					return err
+				}
+			}
+			if ev.Type == clientv3.EventTypePut {
+				if change.Cur, err = decodeSemaphore(ev.Kv.Value); err != nil {
+					return err
+				}
+			}
+			if err := fn(change); err != nil {
+				return err
+			}
+		}
+	}
+
+	return ctx.Err()
+}
+
+// Members returns the unexpired member records of a group, versioned by
+// the revision of their last write.
+func (b *EtcdBackend) Members(ctx context.Context, group string) (map[string]Member, error) {
+	members, _, err := b.readMembers(ctx, group)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+	for node, member := range members {
+		if member.expired(now) {
+			delete(members, node)
+		}
+	}
+
+	return members, nil
+}
+
+// readMembers returns all member records of a group, including expired
+// ones, and the revision they have been read at.
+func (b *EtcdBackend) readMembers(ctx context.Context, group string) (map[string]Member, int64, error) {
+	resp, err := b.client.Get(ctx, b.memberKey(group, ""), clientv3.WithPrefix())
+	if err != nil {
+		etcdErrors.Inc("members")
+		return nil, 0, err
+	}
+
+	members := make(map[string]Member, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		node, err := url.QueryUnescape(strings.TrimPrefix(string(kv.Key), b.memberKey(group, "")))
+		if err != nil {
+			continue
+		}
+		member, err := decodeMember(kv.Value)
+		if err != nil {
+			return nil, 0, err
+		}
+		member.Version = kv.ModRevision
+		members[node] = member
+	}
+
+	return members, resp.Header.Revision, nil
+}
+
+// compareMembers checks the expected member records of a group, returning
+// the transaction conditions which keep them as read: the records are
+// unchanged, and no record of the group has been written since.
+func (b *EtcdBackend) compareMembers(ctx context.Context, group string, expected map[string]bool) ([]clientv3.Cmp, error) {
+	members, revision, err := b.readMembers(ctx, group)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkMembers(expected, members, time.Now().Unix()); err != nil {
+		return nil, err
+	}
+
+	cmps := []clientv3.Cmp{
+		clientv3.Compare(clientv3.ModRevision(b.memberKey(group, "")), "<=", revision).WithPrefix(),
+	}
+	for node := range expected {
+		cmps = append(cmps, clientv3.Compare(clientv3.ModRevision(b.memberKey(group, node)), "=", members[node].Version))
+	}
+
+	return cmps, nil
+}
+
+// SetMember writes the member record of a node. Expired records of the
+// group are deleted in the same transaction, unless they changed since
+// being read.
+func (b *EtcdBackend) SetMember(ctx context.Context, group, node string, member Member) error {
+	member.Version = 0
+	value, err := json.Marshal(member)
+	if err != nil {
+		return err
+	}
+	key := b.memberKey(group, node)
+
+	resp, err := b.client.Get(ctx, b.memberKey(group, ""), clientv3.WithPrefix())
+	if err != nil {
+		etcdErrors.Inc("members")
+		return err
+	}
+	cmps := []clientv3.Cmp{}
+	deletes := []clientv3.Op{}
+	for _, kv := range resp.Kvs {
+		other, err := decodeMember(kv.Value)
+		if err != nil || string(kv.Key) == key || !other.expired(member.Time) {
+			continue
+		}
+		cmps = append(cmps, clientv3.Compare(clientv3.ModRevision(string(kv.Key)), "=", kv.ModRevision))
+		deletes = append(deletes, clientv3.OpDelete(string(kv.Key)))
+	}
+
+	put := clientv3.OpPut(key, string(value))
+	_, err = b.client.Txn(ctx).If(cmps...).Then(append(deletes, put)...).Else(put).Commit()
+	if err != nil {
+		etcdErrors.Inc("members")
+	}
+	return err
+}
+
+// groupKey returns the etcd key holding the semaphore for a group.
+func (b *EtcdBackend) groupKey(customGroup string) string {
+	group := defaultGroup
+	if customGroup != "" {
+		group = url.QueryEscape(customGroup)
+	}
+
+	return b.groupsPrefix + group + semaphoreSuffix
+}
+
+// memberKey returns the etcd key holding the member record of a node,
+// or the prefix of all records of the group if `node` is empty.
+func (b *EtcdBackend) memberKey(group, node string) string {
+	return b.membersPrefix + url.QueryEscape(group) + "/" + url.QueryEscape(node)
+}
+
+// groupFromKey extracts the group name from a semaphore key.
+func (b *EtcdBackend) groupFromKey(key string) (string, bool) {
+	if !strings.HasPrefix(key, b.groupsPrefix) {
+		return "", false
+	}
+
+	escaped := strings.TrimPrefix(key, b.groupsPrefix)
+	if !strings.HasSuffix(escaped, semaphoreSuffix) {
+		return "", false
+	}
+	escaped = strings.TrimSuffix(escaped, semaphoreSuffix)
+	if escaped == "" || strings.Contains(escaped, "/") {
+		return "", false
+	}
+	group, err := url.QueryUnescape(escaped)
+	if err != nil {
+		return "", false
+	}
+
+	return group, true
+}
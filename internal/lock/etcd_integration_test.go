@@ -0,0 +1,425 @@
+package lock
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.etcd.io/etcd/clientv3"
+)
+
+// testEtcd is a single-member etcd cluster requiring client certificates,
+// run from the binary in $ETCD_BIN or the `etcd` one in $PATH.
+type testEtcd struct {
+	endpoint string
+	cmd      *exec.Cmd
+	// admin authenticates as `root` with its certificate Common Name,
+	// once authentication is enabled.
+	admin *clientv3.Client
+}
+
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// startTestEtcd runs etcd with a server certificate from `pki`, waiting
+// for it to serve requests. Tests are skipped if no binary is available.
+func startTestEtcd(t *testing.T, pki *testPKI) *testEtcd {
+	etcdBin := os.Getenv("ETCD_BIN")
+	if etcdBin == "" {
+		var err error
+		if etcdBin, err = exec.LookPath("etcd"); err != nil {
+			t.Skip("etcd binary not found in $ETCD_BIN nor $PATH")
+		}
+	}
+
+	certFile, keyFile := pki.issue(t, "localhost")
+	clientURL := fmt.Sprintf("https://127.0.0.1:%d", freePort(t))
+	peerURL := fmt.Sprintf("http://127.0.0.1:%d", freePort(t))
+	cmd := exec.Command(etcdBin,
+		"--name", "test",
+		"--data-dir", filepath.Join(pki.dir, "etcd"),
+		"--listen-client-urls", clientURL,
+		"--advertise-client-urls", clientURL,
+		"--listen-peer-urls", peerURL,
+		"--initial-advertise-peer-urls", peerURL,
+		"--initial-cluster", "test="+peerURL,
+		"--cert-file", certFile,
+		"--key-file", keyFile,
+		"--trusted-ca-file", pki.caFile,
+		"--client-cert-auth",
+	)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	etcd := &testEtcd{endpoint: clientURL, cmd: cmd}
+
+	rootCert, rootKey := pki.issue(t, "root")
+	cert, err := tls.LoadX509KeyPair(rootCert, rootKey)
+	if err != nil {
+		etcd.stop()
+		t.Fatal(err)
+	}
+	caPEM, err := ioutil.ReadFile(pki.caFile)
+	if err != nil {
+		etcd.stop()
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(caPEM)
+	etcd.admin, err = clientv3.New(clientv3.Config{
+		Endpoints:   []string{clientURL},
+		DialTimeout: 5 * time.Second,
+		TLS:         &tls.Config{Certificates: []tls.Certificate{cert}, RootCAs: pool},
+	})
+	if err != nil {
+		etcd.stop()
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 50; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		_, err = etcd.admin.Get(ctx, "health")
+		cancel()
+		if err == nil {
+			return etcd
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	etcd.stop()
+	t.Fatalf("etcd did not come up: %s", err)
+	return nil
+}
+
+func (e *testEtcd) stop() {
+	if e.admin != nil {
+		e.admin.Close()
+	}
+	e.cmd.Process.Kill()
+	e.cmd.Wait()
+}
+
+// addUser creates a user with read-write access to a key prefix, or
+// with the root role if the prefix is empty.
+func (e *testEtcd) addUser(t *testing.T, name, password, prefix string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	role := name
+	if _, err := e.admin.UserAdd(ctx, name, password); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.admin.RoleAdd(ctx, role); err != nil {
+		t.Fatal(err)
+	}
+	if prefix != "" {
+		perm := clientv3.PermissionType(clientv3.PermReadWrite)
+		if _, err := e.admin.RoleGrantPermission(ctx, role, prefix, clientv3.GetPrefixRangeEnd(prefix), perm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := e.admin.UserGrantRole(ctx, name, role); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// enableAuth turns on RBAC, which needs a `root` user.
+func (e *testEtcd) enableAuth(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := e.admin.AuthEnable(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// countKeys returns the number of keys below a prefix, or of all keys.
+func (e *testEtcd) countKeys(t *testing.T, prefix string) int {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	resp, err := e.admin.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithCountOnly())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return int(resp.Count)
+}
+
+func TestClientTLSAndAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "locksmith2-etcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pki := newTestPKI(t, dir)
+	etcd := startTestEtcd(t, pki)
+	defer etcd.stop()
+	endpoint := etcd.endpoint
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rootCert, rootKey := pki.issue(t, "root")
+	cfg := ClientConfig{
+		Endpoints:   []string{endpoint},
+		CAFile:      pki.caFile,
+		CertFile:    rootCert,
+		KeyFile:     rootKey,
+		DialTimeout: 2 * time.Second,
+	}
+
+	client, err := NewClient(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	backend, err := NewEtcdBackend(client, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager, err := NewManager(ctx, backend, "tls", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := manager.RecursiveLock(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := manager.RecursiveLock(ctx, "b"); err != ErrSemaphoreFull {
+		t.Errorf("unexpected error on full semaphore: %v", err)
+	}
+	if err := manager.UnlockIfHeld(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	noCert := ClientConfig{
+		Endpoints:   []string{endpoint},
+		CAFile:      pki.caFile,
+		DialTimeout: time.Second,
+	}
+	if c, err := NewClient(ctx, noCert); err == nil {
+		if err := CheckAccess(ctx, c, noCert); err == nil {
+			t.Error("unexpected access without client certificate")
+		}
+		c.Close()
+	}
+
+	// Enable RBAC, with an unprivileged user.
+	etcd.addUser(t, "root", "rootpw", "")
+	etcd.addUser(t, "nobody", "nobodypw", "unrelated/")
+	etcd.enableAuth(t)
+
+	wrongPassword := cfg
+	wrongPassword.Username, wrongPassword.Password = "nobody", "wrong"
+	if c, err := NewClient(ctx, wrongPassword); err == nil {
+		c.Close()
+		t.Error("unexpected success with wrong password")
+	} else if !strings.Contains(err.Error(), "authentication failed") {
+		t.Errorf("unexpected error with wrong password: %s", err)
+	}
+
+	unprivileged := cfg
+	unprivileged.Username, unprivileged.Password = "nobody", "nobodypw"
+	c, err := NewClient(ctx, unprivileged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := CheckAccess(ctx, c, unprivileged); err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Errorf("unexpected access check result for unprivileged user: %v", err)
+	}
+
+	root := cfg
+	root.Username, root.Password = "root", "rootpw"
+	rc, err := NewClient(ctx, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	if err := CheckAccess(ctx, rc, root); err != nil {
+		t.Errorf("unexpected access check result for root: %v", err)
+	}
+}
+
+func TestEtcdTenantIsolation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "locksmith2-etcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pki := newTestPKI(t, dir)
+	etcd := startTestEtcd(t, pki)
+	defer etcd.stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	certFile, keyFile := pki.issue(t, "client")
+	newTenant := func(name string) *Manager {
+		prefix, err := KeyPrefix("", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg := ClientConfig{
+			Endpoints:   []string{etcd.endpoint},
+			CAFile:      pki.caFile,
+			CertFile:    certFile,
+			KeyFile:     keyFile,
+			DialTimeout: 2 * time.Second,
+			KeyPrefix:   prefix,
+		}
+		client, err := NewClient(ctx, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			<-ctx.Done()
+			client.Close()
+		}()
+		if err := CheckAccess(ctx, client, cfg); err != nil {
+			t.Fatal(err)
+		}
+
+		backend, err := NewEtcdBackend(client, prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		manager, err := NewManager(ctx, backend, "shared", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return manager
+	}
+	a := newTenant("a")
+	b := newTenant("b")
+
+	// The same group name is a distinct semaphore in each tenant.
+	if _, err := a.RecursiveLock(ctx, "node-a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.RecursiveLock(ctx, "node-b"); err != nil {
+		t.Fatalf("tenant b blocked by tenant a: %s", err)
+	}
+	if _, err := a.RecursiveLock(ctx, "node-b"); err != ErrSemaphoreFull {
+		t.Errorf("unexpected error on full semaphore: %v", err)
+	}
+
+	// Listing and watching only see the own subtree.
+	groups, _, err := a.backend.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 1 || len(groups["shared"].Holders) != 1 || groups["shared"].Holders[0] != "node-a" {
+		t.Errorf("unexpected groups for tenant a: %v", groups)
+	}
+
+	watchCtx, watchCancel := context.WithCancel(ctx)
+	defer watchCancel()
+	changes := make(chan Change, 10)
+	go a.backend.Watch(watchCtx, "", 0, func(c Change) error {
+		changes <- c
+		return nil
+	})
+	time.Sleep(200 * time.Millisecond)
+	if err := b.UnlockIfHeld(ctx, "node-b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.UnlockIfHeld(ctx, "node-a"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case c := <-changes:
+		if c.Cur == nil || len(c.Cur.Holders) != 0 || len(c.Prev.Holders) != 1 || c.Prev.Holders[0] != "node-a" {
+			t.Errorf("unexpected change for tenant a: %+v", c)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for watch event")
+	}
+	select {
+	case c := <-changes:
+		t.Errorf("unexpected extra change for tenant a: %+v", c)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// Compare-and-swap only touches the own subtree.
+	prefixA, _ := KeyPrefix("", "a")
+	prefixB, _ := KeyPrefix("", "b")
+	if etcd.countKeys(t, prefixA)+etcd.countKeys(t, prefixB) != etcd.countKeys(t, "") {
+		t.Error("unexpected keys outside of tenant subtrees")
+	}
+	semA, _, err := a.backend.Get(ctx, "shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	semB, _, err := b.backend.Get(ctx, "shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(semA.Holders) != 0 || len(semB.Holders) != 0 {
+		t.Errorf("unexpected holders: %v %v", semA.Holders, semB.Holders)
+	}
+	if n := etcd.countKeys(t, prefixA); n != 1 {
+		t.Errorf("unexpected number of keys for tenant a: %d", n)
+	}
+	if n := etcd.countKeys(t, prefixB); n != 1 {
+		t.Errorf("unexpected number of keys for tenant b: %d", n)
+	}
+}
+
+func TestEtcdMembers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "locksmith2-etcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pki := newTestPKI(t, dir)
+	etcd := startTestEtcd(t, pki)
+	defer etcd.stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	certFile, keyFile := pki.issue(t, "client")
+	client, err := NewClient(ctx, ClientConfig{
+		Endpoints:   []string{etcd.endpoint},
+		CAFile:      pki.caFile,
+		CertFile:    certFile,
+		KeyFile:     keyFile,
+		DialTimeout: 2 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	b, err := NewEtcdBackend(client, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testBackendMembers(t, b)
+
+	// Member records live apart from semaphores, and expired ones are deleted.
+	if n := etcd.countKeys(t, DefaultKeyPrefix+groupsSegment); n != 1 {
+		t.Errorf("unexpected number of semaphore keys: %d", n)
+	}
+	if n := etcd.countKeys(t, DefaultKeyPrefix+membersSegment); n != 3 {
+		t.Errorf("unexpected number of member keys: %d", n)
+	}
+}
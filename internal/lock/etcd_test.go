@@ -0,0 +1,54 @@
+package lock
+
+import (
+	"testing"
+)
+
+func TestKeyPrefix(t *testing.T) {
+	tests := []struct {
+		prefix   string
+		tenant   string
+		expected string
+		valid    bool
+	}{
+		{"", "", DefaultKeyPrefix, true},
+		{"custom", "", "custom/", true},
+		{"custom/", "", "custom/", true},
+		{"", "team-a", DefaultKeyPrefix + "tenants/team-a/", true},
+		{"custom/", "team.b_1", "custom/tenants/team.b_1/", true},
+		{"", "a/b", "", false},
+		{"", "..", "", false},
+		{"", "-a", "", false},
+	}
+
+	for _, tt := range tests {
+		prefix, err := KeyPrefix(tt.prefix, tt.tenant)
+		if (err == nil) != tt.valid || prefix != tt.expected {
+			t.Errorf("unexpected result for (%q, %q): got (%q, %v)", tt.prefix, tt.tenant, prefix, err)
+		}
+	}
+}
+
+func TestGroupFromKey(t *testing.T) {
+	backend := &EtcdBackend{groupsPrefix: DefaultKeyPrefix + groupsSegment}
+	tenant := &EtcdBackend{groupsPrefix: DefaultKeyPrefix + "tenants/a/" + groupsSegment}
+	tests := []struct {
+		key      string
+		group    string
+		expected bool
+	}{
+		{backend.groupKey(""), defaultGroup, true},
+		{backend.groupKey("my group/1"), "my group/1", true},
+		{tenant.groupKey("my group/1"), "", false},
+		{"com.coreos.locksmith2/groups/foo/v2/semaphore", "", false},
+		{"com.coreos.locksmith2/groups//v1/semaphore", "", false},
+		{"unrelated/key", "", false},
+	}
+
+	for _, tt := range tests {
+		group, ok := backend.groupFromKey(tt.key)
+		if ok != tt.expected || group != tt.group {
+			t.Errorf("unexpected result for %q: got (%q, %t)", tt.key, group, ok)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package lock
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+)
+
+// EventKind is the type of a semaphore state change.
+type EventKind string
+
+const (
+	// EventAcquired is emitted when a node takes a slot.
+	EventAcquired EventKind = "acquired"
+	// EventReleased is emitted when a node gives back its slot.
+	EventReleased EventKind = "released"
+	// EventResized is emitted when the number of slots changes.
+	EventResized EventKind = "resized"
+	// EventPaused is emitted when a semaphore gets paused.
+	EventPaused EventKind = "paused"
+	// EventResumed is emitted when a paused semaphore gets resumed.
+	EventResumed EventKind = "resumed"
+	// EventOverdue is emitted when a holder exceeds the maximum hold
+	// duration of its group.
+	EventOverdue EventKind = "overdue"
+	// EventExpired is emitted for every holder which disappeared
+	// together with its semaphore. Semaphores are never removed by
+	// locksmith2 itself, only out of band, e.g. by an operator deleting
+	// the key in etcd or the file of a group.
+	EventExpired EventKind = "expired"
+)
+
+// Event is a typed change in the state of a group semaphore.
+type Event struct {
+	Kind       EventKind `json:"kind"`
+	Group      string    `json:"group"`
+	Node       string    `json:"node,omitempty"`
+	TotalSlots uint64    `json:"total_slots,omitempty"`
+	// Reason explains a pause, if known.
+	Reason   string `json:"reason,omitempty"`
+	Revision int64  `json:"revision"`
+	// Index is the position of the event among the ones of its revision,
+	// as watched, as a single write can produce several events.
+	Index int `json:"index"`
+}
+
+// DiffSemaphores returns the events which turn `prev` into `cur`.
+// A nil `prev` stands for a semaphore just created, a nil `cur`
+// for a semaphore which has been removed.
+func DiffSemaphores(group string, prev, cur *Semaphore) []Event {
+	events := []Event{}
+	if prev == nil && cur == nil {
+		return events
+	}
+
+	if cur == nil {
+		for _, h := range prev.Holders {
+			events = append(events, Event{Kind: EventExpired, Group: group, Node: h})
+		}
+		return events
+	}
+
+	var prevHolders []string
+	if prev != nil {
+		prevHolders = prev.Holders
+		if prev.TotalSlots != cur.TotalSlots {
+			events = append(events, Event{Kind: EventResized, Group: group, TotalSlots: cur.TotalSlots})
+		}
+		if !prev.Paused && cur.Paused {
+			events = append(events, Event{Kind: EventPaused, Group: group, Reason: cur.PauseReason})
+		}
+		if prev.Paused && !cur.Paused {
+			events = append(events, Event{Kind: EventResumed, Group: group})
+		}
+	} else if cur.Paused {
+		events = append(events, Event{Kind: EventPaused, Group: group, Reason: cur.PauseReason})
+	}
+
+	for _, h := range prevHolders {
+		if !containsHolder(cur.Holders, h) {
+			events = append(events, Event{Kind: EventReleased, Group: group, Node: h})
+		}
+	}
+	for _, h := range cur.Holders {
+		if !containsHolder(prevHolders, h) {
+			events = append(events, Event{Kind: EventAcquired, Group: group, Node: h})
+		}
+	}
+	var prevOverdue []string
+	if prev != nil {
+		prevOverdue = prev.Overdue
+	}
+	for _, h := range cur.Overdue {
+		if !containsHolder(prevOverdue, h) {
+			events = append(events, Event{Kind: EventOverdue, Group: group, Node: h})
+		}
+	}
+
+	return events
+}
+
+// WatchEvents streams typed semaphore events to `fn`, until the context
+// is canceled or an error occurs. Events can be limited to a single group
+// (empty means all groups) and replayed starting from a given backend revision
+// (zero means from now on). Events are indexed within their revision, after
+// filtering, so that watches of the same group agree on indexes.
+func WatchEvents(ctx context.Context, backend Backend, group string, fromRevision int64, fn func(Event) error) error {
+	if backend == nil {
+		return ErrNilBackend
+	}
+	if fn == nil {
+		return errors.New("nil events callback")
+	}
+
+	var revision int64
+	index := 0
+	return backend.Watch(ctx, group, fromRevision, func(change Change) error {
+		if change.Revision != revision {
+			revision, index = change.Revision, 0
+		}
+		for _, e := range DiffSemaphores(change.Group, change.Prev, change.Cur) {
+			e.Revision, e.Index = change.Revision, index
+			index++
+			if err := fn(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// WriteEventsBackend wraps a backend, passing the events caused by its
+// own successful writes to a callback. Unlike watches, which see the
+// writes of all processes sharing a backend, it only sees the ones of
+// this process, e.g. for side effects which must happen once per event.
+//
+// The previous state of a write is the semaphore read by `Get` at the
+// expected version, as done by managers before every update. Only one
+// write can succeed at a given version, so concurrent requests each find
+// the right one.
+type WriteEventsBackend struct {
+	Backend
+	fn func(Event)
+
+	mu sync.Mutex
+	// reads are the semaphores read of each group, by version, until a
+	// write makes them outdated.
+	reads map[string]map[int64]*Semaphore
+}
+
+// NewWriteEventsBackend returns a backend passing the events of its own
+// writes to `fn`, synchronously after each write.
+func NewWriteEventsBackend(backend Backend, fn func(Event)) *WriteEventsBackend {
+	return &WriteEventsBackend{
+		Backend: backend,
+		fn:      fn,
+		reads:   map[string]map[int64]*Semaphore{},
+	}
+}
+
+// Get implements Backend, remembering a copy of the semaphore read.
+func (b *WriteEventsBackend) Get(ctx context.Context, group string) (*Semaphore, int64, error) {
+	sem, version, err := b.Backend.Get(ctx, group)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Callers modify the semaphore in place before writing it.
+	data, err := json.Marshal(sem)
+	if err != nil {
+		return nil, 0, err
+	}
+	prev := &Semaphore{}
+	if err := json.Unmarshal(data, prev); err != nil {
+		return nil, 0, err
+	}
+	if _, err := upgradeSemaphore(prev); err != nil {
+		return nil, 0, err
+	}
+
+	b.mu.Lock()
+	if b.reads[group] == nil {
+		b.reads[group] = map[int64]*Semaphore{}
+	}
+	b.reads[group][version] = prev
+	b.mu.Unlock()
+
+	return sem, version, nil
+}
+
+// CompareAndSwap implements Backend, passing the events of a successful
+// write to the callback. Writes of semaphores not read at the expected
+// version, which cannot be diffed, pass no events.
+func (b *WriteEventsBackend) CompareAndSwap(ctx context.Context, updates ...Update) (int64, error) {
+	revision, err := b.Backend.CompareAndSwap(ctx, updates...)
+	if err != nil {
+		return revision, err
+	}
+
+	events := []Event{}
+	b.mu.Lock()
+	for _, u := range updates {
+		if u.Semaphore == nil {
+			continue
+		}
+		prev, ok := b.reads[u.Group][u.Version]
+		// Reads up to the expected version cannot be written anymore.
+		for version := range b.reads[u.Group] {
+			if version <= u.Version {
+				delete(b.reads[u.Group], version)
+			}
+		}
+		if !ok && u.Version != 0 {
+			continue
+		}
+		events = append(events, DiffSemaphores(u.Group, prev, u.Semaphore)...)
+	}
+	b.mu.Unlock()
+
+	for i, e := range events {
+		e.Revision, e.Index = revision, i
+		b.fn(e)
+	}
+	return revision, nil
+}
+
+// containsHolder returns whether `h` is in the sorted list of holders.
+func containsHolder(holders []string, h string) bool {
+	loc := sort.SearchStrings(holders, h)
+	return loc < len(holders) && holders[loc] == h
+}
@@ -0,0 +1,191 @@
+package lock
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestDiffSemaphores(t *testing.T) {
+	tests := []struct {
+		prev     *Semaphore
+		cur      *Semaphore
+		expected []Event
+	}{
+		{
+			nil,
+			&Semaphore{TotalSlots: 1, Holders: []string{}},
+			[]Event{},
+		},
+		{
+			&Semaphore{TotalSlots: 2, Holders: []string{"a"}},
+			&Semaphore{TotalSlots: 2, Holders: []string{"a", "b"}},
+			[]Event{{Kind: EventAcquired, Group: "g", Node: "b"}},
+		},
+		{
+			&Semaphore{TotalSlots: 2, Holders: []string{"a", "b"}},
+			&Semaphore{TotalSlots: 3, Holders: []string{"b"}},
+			[]Event{
+				{Kind: EventResized, Group: "g", TotalSlots: 3},
+				{Kind: EventReleased, Group: "g", Node: "a"},
+			},
+		},
+		{
+			&Semaphore{TotalSlots: 1, Holders: []string{}},
+			&Semaphore{TotalSlots: 1, Holders: []string{}, Paused: true},
+			[]Event{{Kind: EventPaused, Group: "g"}},
+		},
+		{
+			&Semaphore{TotalSlots: 1, Holders: []string{}, Paused: true},
+			&Semaphore{TotalSlots: 1, Holders: []string{}},
+			[]Event{{Kind: EventResumed, Group: "g"}},
+		},
+		{
+			&Semaphore{TotalSlots: 2, Holders: []string{"a", "b"}, Overdue: []string{"a"}},
+			&Semaphore{TotalSlots: 2, Holders: []string{"a", "b"}, Overdue: []string{"a", "b"}, Paused: true, PauseReason: "budget"},
+			[]Event{
+				{Kind: EventPaused, Group: "g", Reason: "budget"},
+				{Kind: EventOverdue, Group: "g", Node: "b"},
+			},
+		},
+		{
+			&Semaphore{TotalSlots: 2, Holders: []string{"a", "b"}},
+			nil,
+			[]Event{
+				{Kind: EventExpired, Group: "g", Node: "a"},
+				{Kind: EventExpired, Group: "g", Node: "b"},
+			},
+		},
+	}
+
+	for i, tt := range tests {
+		events := DiffSemaphores("g", tt.prev, tt.cur)
+		if !reflect.DeepEqual(events, tt.expected) {
+			t.Errorf("#%d: unexpected events: got %v, expected %v", i, events, tt.expected)
+		}
+	}
+}
+
+func TestWriteEventsBackend(t *testing.T) {
+	ctx := context.Background()
+	shared := NewMemoryBackend()
+	events := []Event{}
+	own := NewWriteEventsBackend(shared, func(e Event) {
+		events = append(events, e)
+	})
+
+	manager, err := NewManager(ctx, own, "g", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := OpenManager(ctx, shared, "g")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := manager.RecursiveLock(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.RecursiveLock(ctx, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := manager.UnlockIfHeld(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 2 || events[0].Kind != EventAcquired || events[0].Node != "a" || events[0].Revision != token {
+		t.Fatalf("unexpected events: %+v", events)
+	}
+	if events[1].Kind != EventReleased || events[1].Node != "a" || events[1].Revision <= token {
+		t.Errorf("unexpected release event: %+v", events[1])
+	}
+}
+
+// delayedBackend holds the reply of a read, so that it arrives after the
+// ones of later reads.
+type delayedBackend struct {
+	Backend
+
+	mu sync.Mutex
+	// delay, if set, is closed to pass the reply of the next read.
+	delay chan struct{}
+	// replied is closed once that read got its reply from the backend.
+	replied chan struct{}
+	// beforeWrite, if set, runs before the next compare-and-swap returns.
+	beforeWrite func()
+}
+
+func (b *delayedBackend) CompareAndSwap(ctx context.Context, updates ...Update) (int64, error) {
+	revision, err := b.Backend.CompareAndSwap(ctx, updates...)
+	b.mu.Lock()
+	beforeWrite := b.beforeWrite
+	b.beforeWrite = nil
+	b.mu.Unlock()
+	if beforeWrite != nil {
+		beforeWrite()
+	}
+	return revision, err
+}
+
+func (b *delayedBackend) Get(ctx context.Context, group string) (*Semaphore, int64, error) {
+	sem, version, err := b.Backend.Get(ctx, group)
+	b.mu.Lock()
+	delay, replied := b.delay, b.replied
+	b.delay = nil
+	b.mu.Unlock()
+	if delay != nil {
+		close(replied)
+		<-delay
+	}
+	return sem, version, err
+}
+
+func TestWriteEventsBackendConcurrent(t *testing.T) {
+	ctx := context.Background()
+	delayed := &delayedBackend{Backend: NewMemoryBackend()}
+	var mu sync.Mutex
+	events := []Event{}
+	own := NewWriteEventsBackend(delayed, func(e Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, e)
+	})
+	manager, err := NewManager(ctx, own, "g", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A read of another request gets its reply late, after "a" took a
+	// slot, while "b" is taking one based on a newer read.
+	delay, replied, done := make(chan struct{}), make(chan struct{}), make(chan struct{})
+	delayed.delay, delayed.replied = delay, replied
+	go func() {
+		defer close(done)
+		if _, _, err := own.Get(ctx, "g"); err != nil {
+			t.Error(err)
+		}
+	}()
+	<-replied
+	if _, err := manager.RecursiveLock(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	delayed.mu.Lock()
+	delayed.beforeWrite = func() {
+		close(delay)
+		<-done
+	}
+	delayed.mu.Unlock()
+
+	// The late reply must not hide the previous state of the write.
+	if _, err := manager.RecursiveLock(ctx, "b"); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(events) != 2 || events[0].Node != "a" || events[1].Kind != EventAcquired || events[1].Node != "b" {
+		t.Errorf("unexpected events: %+v", events)
+	}
+}
@@ -0,0 +1,388 @@
+package lock
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// fileLockName is the advisory lock file, guarding the state directory.
+	fileLockName = ".lock"
+	// fileSuffix is the extension of semaphore and member files.
+	fileSuffix = ".json"
+	// fileMembersDir holds member records, one directory per group.
+	fileMembersDir = "members"
+	// filePollInterval is how often watches check for changes made by
+	// other processes.
+	filePollInterval = time.Second
+)
+
+// FileBackend stores semaphores as JSON files in a local directory, one
+// per group, for single-node deployments. Member records are stored in
+// a subdirectory, one file per node.
+//
+// Files are replaced atomically, and every operation holds an advisory
+// lock on the directory. Multi-group updates are atomic for readers, but
+// a crash while committing them may persist only some of the groups.
+type FileBackend struct {
+	dir string
+
+	mu sync.Mutex
+	// notify is closed and replaced on every local write, to wake up watchers.
+	notify chan struct{}
+}
+
+// NewFileBackend returns a backend storing semaphores in `dir`,
+// creating it if needed.
+func NewFileBackend(dir string) (*FileBackend, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+
+	return &FileBackend{
+		dir:    dir,
+		notify: make(chan struct{}),
+	}, nil
+}
+
+// Get returns the semaphore of a group and its version.
+func (b *FileBackend) Get(ctx context.Context, group string) (*Semaphore, int64, error) {
+	unlock, err := b.lock(unix.LOCK_SH)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer unlock()
+
+	record, err := b.read(group)
+	if err != nil {
+		return nil, 0, err
+	}
+	if record == nil {
+		return nil, 0, ErrUnknownGroup
+	}
+
+	return record.Semaphore, record.Version, nil
+}
+
+// CompareAndSwap writes all updates while holding the directory lock.
+func (b *FileBackend) CompareAndSwap(ctx context.Context, updates ...Update) (int64, error) {
+	unlock, err := b.lock(unix.LOCK_EX)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	records, revision, err := b.readAll()
+	if err != nil {
+		return 0, err
+	}
+	for _, u := range updates {
+		var version int64
+		if record, ok := records[u.Group]; ok {
+			version = record.Version
+		}
+		if version != u.Version {
+			return 0, ErrConflict
+		}
+		if u.Members == nil {
+			continue
+		}
+		members, err := b.readMembers(u.Group)
+		if err != nil {
+			return 0, err
+		}
+		if err := checkMembers(u.Members, members, time.Now().Unix()); err != nil {
+			return 0, err
+		}
+	}
+
+	revision++
+	for _, u := range updates {
+		if u.Semaphore == nil {
+			continue
+		}
+		record := storedSemaphore{u.Version + 1, revision, u.Semaphore}
+		if err := b.write(u.Group, &record); err != nil {
+			return 0, err
+		}
+	}
+	if err := syncDir(b.dir); err != nil {
+		return 0, err
+	}
+
+	b.mu.Lock()
+	close(b.notify)
+	b.notify = make(chan struct{})
+	b.mu.Unlock()
+
+	return revision, nil
+}
+
+// List returns the semaphores of all groups.
+func (b *FileBackend) List(ctx context.Context) (map[string]*Semaphore, int64, error) {
+	unlock, err := b.lock(unix.LOCK_SH)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer unlock()
+
+	records, revision, err := b.readAll()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	sems := make(map[string]*Semaphore, len(records))
+	for group, record := range records {
+		sems[group] = record.Semaphore
+	}
+
+	return sems, revision, nil
+}
+
+// Members returns the unexpired member records of a group.
+func (b *FileBackend) Members(ctx context.Context, group string) (map[string]Member, error) {
+	unlock, err := b.lock(unix.LOCK_SH)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	members, err := b.readMembers(group)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().Unix()
+	for node, member := range members {
+		if member.expired(now) {
+			delete(members, node)
+		}
+	}
+
+	return members, nil
+}
+
+// SetMember writes the member record of a node, removing the expired
+// records of the group. Watchers are not woken up.
+func (b *FileBackend) SetMember(ctx context.Context, group, node string, member Member) error {
+	unlock, err := b.lock(unix.LOCK_EX)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	members, err := b.readMembers(group)
+	if err != nil {
+		return err
+	}
+	for n, other := range members {
+		if n != node && other.expired(member.Time) {
+			if err := os.Remove(b.memberPath(group, n)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+
+	member.Version = members[node].Version + 1
+	data, err := json.Marshal(member)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(b.membersDir(group), 0750); err != nil {
+		return err
+	}
+	if err := b.writeFile(b.memberPath(group, node), data); err != nil {
+		return err
+	}
+
+	return syncDir(b.membersDir(group))
+}
+
+// Watch streams semaphore changes, by comparing the state directory
+// after every local write and periodically for writes by other processes.
+// Past changes are not retained, thus it returns ErrCompacted when asked
+// to replay any change older than the current state.
+func (b *FileBackend) Watch(ctx context.Context, group string, fromRevision int64, fn func(Change) error) error {
+	snapshot := func() (map[string]*storedSemaphore, int64, error) {
+		unlock, err := b.lock(unix.LOCK_SH)
+		if err != nil {
+			return nil, 0, err
+		}
+		defer unlock()
+		return b.readAll()
+	}
+	wakeup := func() <-chan struct{} {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return b.notify
+	}
+
+	return watchSnapshots(ctx, group, fromRevision, filePollInterval, snapshot, wakeup, fn)
+}
+
+// lock takes the advisory lock on the state directory, returning a
+// function releasing it.
+func (b *FileBackend) lock(how int) (func(), error) {
+	fp, err := os.OpenFile(filepath.Join(b.dir, fileLockName), os.O_RDWR|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Flock(int(fp.Fd()), how); err != nil {
+		fp.Close()
+		return nil, err
+	}
+
+	return func() {
+		unix.Flock(int(fp.Fd()), unix.LOCK_UN)
+		fp.Close()
+	}, nil
+}
+
+// path returns the file holding the semaphore of a group.
+func (b *FileBackend) path(group string) string {
+	return filepath.Join(b.dir, url.QueryEscape(group)+fileSuffix)
+}
+
+// membersDir returns the directory holding the member records of a group.
+func (b *FileBackend) membersDir(group string) string {
+	return filepath.Join(b.dir, fileMembersDir, url.QueryEscape(group))
+}
+
+// memberPath returns the file holding the member record of a node.
+func (b *FileBackend) memberPath(group, node string) string {
+	return filepath.Join(b.membersDir(group), url.QueryEscape(node)+fileSuffix)
+}
+
+// readMembers returns all member records of a group, including expired ones.
+func (b *FileBackend) readMembers(group string) (map[string]Member, error) {
+	infos, err := ioutil.ReadDir(b.membersDir(group))
+	if os.IsNotExist(err) {
+		return map[string]Member{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	members := make(map[string]Member, len(infos))
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || !strings.HasSuffix(name, fileSuffix) {
+			continue
+		}
+		node, err := url.QueryUnescape(strings.TrimSuffix(name, fileSuffix))
+		if err != nil {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(b.membersDir(group), name))
+		if err != nil {
+			return nil, err
+		}
+		if members[node], err = decodeMember(data); err != nil {
+			return nil, err
+		}
+	}
+
+	return members, nil
+}
+
+// read returns the record of a group, or nil if it does not exist.
+func (b *FileBackend) read(group string) (*storedSemaphore, error) {
+	data, err := ioutil.ReadFile(b.path(group))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeStoredSemaphore(data)
+}
+
+// readAll returns the records of all groups, and the latest revision.
+func (b *FileBackend) readAll() (map[string]*storedSemaphore, int64, error) {
+	infos, err := ioutil.ReadDir(b.dir)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	records := make(map[string]*storedSemaphore, len(infos))
+	var revision int64
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || strings.HasPrefix(name, ".") || !strings.HasSuffix(name, fileSuffix) {
+			continue
+		}
+		group, err := url.QueryUnescape(strings.TrimSuffix(name, fileSuffix))
+		if err != nil {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(b.dir, name))
+		if err != nil {
+			return nil, 0, err
+		}
+		record, err := decodeStoredSemaphore(data)
+		if err != nil {
+			return nil, 0, err
+		}
+		records[group] = record
+		if record.Revision > revision {
+			revision = record.Revision
+		}
+	}
+
+	return records, revision, nil
+}
+
+// write atomically replaces the record of a group.
+func (b *FileBackend) write(group string, record *storedSemaphore) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	return b.writeFile(b.path(group), data)
+}
+
+// writeFile atomically replaces a file, via a synced temporary file.
+func (b *FileBackend) writeFile(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(b.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// syncDir flushes directory entries, making renames durable.
+func syncDir(dir string) error {
+	fp, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	return fp.Sync()
+}
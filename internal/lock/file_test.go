@@ -0,0 +1,197 @@
+package lock
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFileBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "locksmith2-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+
+	b, err := NewFileBackend(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := b.Get(ctx, "g"); err != ErrUnknownGroup {
+		t.Errorf("unexpected error for missing group: %v", err)
+	}
+
+	manager, err := NewManager(ctx, b, "my group/1", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := manager.RecursiveLock(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := manager.RecursiveLock(ctx, "b"); err != ErrSemaphoreFull {
+		t.Errorf("unexpected error on full semaphore: %v", err)
+	}
+
+	// State survives a new backend instance, e.g. after a restart.
+	reopened, err := NewFileBackend(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sem, version, err := reopened.Get(ctx, "my group/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Taking a slot and recording its fencing token are two writes.
+	if version != 3 || len(sem.Holders) != 1 || sem.Holders[0] != "a" || sem.Token("a") != 2 {
+		t.Errorf("unexpected semaphore at version %d: %+v", version, sem)
+	}
+	if _, err := reopened.CompareAndSwap(ctx, Update{Group: "my group/1", Semaphore: sem, Version: 1}); err != ErrConflict {
+		t.Errorf("unexpected error on stale version: %v", err)
+	}
+
+	sems, revision, err := reopened.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sems) != 1 || revision != 3 {
+		t.Errorf("unexpected list at revision %d: %+v", revision, sems)
+	}
+
+	// No temporary files are left behind.
+	tmps, _ := filepath.Glob(filepath.Join(dir, ".tmp-*"))
+	if len(tmps) != 0 {
+		t.Errorf("leftover temporary files: %v", tmps)
+	}
+}
+
+func TestFileBackendMembers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "locksmith2-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b, err := NewFileBackend(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBackendMembers(t, b)
+
+	// Member records are not groups, and expired ones are removed.
+	sems, _, err := b.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sems) != 1 {
+		t.Errorf("unexpected groups: %v", sems)
+	}
+	if _, err := os.Stat(b.memberPath("g", "gone")); !os.IsNotExist(err) {
+		t.Errorf("expired member record not removed: %v", err)
+	}
+}
+
+func TestFileBackendConcurrentWriters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "locksmith2-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+
+	first, _ := NewFileBackend(dir)
+	if _, err := NewManager(ctx, first, "g", 100); err != nil {
+		t.Fatal(err)
+	}
+
+	// Independent instances on the same directory only share the file lock.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			b, _ := NewFileBackend(dir)
+			for j := 0; j < 10; j++ {
+				sem, version, err := b.Get(ctx, "g")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				sem.TotalSlots++
+				for {
+					_, err := b.CompareAndSwap(ctx, Update{Group: "g", Semaphore: sem, Version: version})
+					if err == nil {
+						break
+					}
+					if err != ErrConflict {
+						t.Error(err)
+						return
+					}
+					sem, version, _ = b.Get(ctx, "g")
+					sem.TotalSlots++
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	sem, version, err := first.Get(ctx, "g")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sem.TotalSlots != 140 || version != 41 {
+		t.Errorf("lost updates: %d slots at version %d", sem.TotalSlots, version)
+	}
+}
+
+func TestFileBackendWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "locksmith2-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	b, _ := NewFileBackend(dir)
+	manager, err := NewManager(ctx, b, "g", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Watch(ctx, "", 1, func(Change) error { return nil }); err != ErrCompacted {
+		t.Errorf("unexpected error replaying past changes: %v", err)
+	}
+
+	_, revision, err := b.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := make(chan Event, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- WatchEvents(ctx, b, "g", revision+1, func(e Event) error {
+			events <- e
+			return nil
+		})
+	}()
+	// Give the watch time to take its initial snapshot.
+	time.Sleep(100 * time.Millisecond)
+
+	if _, err := manager.RecursiveLock(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case e := <-events:
+		// Snapshots may already include the fencing token write.
+		if e.Kind != EventAcquired || e.Node != "a" || e.Revision < 2 {
+			t.Errorf("unexpected event: %+v", e)
+		}
+	case err := <-done:
+		t.Fatalf("no event received: %v", err)
+	}
+}
@@ -0,0 +1,497 @@
+package lock
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultKubernetesConfigMap is the name of the ConfigMap holding semaphores.
+	defaultKubernetesConfigMap = "locksmith2-semaphores"
+	// defaultKubernetesPollInterval is how often watches poll the ConfigMap.
+	defaultKubernetesPollInterval = 2 * time.Second
+	// kubernetesWriteRetries bounds the retries of a write which lost a race
+	// on the ConfigMap against an update of unrelated groups.
+	kubernetesWriteRetries = 5
+	// kubernetesDataPrefix prefixes the ConfigMap data key of each group.
+	kubernetesDataPrefix = "group."
+	// kubernetesMemberPrefix prefixes the ConfigMap data key of each
+	// member record, followed by the group and the node.
+	kubernetesMemberPrefix = "member."
+
+	// In-cluster service account credentials.
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount/"
+)
+
+var (
+	// errKubernetesConflict is a ConfigMap write rejected on resourceVersion.
+	errKubernetesConflict = errors.New("ConfigMap changed concurrently")
+	// kubernetesDataKey matches group names allowed in ConfigMap data keys.
+	kubernetesDataKey = regexp.MustCompile("^[-._a-zA-Z0-9]+$")
+	// kubernetesMemberNode matches node names allowed in member data keys,
+	// which end with the node.
+	kubernetesMemberNode = regexp.MustCompile("^[-_a-zA-Z0-9]+$")
+)
+
+// KubernetesConfig holds settings for the Kubernetes backend.
+// Empty fields default to the in-cluster service account.
+type KubernetesConfig struct {
+	// Server is the API server URL.
+	Server string
+	// Namespace and ConfigMap locate the object holding semaphores.
+	Namespace string
+	ConfigMap string
+	// TokenFile contains the bearer token, re-read on every request.
+	TokenFile string
+	// CAFile is the CA bundle for verifying the API server certificate.
+	CAFile string
+	// PollInterval is how often watches poll for changes (default 2s).
+	PollInterval time.Duration
+}
+
+// KubernetesBackend stores semaphores in a Kubernetes ConfigMap, one data
+// key per group. Writes use the ConfigMap `resourceVersion` for optimistic
+// concurrency, so that updates of multiple groups are atomic. Member
+// records are stored in the same ConfigMap, one data key per node.
+type KubernetesBackend struct {
+	cfg    KubernetesConfig
+	client *http.Client
+}
+
+// configMap is the subset of a Kubernetes ConfigMap used by the backend.
+type configMap struct {
+	APIVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Metadata   objectMeta        `json:"metadata"`
+	Data       map[string]string `json:"data,omitempty"`
+}
+
+// objectMeta is the subset of Kubernetes object metadata used by the backend.
+type objectMeta struct {
+	Name            string            `json:"name"`
+	Namespace       string            `json:"namespace,omitempty"`
+	ResourceVersion string            `json:"resourceVersion,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	Annotations     map[string]string `json:"annotations,omitempty"`
+}
+
+// apiStatus is a Kubernetes API error.
+type apiStatus struct {
+	Message string `json:"message"`
+	Reason  string `json:"reason"`
+}
+
+// NewKubernetesBackend returns a backend on top of the Kubernetes API.
+func NewKubernetesBackend(cfg KubernetesConfig) (*KubernetesBackend, error) {
+	if cfg.Server == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, errors.New("no Kubernetes API server configured, and not running in a cluster")
+		}
+		cfg.Server = "https://" + net.JoinHostPort(host, port)
+	}
+	if cfg.Namespace == "" {
+		namespace, err := ioutil.ReadFile(serviceAccountDir + "namespace")
+		if err != nil {
+			return nil, fmt.Errorf("no Kubernetes namespace configured: %s", err)
+		}
+		cfg.Namespace = strings.TrimSpace(string(namespace))
+	}
+	if cfg.ConfigMap == "" {
+		cfg.ConfigMap = defaultKubernetesConfigMap
+	}
+	if cfg.TokenFile == "" {
+		cfg.TokenFile = serviceAccountDir + "token"
+	}
+	if cfg.CAFile == "" && strings.HasPrefix(cfg.Server, "https://") {
+		cfg.CAFile = serviceAccountDir + "ca.crt"
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = defaultKubernetesPollInterval
+	}
+
+	transport := &http.Transport{}
+	if cfg.CAFile != "" {
+		caPEM, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read Kubernetes CA: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificates found in %q", cfg.CAFile)
+		}
+		transport.TLSClientConfig = &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			RootCAs:    pool,
+		}
+	}
+
+	return &KubernetesBackend{
+		cfg:    cfg,
+		client: &http.Client{Transport: transport},
+	}, nil
+}
+
+// Get returns the semaphore of a group and its version.
+func (b *KubernetesBackend) Get(ctx context.Context, group string) (*Semaphore, int64, error) {
+	cm, err := b.getConfigMap(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	records, _, err := decodeConfigMap(cm)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	record, ok := records[group]
+	if !ok {
+		return nil, 0, ErrUnknownGroup
+	}
+
+	return record.Semaphore, record.Version, nil
+}
+
+// CompareAndSwap writes all updates in a single ConfigMap update. Races
+// against writes of other groups are retried, as long as the versions of
+// the updated groups still match.
+func (b *KubernetesBackend) CompareAndSwap(ctx context.Context, updates ...Update) (int64, error) {
+	for _, u := range updates {
+		if !kubernetesDataKey.MatchString(u.Group) {
+			return 0, fmt.Errorf("group name %q cannot be stored in a ConfigMap", u.Group)
+		}
+	}
+
+	for attempt := 0; attempt < kubernetesWriteRetries; attempt++ {
+		cm, err := b.getConfigMap(ctx)
+		if err != nil {
+			return 0, err
+		}
+		records, revision, err := decodeConfigMap(cm)
+		if err != nil {
+			return 0, err
+		}
+		for _, u := range updates {
+			var version int64
+			if record, ok := records[u.Group]; ok {
+				version = record.Version
+			}
+			if version != u.Version {
+				return 0, ErrConflict
+			}
+			if u.Members == nil {
+				continue
+			}
+			members, err := decodeMembers(cm, u.Group)
+			if err != nil {
+				return 0, err
+			}
+			if err := checkMembers(u.Members, members, time.Now().Unix()); err != nil {
+				return 0, err
+			}
+		}
+
+		revision++
+		if cm == nil {
+			cm = &configMap{Metadata: objectMeta{Name: b.cfg.ConfigMap, Namespace: b.cfg.Namespace}}
+		}
+		if cm.Data == nil {
+			cm.Data = map[string]string{}
+		}
+		for _, u := range updates {
+			if u.Semaphore == nil {
+				continue
+			}
+			data, err := json.Marshal(storedSemaphore{u.Version + 1, revision, u.Semaphore})
+			if err != nil {
+				return 0, err
+			}
+			cm.Data[kubernetesDataPrefix+u.Group] = string(data)
+		}
+
+		err = b.putConfigMap(ctx, cm)
+		if err == errKubernetesConflict {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		return revision, nil
+	}
+
+	return 0, errors.New("too many concurrent ConfigMap updates, giving up")
+}
+
+// List returns the semaphores of all groups.
+func (b *KubernetesBackend) List(ctx context.Context) (map[string]*Semaphore, int64, error) {
+	cm, err := b.getConfigMap(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	records, revision, err := decodeConfigMap(cm)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	sems := make(map[string]*Semaphore, len(records))
+	for group, record := range records {
+		sems[group] = record.Semaphore
+	}
+
+	return sems, revision, nil
+}
+
+// Members returns the unexpired member records of a group.
+func (b *KubernetesBackend) Members(ctx context.Context, group string) (map[string]Member, error) {
+	cm, err := b.getConfigMap(ctx)
+	if err != nil {
+		return nil, err
+	}
+	members, err := decodeMembers(cm, group)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+	for node, member := range members {
+		if member.expired(now) {
+			delete(members, node)
+		}
+	}
+
+	return members, nil
+}
+
+// SetMember writes the member record of a node, removing the expired
+// records of the group in the same ConfigMap update.
+func (b *KubernetesBackend) SetMember(ctx context.Context, group, node string, member Member) error {
+	if !kubernetesDataKey.MatchString(group) || !kubernetesMemberNode.MatchString(node) {
+		return fmt.Errorf("member %q of group %q cannot be stored in a ConfigMap", node, group)
+	}
+
+	for attempt := 0; attempt < kubernetesWriteRetries; attempt++ {
+		cm, err := b.getConfigMap(ctx)
+		if err != nil {
+			return err
+		}
+		members, err := decodeMembers(cm, group)
+		if err != nil {
+			return err
+		}
+
+		if cm == nil {
+			cm = &configMap{Metadata: objectMeta{Name: b.cfg.ConfigMap, Namespace: b.cfg.Namespace}}
+		}
+		if cm.Data == nil {
+			cm.Data = map[string]string{}
+		}
+		for n, other := range members {
+			if n != node && other.expired(member.Time) {
+				delete(cm.Data, memberDataKey(group, n))
+			}
+		}
+		member.Version = members[node].Version + 1
+		data, err := json.Marshal(member)
+		if err != nil {
+			return err
+		}
+		cm.Data[memberDataKey(group, node)] = string(data)
+
+		err = b.putConfigMap(ctx, cm)
+		if err == errKubernetesConflict {
+			continue
+		}
+		return err
+	}
+
+	return errors.New("too many concurrent ConfigMap updates, giving up")
+}
+
+// Watch streams semaphore changes by polling the ConfigMap. Past changes
+// are not retained, thus it returns ErrCompacted when asked to replay any
+// change older than the current state.
+func (b *KubernetesBackend) Watch(ctx context.Context, group string, fromRevision int64, fn func(Change) error) error {
+	snapshot := func() (map[string]*storedSemaphore, int64, error) {
+		cm, err := b.getConfigMap(ctx)
+		if err != nil {
+			return nil, 0, err
+		}
+		return decodeConfigMap(cm)
+	}
+	wakeup := func() <-chan struct{} {
+		return nil
+	}
+
+	return watchSnapshots(ctx, group, fromRevision, b.cfg.PollInterval, snapshot, wakeup, fn)
+}
+
+// decodeConfigMap returns the semaphores stored in a ConfigMap, which may
+// be nil, and the latest revision.
+func decodeConfigMap(cm *configMap) (map[string]*storedSemaphore, int64, error) {
+	records := map[string]*storedSemaphore{}
+	var revision int64
+	if cm == nil {
+		return records, revision, nil
+	}
+
+	for key, value := range cm.Data {
+		if !strings.HasPrefix(key, kubernetesDataPrefix) {
+			continue
+		}
+		record, err := decodeStoredSemaphore([]byte(value))
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid semaphore in ConfigMap key %q: %s", key, err)
+		}
+		records[strings.TrimPrefix(key, kubernetesDataPrefix)] = record
+		if record.Revision > revision {
+			revision = record.Revision
+		}
+	}
+
+	return records, revision, nil
+}
+
+// memberDataKey returns the ConfigMap data key of the member record of a node.
+func memberDataKey(group, node string) string {
+	return kubernetesMemberPrefix + group + "." + node
+}
+
+// decodeMembers returns all member records of a group stored in a
+// ConfigMap, which may be nil, including expired ones.
+func decodeMembers(cm *configMap, group string) (map[string]Member, error) {
+	members := map[string]Member{}
+	if cm == nil {
+		return members, nil
+	}
+
+	prefix := memberDataKey(group, "")
+	for key, value := range cm.Data {
+		node := strings.TrimPrefix(key, prefix)
+		if !strings.HasPrefix(key, prefix) || !kubernetesMemberNode.MatchString(node) {
+			continue
+		}
+		member, err := decodeMember([]byte(value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid member record in ConfigMap key %q: %s", key, err)
+		}
+		members[node] = member
+	}
+
+	return members, nil
+}
+
+// getConfigMap fetches the ConfigMap, returning nil if it does not exist.
+func (b *KubernetesBackend) getConfigMap(ctx context.Context) (*configMap, error) {
+	resp, err := b.do(ctx, "GET", b.configMapPath(b.cfg.ConfigMap), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, apiError(resp)
+	}
+
+	cm := &configMap{}
+	if err := json.NewDecoder(resp.Body).Decode(cm); err != nil {
+		return nil, fmt.Errorf("failed to decode ConfigMap: %s", err)
+	}
+
+	return cm, nil
+}
+
+// putConfigMap creates the ConfigMap, or replaces it if the resourceVersion
+// still matches. It returns errKubernetesConflict otherwise.
+func (b *KubernetesBackend) putConfigMap(ctx context.Context, cm *configMap) error {
+	cm.APIVersion, cm.Kind = "v1", "ConfigMap"
+	body, err := json.Marshal(cm)
+	if err != nil {
+		return err
+	}
+
+	var resp *http.Response
+	if cm.Metadata.ResourceVersion == "" {
+		resp, err = b.do(ctx, "POST", b.configMapPath(""), body)
+	} else {
+		resp, err = b.do(ctx, "PUT", b.configMapPath(b.cfg.ConfigMap), body)
+	}
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		return nil
+	case http.StatusConflict:
+		// Either a stale resourceVersion, or a concurrent creation.
+		return errKubernetesConflict
+	default:
+		return apiError(resp)
+	}
+}
+
+// configMapPath returns the API path of a ConfigMap, or of the collection
+// if `name` is empty.
+func (b *KubernetesBackend) configMapPath(name string) string {
+	path := "/api/v1/namespaces/" + b.cfg.Namespace + "/configmaps"
+	if name != "" {
+		path += "/" + name
+	}
+	return path
+}
+
+// do sends an authenticated request to the API server.
+func (b *KubernetesBackend) do(ctx context.Context, method, path string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, strings.TrimSuffix(b.cfg.Server, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	token, err := ioutil.ReadFile(b.cfg.TokenFile)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read Kubernetes token: %s", err)
+	}
+	if t := strings.TrimSpace(string(token)); t != "" {
+		req.Header.Set("Authorization", "Bearer "+t)
+	}
+
+	return b.client.Do(req)
+}
+
+// apiError turns a failed API response into a descriptive error.
+func apiError(resp *http.Response) error {
+	status := apiStatus{}
+	data, _ := ioutil.ReadAll(resp.Body)
+	if err := json.Unmarshal(data, &status); err != nil || status.Message == "" {
+		status.Message = strings.TrimSpace(string(data))
+	}
+
+	switch resp.StatusCode {
+	case http.StatusUnauthorized:
+		return fmt.Errorf("Kubernetes API authentication failed: %s", status.Message)
+	case http.StatusForbidden:
+		return fmt.Errorf("Kubernetes API access denied, check RBAC for ConfigMaps: %s", status.Message)
+	default:
+		return fmt.Errorf("Kubernetes API error (%d %s): %s", resp.StatusCode, status.Reason, status.Message)
+	}
+}
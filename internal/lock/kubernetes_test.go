@@ -0,0 +1,253 @@
+package lock
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeAPIServer is a minimal Kubernetes API server, serving ConfigMaps
+// with resourceVersion checks.
+type fakeAPIServer struct {
+	token string
+
+	mu         sync.Mutex
+	version    int
+	configMaps map[string]configMap
+}
+
+func (s *fakeAPIServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Header.Get("Authorization") != "Bearer "+s.token {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(apiStatus{Message: "Unauthorized", Reason: "Unauthorized"})
+		return
+	}
+	const collection = "/api/v1/namespaces/test/configmaps"
+	if !strings.HasPrefix(req.URL.Path, collection) {
+		http.NotFound(w, req)
+		return
+	}
+	name := strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, collection), "/")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var cm configMap
+	if req.Method == "POST" || req.Method == "PUT" {
+		if err := json.NewDecoder(req.Body).Decode(&cm); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	switch {
+	case req.Method == "GET" && name != "":
+		cur, ok := s.configMaps[name]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(apiStatus{Message: "not found", Reason: "NotFound"})
+			return
+		}
+		json.NewEncoder(w).Encode(cur)
+	case req.Method == "POST" && name == "":
+		if _, ok := s.configMaps[cm.Metadata.Name]; ok {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(apiStatus{Message: "already exists", Reason: "AlreadyExists"})
+			return
+		}
+		s.store(w, cm, http.StatusCreated)
+	case req.Method == "PUT" && name != "":
+		cur, ok := s.configMaps[name]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		if cm.Metadata.ResourceVersion != cur.Metadata.ResourceVersion {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(apiStatus{Message: "object has been modified", Reason: "Conflict"})
+			return
+		}
+		s.store(w, cm, http.StatusOK)
+	default:
+		http.Error(w, "unsupported", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *fakeAPIServer) store(w http.ResponseWriter, cm configMap, code int) {
+	s.version++
+	cm.Metadata.ResourceVersion = strconv.Itoa(s.version)
+	s.configMaps[cm.Metadata.Name] = cm
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(cm)
+}
+
+// newTestKubernetesBackend returns a backend talking to a fake API server.
+func newTestKubernetesBackend(t *testing.T) (*KubernetesBackend, func()) {
+	dir, err := ioutil.TempDir("", "locksmith2-k8s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("s3cr3t\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(&fakeAPIServer{token: "s3cr3t", configMaps: map[string]configMap{}})
+	b, err := NewKubernetesBackend(KubernetesConfig{
+		Server:       srv.URL,
+		Namespace:    "test",
+		TokenFile:    tokenFile,
+		PollInterval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b, func() {
+		srv.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestKubernetesBackend(t *testing.T) {
+	b, cleanup := newTestKubernetesBackend(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	if _, _, err := b.Get(ctx, "g"); err != ErrUnknownGroup {
+		t.Errorf("unexpected error for missing group: %v", err)
+	}
+
+	manager, err := NewManager(ctx, b, "g", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := manager.RecursiveLock(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := manager.RecursiveLock(ctx, "b"); err != ErrSemaphoreFull {
+		t.Errorf("unexpected error on full semaphore: %v", err)
+	}
+
+	sem, version, err := b.Get(ctx, "g")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 3 || len(sem.Holders) != 1 {
+		t.Errorf("unexpected semaphore at version %d: %+v", version, sem)
+	}
+	if _, err := b.CompareAndSwap(ctx, Update{Group: "g", Semaphore: sem, Version: 1}); err != ErrConflict {
+		t.Errorf("unexpected error on stale version: %v", err)
+	}
+	if _, err := b.CompareAndSwap(ctx, Update{Group: "my/group", Semaphore: sem, Version: 0}); err == nil {
+		t.Error("unexpected success with invalid group name")
+	}
+
+	b.cfg.TokenFile = filepath.Join(filepath.Dir(b.cfg.TokenFile), "missing")
+	if _, _, err := b.List(ctx); err == nil || !strings.Contains(err.Error(), "authentication failed") {
+		t.Errorf("unexpected error without token: %v", err)
+	}
+}
+
+func TestKubernetesBackendMembers(t *testing.T) {
+	b, cleanup := newTestKubernetesBackend(t)
+	defer cleanup()
+
+	testBackendMembers(t, b)
+
+	cm, err := b.getConfigMap(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cm.Data[memberDataKey("g", "gone")]; ok {
+		t.Error("expired member record not removed")
+	}
+	if err := b.SetMember(context.Background(), "g", "a.b", Member{}); err == nil {
+		t.Error("expected error on node name with a dot")
+	}
+}
+
+func TestKubernetesBackendConcurrentGroups(t *testing.T) {
+	b, cleanup := newTestKubernetesBackend(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	// Writers of different groups race on the same ConfigMap, but never
+	// conflict on their semaphores.
+	var wg sync.WaitGroup
+	for _, group := range []string{"a", "b", "c"} {
+		wg.Add(1)
+		go func(group string) {
+			defer wg.Done()
+			m, err := NewManager(ctx, b, group, 1)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if _, err := m.RecursiveLock(ctx, "node-"+group); err != nil {
+				t.Error(err)
+			}
+		}(group)
+	}
+	wg.Wait()
+
+	sems, revision, err := b.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sems) != 3 || revision != 9 {
+		t.Errorf("unexpected semaphores at revision %d: %+v", revision, sems)
+	}
+	for group, sem := range sems {
+		if len(sem.Holders) != 1 || sem.Holders[0] != "node-"+group {
+			t.Errorf("unexpected holders in group %s: %v", group, sem.Holders)
+		}
+	}
+}
+
+func TestKubernetesBackendWatch(t *testing.T) {
+	b, cleanup := newTestKubernetesBackend(t)
+	defer cleanup()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	manager, err := NewManager(ctx, b, "g", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, revision, err := b.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := make(chan Event, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- WatchEvents(ctx, b, "g", revision+1, func(e Event) error {
+			events <- e
+			return nil
+		})
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	if _, err := manager.RecursiveLock(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case e := <-events:
+		if e.Kind != EventAcquired || e.Node != "a" || e.Revision < revision+1 {
+			t.Errorf("unexpected event: %+v", e)
+		}
+	case err := <-done:
+		t.Fatalf("no event received: %v", err)
+	}
+}
@@ -2,190 +2,520 @@ package lock
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
-	"fmt"
-	"net/url"
-
-	"go.etcd.io/etcd/clientv3"
+	"time"
 )
 
 const (
-	keyTemplate  = "com.coreos.locksmith2/groups/%s/v1/semaphore"
 	defaultGroup = "default"
+
+	// maxConflictRetries is the number of times a semaphore update is
+	// retried after losing a race against a concurrent update.
+	maxConflictRetries = 3
+	// undoTimeout bounds giving back slots after a failed acquisition,
+	// which may run after the request context expired.
+	undoTimeout = 5 * time.Second
+	// versionRefreshes is the number of times an unchanged version is
+	// reported again within the version TTL, bounding the writes of
+	// nodes reporting on every request.
+	versionRefreshes = 10
 )
 
 var (
 	// ErrNilManager is returned on nil manager.
 	ErrNilManager = errors.New("nil Manager")
+	// ErrNilClient is returned on nil etcd client.
+	ErrNilClient = errors.New("nil etcd client")
+	// ErrUnknownGroup is returned when opening a group without a semaphore.
+	ErrUnknownGroup = errors.New("unknown group")
+	// ErrConflict is returned when the semaphore changed concurrently.
+	ErrConflict = errors.New("conflict on semaphore detected, aborting")
+	// ErrStaleToken is returned when verifying a fencing token which is
+	// not the one of a current holder.
+	ErrStaleToken = errors.New("fencing token is not current")
+	// ErrSlotLost is returned when a slot just taken got released by a
+	// concurrent request before its fencing token was recorded.
+	ErrSlotLost = errors.New("slot released before its fencing token was recorded")
 )
 
 // Manager takes care of locking for clients.
+//
+// A manager can span several groups, e.g. a group and its parents, in
+// which case slots are taken and released in all of them atomically.
 type Manager struct {
-	client  *clientv3.Client
-	keyPath string
+	backend Backend
+	// groups are the names of all locked semaphores, starting with
+	// the group of the manager.
+	groups []string
+	// observed are the names of semaphores only read by guards.
+	observed []string
+	guards   []Guard
+	// labels are recorded with new slots, and checked against spread
+	// constraints, by group.
+	labels  map[string]string
+	spreads map[string][]Spread
+	// disruptions are the disruption budgets, by group.
+	disruptions map[string]DisruptionBudget
+	// versionTTL is how long reported versions are kept without a new
+	// report, zero meaning forever.
+	versionTTL time.Duration
 }
 
+// Guard decides whether a lock id may take a slot, given the current
+// semaphores of all locked and observed groups. Any error refuses the
+// lock, and is returned by RecursiveLock.
+type Guard func(id string, sems map[string]*Semaphore) error
+
 // NewManager returns a new lock manager, ensuring the underlying semaphore is initialized.
-func NewManager(ctx context.Context, etcdURLs []string, customGroup string, slots uint64) (*Manager, error) {
-	client, err := clientv3.NewFromURL(etcdURLs[0])
-	if err != nil {
-		return nil, err
+func NewManager(ctx context.Context, backend Backend, customGroup string, slots uint64) (*Manager, error) {
+	if backend == nil {
+		return nil, ErrNilBackend
 	}
 
-	group := defaultGroup
-	if customGroup != "" {
-		group = url.QueryEscape(customGroup)
+	manager := Manager{backend: backend, groups: []string{groupName(customGroup)}}
+	if err := manager.ensureInit(ctx, slots); err != nil {
+		return nil, err
 	}
 
-	keyPath := fmt.Sprintf(keyTemplate, group)
-	manager := Manager{client, keyPath}
+	return &manager, nil
+}
 
-	if err := manager.ensureInit(ctx, slots); err != nil {
+// OpenManager returns a lock manager for an existing semaphore, without
+// implicitly creating it. It returns ErrUnknownGroup if the semaphore
+// does not exist.
+//
+// Additional groups (e.g. the parent chain of the group) are locked and
+// unlocked together with the group of the manager, in a single
+// compare-and-swap on all semaphores. Their semaphores must exist too.
+func OpenManager(ctx context.Context, backend Backend, customGroup string, others ...string) (*Manager, error) {
+	if backend == nil {
+		return nil, ErrNilBackend
+	}
+
+	groups := []string{groupName(customGroup)}
+	for _, group := range others {
+		group = groupName(group)
+		if !containsGroup(groups, group) {
+			groups = append(groups, group)
+		}
+	}
+	manager := Manager{backend: backend, groups: groups}
+	if _, err := manager.get(ctx, manager.groups); err != nil {
 		return nil, err
 	}
 
 	return &manager, nil
 }
 
-// Close reaps all running goroutines.
-func (m *Manager) Close() {
+// groupName returns the name of a group, defaulting to `defaultGroup`.
+func groupName(customGroup string) string {
+	if customGroup == "" {
+		return defaultGroup
+	}
+	return customGroup
+}
+
+// containsGroup returns whether a group is in an unsorted list.
+func containsGroup(groups []string, group string) bool {
+	for _, g := range groups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+// WithGuard returns a copy of the manager which takes new slots only if
+// `guard` allows it. The semaphores of `observed` groups are passed to
+// the guard as well, and their versions are compared in the same
+// transaction taking the slot, so that a decision is never based on
+// stale state.
+func (m *Manager) WithGuard(guard Guard, observed ...string) *Manager {
 	if m == nil {
-		return
+		return nil
 	}
 
-	m.client.Close()
+	guarded := *m
+	guarded.guards = append(append([]Guard{}, m.guards...), guard)
+	guarded.observed = append([]string{}, m.observed...)
+	for _, group := range observed {
+		group = groupName(group)
+		if !containsGroup(guarded.groups, group) && !containsGroup(guarded.observed, group) {
+			guarded.observed = append(guarded.observed, group)
+		}
+	}
+
+	return &guarded
 }
 
-// ensureInit initialize the semaphore in etcd, if it does not exist yet.
+// ensureInit initialize the semaphore, if it does not exist yet.
 func (m *Manager) ensureInit(ctx context.Context, slots uint64) error {
 	if m == nil {
 		return ErrNilManager
 	}
 
-	sem := NewSemaphore(slots)
-	semValue, err := sem.String()
-	if err != nil {
-		return err
+	_, err := m.backend.CompareAndSwap(ctx, Update{Group: m.groups[0], Semaphore: NewSemaphore(slots), Version: 0})
+	if err == ErrConflict {
+		// Already initialized.
+		return nil
 	}
+	return err
+}
 
-	_, err = m.client.Txn(ctx).If(
-		// version=0 means that the key does not exist.
-		clientv3.Compare(clientv3.Version(m.keyPath), "=", 0),
-	).Then(
-		clientv3.OpPut(m.keyPath, semValue),
-	).Commit()
+// get returns the current value and version of the given semaphores, or
+// an error. Semaphores with an older schema are upgraded, to be written
+// back on the next update.
+func (m *Manager) get(ctx context.Context, groups []string) ([]Update, error) {
+	if m == nil {
+		return nil, ErrNilManager
+	}
 
-	if err != nil {
-		return err
+	updates := make([]Update, 0, len(groups))
+	for _, group := range groups {
+		sem, version, err := m.backend.Get(ctx, group)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := upgradeSemaphore(sem); err != nil {
+			return nil, err
+		}
+		updates = append(updates, Update{Group: group, Semaphore: sem, Version: version})
 	}
-	return nil
+
+	return updates, nil
 }
 
-// Get returns the current semaphore value and version, or an error.
-func (m *Manager) get(ctx context.Context) (*Semaphore, int64, error) {
-	resp, err := m.client.Get(ctx, m.keyPath)
-	if err != nil {
-		return nil, 0, err
+// set writes all semaphores, if their versions are still the ones
+// observed, returning the revision of the write. Updates without a
+// semaphore are only compared.
+func (m *Manager) set(ctx context.Context, updates []Update) (int64, error) {
+	if m == nil {
+		return 0, ErrNilManager
+	}
+
+	revision, err := m.backend.CompareAndSwap(ctx, updates...)
+	if err == ErrConflict {
+		casConflicts.Inc()
 	}
-	if resp.Count != 1 {
-		return nil, 0, fmt.Errorf("unexpected number of results: %d", resp.Count)
+	return revision, err
+}
+
+// RecursiveLock adds this lock id as a holder to the semaphore
+// it will return an error if there is a problem getting or setting the
+// semaphore, or if the maximum number of holders has been reached.
+// With several groups, a slot is taken in each of them or in none.
+//
+// On success, it returns the fencing token of the holder: the revision
+// at which the slot was taken, which increases with every acquisition.
+// Re-locking a held slot returns the same token.
+//
+// Conflicts with concurrent updates are retried a bounded number of
+// times. It returns ErrConflict if they kept getting in the way, in which
+// case nothing has been taken, and ErrSlotLost if the slot got released
+// before its token was recorded.
+func (m *Manager) RecursiveLock(ctx context.Context, id string) (int64, error) {
+	var token int64
+	err := m.retryOnConflict(func() error {
+		var err error
+		token, err = m.recursiveLock(ctx, id)
+		return err
+	})
+
+	return token, err
+}
+
+func (m *Manager) recursiveLock(ctx context.Context, id string) (int64, error) {
+	all, err := m.get(ctx, append(append([]string{}, m.groups...), m.observed...))
+	if err != nil {
+		return 0, err
 	}
+	updates := all[:len(m.groups)]
 
-	var data []byte
-	var version int64
-	for _, kv := range resp.Kvs {
-		data = kv.Value
-		version = kv.Version
-		break
+	allHeld := true
+	for _, u := range updates {
+		allHeld = allHeld && containsHolder(u.Semaphore.Holders, id)
 	}
-	if version == 0 {
-		return nil, 0, errors.New("key at version 0")
+	if token := heldToken(updates, id); allHeld && token != 0 {
+		return token, nil
 	}
-	if len(data) == 0 {
-		return nil, 0, errors.New("empty semaphore value")
+	if !allHeld && len(m.guards) > 0 {
+		sems := make(map[string]*Semaphore, len(all))
+		for _, u := range all {
+			sems[u.Group] = u.Semaphore
+		}
+		for _, guard := range m.guards {
+			if err := guard(id, sems); err != nil {
+				return 0, err
+			}
+		}
 	}
 
-	sem := &Semaphore{}
-	err = json.Unmarshal(data, sem)
+	now := time.Now()
+	taken := []string{}
+	for i, u := range updates {
+		held, err := u.Semaphore.RecursiveLock(id)
+		if err != nil {
+			return 0, err
+		}
+		if held {
+			continue
+		}
+		taken = append(taken, u.Group)
+		if err := checkSpread(u.Group, u.Semaphore, id, m.labels, m.spreads[u.Group]); err != nil {
+			return 0, err
+		}
+		if budget, ok := m.disruptions[u.Group]; ok {
+			members, err := m.backend.Members(ctx, u.Group)
+			if err != nil {
+				return 0, err
+			}
+			if err := checkDisruption(u.Group, u.Semaphore, members, budget, now); err != nil {
+				return 0, err
+			}
+			// A concurrent health change must not change availability
+			// before the slot is taken.
+			updates[i].Members = memberHealth(members)
+		}
+		u.Semaphore.setLabels(id, m.labels)
+	}
+	// Observed semaphores must not have changed since the guards ran.
+	for _, u := range all[len(m.groups):] {
+		updates = append(updates, Update{Group: u.Group, Semaphore: nil, Version: u.Version})
+	}
+
+	// The revision of a write is only known once committed, thus the
+	// token is recorded by a follow-up update. Holders from before
+	// fencing tokens get one here as well.
+	revision, err := m.set(ctx, updates)
 	if err != nil {
-		return nil, 0, err
+		return 0, err
 	}
 
-	return sem, version, nil
+	// Concurrent writes to the same semaphores, e.g. other nodes locking,
+	// must not leave the slot without a token.
+	var token int64
+	err = m.retryOnConflict(func() error {
+		var err error
+		token, err = m.recordToken(ctx, id, revision)
+		return err
+	})
+	if err != nil && err != ErrSlotLost {
+		// The caller gets no token, so the slots just taken would leak.
+		m.undoLock(id, taken)
+	}
+	return token, err
 }
 
-// ensureInit initialize the semaphore in etcd, if it does not exist yet.
-func (m *Manager) set(ctx context.Context, sem *Semaphore, version int64) error {
-	if m == nil {
-		return ErrNilManager
-	}
-	if sem == nil {
-		return ErrNilSemaphore
+// undoLock releases the slots of this lock id in `groups`, unless a
+// concurrent request already recorded a token for them. Failures are
+// ignored: a retried acquisition of the same id picks the slots up.
+func (m *Manager) undoLock(id string, groups []string) {
+	if len(groups) == 0 {
+		return
 	}
 
-	data, err := json.Marshal(sem)
-	if err != nil {
+	ctx, cancel := context.WithTimeout(context.Background(), undoTimeout)
+	defer cancel()
+	m.retryOnConflict(func() error {
+		updates, err := m.get(ctx, groups)
+		if err != nil {
+			return err
+		}
+		for _, u := range updates {
+			if u.Semaphore.Token(id) != 0 {
+				return nil
+			}
+			if err := u.Semaphore.UnlockIfHeld(id); err != nil {
+				return err
+			}
+		}
+		_, err = m.set(ctx, updates)
 		return err
+	})
+}
+
+// heldToken returns the fencing token of a holder, i.e. the one in the
+// group of the manager, or 0 if it lacks a token in any group.
+func heldToken(updates []Update, id string) int64 {
+	for _, u := range updates {
+		if u.Semaphore.Token(id) == 0 {
+			return 0
+		}
 	}
 
-	// Conditionally Put if version in etcd is still the same we observed.
-	// If the condition is not met, the transaction will return as "not succeeding".
-	resp, err := m.client.Txn(ctx).If(
-		clientv3.Compare(clientv3.Version(m.keyPath), "=", version),
-	).Then(
-		clientv3.OpPut(m.keyPath, string(data)),
-	).Commit()
+	return updates[0].Semaphore.Token(id)
+}
 
+// recordToken stores the fencing token of a holder in all groups, together
+// with the time it took the slot, unless a concurrent request already did.
+// It returns ErrSlotLost if the slot has been released in the meantime.
+func (m *Manager) recordToken(ctx context.Context, id string, token int64) (int64, error) {
+	updates, err := m.get(ctx, m.groups)
 	if err != nil {
-		return err
+		return 0, err
+	}
+
+	changed := false
+	for _, u := range updates {
+		if !containsHolder(u.Semaphore.Holders, id) {
+			return 0, ErrSlotLost
+		}
+		if u.Semaphore.Token(id) == 0 {
+			u.Semaphore.setToken(id, token)
+			u.Semaphore.setAcquired(id, time.Now())
+			changed = true
+		}
 	}
-	if !resp.Succeeded {
-		return errors.New("conflict on semaphore detected, aborting")
+	if changed {
+		if _, err := m.set(ctx, updates); err != nil {
+			return 0, err
+		}
 	}
 
-	return nil
+	return heldToken(updates, id), nil
 }
 
-// RecursiveLock adds this lock id as a holder to the semaphore
-// it will return an error if there is a problem getting or setting the
-// semaphore, or if the maximum number of holders has been reached.
-func (m *Manager) RecursiveLock(ctx context.Context, id string) error {
-	sem, version, err := m.get(ctx)
+// Verify checks that a fencing token is the one of the current slot of
+// this lock id, returning ErrStaleToken otherwise (e.g. if the slot has
+// been released, or taken again with a newer token).
+func (m *Manager) Verify(ctx context.Context, id string, token int64) error {
+	updates, err := m.get(ctx, m.groups)
 	if err != nil {
 		return err
 	}
+	if token <= 0 || heldToken(updates, id) != token {
+		return ErrStaleToken
+	}
 
-	held, err := sem.RecursiveLock(id)
+	return nil
+}
+
+// UnlockIfHeld removes this lock id as a holder of the semaphore
+// it returns an error if there is a problem getting or setting the semaphore.
+// With several groups, the slots in all of them are released.
+// Conflicts with concurrent updates are retried a bounded number of times.
+func (m *Manager) UnlockIfHeld(ctx context.Context, id string) error {
+	return m.retryOnConflict(func() error {
+		return m.unlockIfHeld(ctx, id)
+	})
+}
+
+func (m *Manager) unlockIfHeld(ctx context.Context, id string) error {
+	updates, err := m.get(ctx, m.groups)
 	if err != nil {
 		return err
 	}
-	if held {
-		return nil
+
+	for _, u := range updates {
+		if err := u.Semaphore.UnlockIfHeld(id); err != nil {
+			return err
+		}
 	}
 
-	if err := m.set(ctx, sem, version); err != nil {
+	if _, err := m.set(ctx, updates); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-// UnlockIfHeld removes this lock id as a holder of the semaphore
-// it returns an error if there is a problem getting or setting the semaphore.
-func (m *Manager) UnlockIfHeld(ctx context.Context, id string) error {
-	sem, version, err := m.get(ctx)
+// WithVersionTTL returns a copy of the manager which forgets the versions
+// of nodes which did not report one for longer than `ttl`, e.g. nodes
+// which got decommissioned. Zero keeps versions forever.
+func (m *Manager) WithVersionTTL(ttl time.Duration) *Manager {
+	if m == nil {
+		return nil
+	}
+
+	expiring := *m
+	expiring.versionTTL = ttl
+	return &expiring
+}
+
+// ReportVersion records the `current_version` reported by this lock id
+// in all groups, as tracked for rollout stages. Versions which expired
+// are forgotten in the same write.
+func (m *Manager) ReportVersion(ctx context.Context, id string, version string) error {
+	return m.retryOnConflict(func() error {
+		return m.reportVersion(ctx, id, version)
+	})
+}
+
+func (m *Manager) reportVersion(ctx context.Context, id string, version string) error {
+	updates, err := m.get(ctx, m.groups)
 	if err != nil {
 		return err
 	}
 
-	if err := sem.UnlockIfHeld(id); err != nil {
-		return err
+	now := time.Now()
+	changed := false
+	for _, u := range updates {
+		sem := u.Semaphore
+		if m.versionTTL > 0 && sem.expireVersions(now.Add(-m.versionTTL)) {
+			changed = true
+		}
+		stale := m.versionTTL > 0 && now.Sub(time.Unix(sem.Reported[id], 0)) > m.versionTTL/versionRefreshes
+		if sem.Versions[id] != version || stale {
+			sem.setVersion(id, version, now)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
 	}
 
-	if err := m.set(ctx, sem, version); err != nil {
+	_, err = m.set(ctx, updates)
+	return err
+}
+
+// ForgetNode releases the slots of this lock id and forgets its reported
+// version in all groups, e.g. for a decommissioned node. It returns
+// whether anything was recorded for it.
+func (m *Manager) ForgetNode(ctx context.Context, id string) (bool, error) {
+	forgotten := false
+	err := m.retryOnConflict(func() error {
+		var err error
+		forgotten, err = m.forgetNode(ctx, id)
 		return err
+	})
+	return forgotten, err
+}
+
+func (m *Manager) forgetNode(ctx context.Context, id string) (bool, error) {
+	updates, err := m.get(ctx, m.groups)
+	if err != nil {
+		return false, err
 	}
 
-	return nil
+	forgotten := false
+	for _, u := range updates {
+		found, err := u.Semaphore.forgetNode(id)
+		if err != nil {
+			return false, err
+		}
+		forgotten = forgotten || found
+	}
+	if !forgotten {
+		return false, nil
+	}
+
+	_, err = m.set(ctx, updates)
+	return true, err
+}
+
+// retryOnConflict runs a semaphore update, retrying it a bounded
+// number of times if it lost a race against a concurrent update.
+func (m *Manager) retryOnConflict(update func() error) error {
+	var err error
+	for attempt := 0; attempt <= maxConflictRetries; attempt++ {
+		if attempt > 0 {
+			casRetries.Inc()
+		}
+		err = update()
+		if err != ErrConflict {
+			return err
+		}
+	}
+
+	return err
 }
@@ -0,0 +1,228 @@
+package lock
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	// memoryHistorySize bounds the number of changes kept for watches.
+	memoryHistorySize = 1000
+)
+
+// MemoryBackend stores semaphores in memory, for tests and single-instance
+// deployments. It is safe for concurrent use.
+type MemoryBackend struct {
+	mu       sync.Mutex
+	revision int64
+	values   map[string]memoryValue
+	// members are the member records of nodes, by group and node.
+	members map[string]map[string]Member
+	// history holds the latest changes, oldest first, starting at
+	// revision `oldest`.
+	history []Change
+	oldest  int64
+	// notify is closed and replaced on every write, to wake up watchers.
+	notify chan struct{}
+}
+
+// memoryValue is a stored semaphore, encoded to avoid aliasing.
+type memoryValue struct {
+	data    []byte
+	version int64
+}
+
+// NewMemoryBackend returns an empty in-memory backend.
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		revision: 1,
+		oldest:   1,
+		values:   map[string]memoryValue{},
+		members:  map[string]map[string]Member{},
+		notify:   make(chan struct{}),
+	}
+}
+
+// Get returns the semaphore of a group and its version.
+func (b *MemoryBackend) Get(ctx context.Context, group string) (*Semaphore, int64, error) {
+	b.mu.Lock()
+	value, ok := b.values[group]
+	b.mu.Unlock()
+	if !ok {
+		return nil, 0, ErrUnknownGroup
+	}
+
+	sem, err := decodeSemaphore(value.data)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return sem, value.version, nil
+}
+
+// CompareAndSwap atomically writes all updates.
+func (b *MemoryBackend) CompareAndSwap(ctx context.Context, updates ...Update) (int64, error) {
+	encoded := make([][]byte, len(updates))
+	for i, u := range updates {
+		if u.Semaphore == nil {
+			continue
+		}
+		value, err := u.Semaphore.String()
+		if err != nil {
+			return 0, err
+		}
+		encoded[i] = []byte(value)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now().Unix()
+	for _, u := range updates {
+		if b.values[u.Group].version != u.Version {
+			return 0, ErrConflict
+		}
+		if u.Members == nil {
+			continue
+		}
+		if err := checkMembers(u.Members, b.members[u.Group], now); err != nil {
+			return 0, err
+		}
+	}
+
+	b.revision++
+	for i, u := range updates {
+		if u.Semaphore == nil {
+			continue
+		}
+		prev, existed := b.values[u.Group]
+		b.values[u.Group] = memoryValue{encoded[i], prev.version + 1}
+
+		change := Change{Group: u.Group, Revision: b.revision}
+		change.Cur, _ = decodeSemaphore(encoded[i])
+		if existed {
+			change.Prev, _ = decodeSemaphore(prev.data)
+		}
+		b.history = append(b.history, change)
+	}
+	if len(b.history) > memoryHistorySize {
+		dropped := len(b.history) - memoryHistorySize
+		b.oldest = b.history[dropped-1].Revision + 1
+		b.history = append([]Change(nil), b.history[dropped:]...)
+	}
+	close(b.notify)
+	b.notify = make(chan struct{})
+
+	return b.revision, nil
+}
+
+// List returns the semaphores of all groups.
+func (b *MemoryBackend) List(ctx context.Context) (map[string]*Semaphore, int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	sems := make(map[string]*Semaphore, len(b.values))
+	for group, value := range b.values {
+		sem, err := decodeSemaphore(value.data)
+		if err != nil {
+			return nil, 0, err
+		}
+		sems[group] = sem
+	}
+
+	return sems, b.revision, nil
+}
+
+// Members returns the unexpired member records of a group.
+func (b *MemoryBackend) Members(ctx context.Context, group string) (map[string]Member, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now().Unix()
+	members := map[string]Member{}
+	for node, member := range b.members[group] {
+		if !member.expired(now) {
+			members[node] = member
+		}
+	}
+
+	return members, nil
+}
+
+// SetMember writes the member record of a node, versioned by the
+// backend revision. Watchers are not woken up.
+func (b *MemoryBackend) SetMember(ctx context.Context, group, node string, member Member) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.members[group] == nil {
+		b.members[group] = map[string]Member{}
+	}
+	for n, other := range b.members[group] {
+		if other.expired(member.Time) {
+			delete(b.members[group], n)
+		}
+	}
+	b.revision++
+	member.Version = b.revision
+	b.members[group][node] = member
+
+	return nil
+}
+
+// Watch streams semaphore changes from the in-memory history. It returns
+// ErrCompacted if the watcher falls behind the retained history.
+func (b *MemoryBackend) Watch(ctx context.Context, group string, fromRevision int64, fn func(Change) error) error {
+	b.mu.Lock()
+	next := fromRevision
+	if next <= 0 {
+		next = b.revision + 1
+	}
+	b.mu.Unlock()
+
+	for {
+		changes, notify, err := b.changesSince(next)
+		if err != nil {
+			return err
+		}
+		for _, change := range changes {
+			next = change.Revision + 1
+			if group != "" && change.Group != group {
+				continue
+			}
+			if err := fn(change); err != nil {
+				return err
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-notify:
+		}
+	}
+}
+
+// changesSince returns the retained changes at or after a revision,
+// and a channel which is closed on the next write.
+func (b *MemoryBackend) changesSince(revision int64) ([]Change, chan struct{}, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if revision > b.revision {
+		return nil, b.notify, nil
+	}
+	if revision < b.oldest {
+		return nil, nil, ErrCompacted
+	}
+
+	var changes []Change
+	for _, change := range b.history {
+		if change.Revision >= revision {
+			changes = append(changes, change)
+		}
+	}
+
+	return changes, b.notify, nil
+}
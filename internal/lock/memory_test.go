@@ -0,0 +1,885 @@
+package lock
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemoryBackendCompareAndSwap(t *testing.T) {
+	ctx := context.Background()
+	b := NewMemoryBackend()
+
+	if _, _, err := b.Get(ctx, "g"); err != ErrUnknownGroup {
+		t.Errorf("unexpected error for missing group: %v", err)
+	}
+	if _, err := b.CompareAndSwap(ctx, Update{Group: "g", Semaphore: NewSemaphore(1), Version: 0}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.CompareAndSwap(ctx, Update{Group: "g", Semaphore: NewSemaphore(2), Version: 0}); err != ErrConflict {
+		t.Errorf("unexpected error on re-creation: %v", err)
+	}
+
+	sem, version, err := b.Get(ctx, "g")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 1 || sem.TotalSlots != 1 {
+		t.Errorf("unexpected semaphore at version %d: %+v", version, sem)
+	}
+
+	// Returned semaphores are copies.
+	sem.Holders = append(sem.Holders, "a")
+	if again, _, _ := b.Get(ctx, "g"); len(again.Holders) != 0 {
+		t.Error("stored semaphore modified through a returned copy")
+	}
+
+	// Multi-group updates are all-or-nothing.
+	_, err = b.CompareAndSwap(ctx,
+		Update{Group: "g", Semaphore: sem, Version: version},
+		Update{Group: "h", Semaphore: NewSemaphore(1), Version: 1},
+	)
+	if err != ErrConflict {
+		t.Errorf("unexpected error on partial conflict: %v", err)
+	}
+	if _, v, _ := b.Get(ctx, "g"); v != version {
+		t.Errorf("semaphore updated despite conflict, version %d", v)
+	}
+	if _, err := b.CompareAndSwap(ctx, Update{Group: "g", Semaphore: sem, Version: version}, Update{Group: "h", Semaphore: NewSemaphore(1), Version: 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	sems, _, err := b.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sems) != 2 || !reflect.DeepEqual(sems["g"].Holders, []string{"a"}) {
+		t.Errorf("unexpected semaphores: %+v", sems)
+	}
+}
+
+// testBackendMembers checks the member records of a backend without
+// semaphores yet.
+func testBackendMembers(t *testing.T, b Backend) {
+	ctx := context.Background()
+	if _, err := b.CompareAndSwap(ctx, Update{Group: "g", Semaphore: NewSemaphore(1)}); err != nil {
+		t.Fatal(err)
+	}
+	_, version, err := b.Get(ctx, "g")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Unix()
+	for _, record := range []struct {
+		group, node string
+		member      Member
+	}{
+		{"g", "gone", Member{Heartbeat: Heartbeat{now - 120, true}, Expires: now - 60}},
+		{"g", "a", Member{Heartbeat: Heartbeat{now, true}, Expires: now + 60}},
+		{"g", "b", Member{Heartbeat: Heartbeat{now, false}, Expires: now + 60}},
+		{"g.x", "c", Member{Heartbeat: Heartbeat{now, true}, Expires: now + 60}},
+	} {
+		if err := b.SetMember(ctx, record.group, record.node, record.member); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	members, err := b.Members(ctx, "g")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 2 || !members["a"].Healthy || members["b"].Healthy || members["a"].Time != now || members["a"].Version == 0 {
+		t.Fatalf("unexpected members: %+v", members)
+	}
+	if _, v, _ := b.Get(ctx, "g"); v != version {
+		t.Errorf("member records changed the semaphore version to %d", v)
+	}
+
+	// Taking a slot compares the member records it was based on, but
+	// not refreshed heartbeats.
+	check := Update{Group: "g", Version: version, Members: memberHealth(members)}
+	if _, err := b.CompareAndSwap(ctx, check); err != nil {
+		t.Errorf("unexpected error on unchanged members: %v", err)
+	}
+	if err := b.SetMember(ctx, "g", "a", Member{Heartbeat: Heartbeat{now + 1, true}, Expires: now + 60}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.CompareAndSwap(ctx, check); err != nil {
+		t.Errorf("unexpected error on refreshed heartbeat: %v", err)
+	}
+	if err := b.SetMember(ctx, "g", "b", Member{Heartbeat: Heartbeat{now, true}, Expires: now + 60}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.CompareAndSwap(ctx, check); err != ErrConflict {
+		t.Errorf("unexpected error on changed member: %v", err)
+	}
+
+	// Nodes joining concurrently conflict as well.
+	if members, err = b.Members(ctx, "g"); err != nil {
+		t.Fatal(err)
+	}
+	check = Update{Group: "g", Version: version, Members: memberHealth(members)}
+	if err := b.SetMember(ctx, "g", "d", Member{Heartbeat: Heartbeat{now, false}, Expires: now + 60}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.CompareAndSwap(ctx, check); err != ErrConflict {
+		t.Errorf("unexpected error on added member: %v", err)
+	}
+	if _, err := b.CompareAndSwap(ctx, Update{Group: "g", Version: version, Members: map[string]bool{}}); err != ErrConflict {
+		t.Errorf("unexpected error on members of a group expected without any: %v", err)
+	}
+}
+
+func TestMemoryBackendMembers(t *testing.T) {
+	testBackendMembers(t, NewMemoryBackend())
+}
+
+func TestMemoryBackendWatch(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	b := NewMemoryBackend()
+
+	manager, err := NewManager(ctx, b, "g", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, startRevision, _ := b.List(ctx)
+
+	var mu sync.Mutex
+	var events []Event
+	watchCtx, stopWatch := context.WithCancel(ctx)
+	done := make(chan error, 1)
+	go func() {
+		done <- WatchEvents(watchCtx, b, "g", startRevision+1, func(e Event) error {
+			mu.Lock()
+			defer mu.Unlock()
+			events = append(events, e)
+			if len(events) == 2 {
+				stopWatch()
+			}
+			return nil
+		})
+	}()
+
+	if _, err := NewManager(ctx, b, "other", 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := manager.RecursiveLock(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := manager.UnlockIfHeld(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-done; err != context.Canceled {
+		t.Errorf("unexpected watch error: %v", err)
+	}
+	expected := []Event{
+		{Kind: EventAcquired, Group: "g", Node: "a", Revision: startRevision + 2},
+		// The fencing token write in between changes no holders.
+		{Kind: EventReleased, Group: "g", Node: "a", Revision: startRevision + 4},
+	}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("unexpected events: %+v", events)
+	}
+
+	// Revisions older than the retained history are compacted.
+	for i := 0; i < memoryHistorySize; i++ {
+		manager.RecursiveLock(ctx, "a")
+		manager.UnlockIfHeld(ctx, "a")
+	}
+	err = b.Watch(ctx, "", startRevision, func(Change) error { return nil })
+	if err != ErrCompacted {
+		t.Errorf("unexpected error watching compacted revision: %v", err)
+	}
+}
+
+func TestManagerConcurrentLocks(t *testing.T) {
+	ctx := context.Background()
+	b := NewMemoryBackend()
+	if _, err := NewManager(ctx, b, "", 3); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	granted := 0
+	for _, id := range []string{"a", "b", "c", "d", "e", "f"} {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			m, err := OpenManager(ctx, b, "")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			// Conflicts may exhaust retries, but never over-grant.
+			if _, err := m.RecursiveLock(ctx, id); err == nil {
+				mu.Lock()
+				granted++
+				mu.Unlock()
+			}
+		}(id)
+	}
+	wg.Wait()
+
+	sem, _, err := b.Get(ctx, defaultGroup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if granted > 3 || len(sem.Holders) != granted {
+		t.Errorf("granted %d locks, semaphore holds %v", granted, sem.Holders)
+	}
+}
+
+func TestManagerFencingTokens(t *testing.T) {
+	ctx := context.Background()
+	b := NewMemoryBackend()
+	manager, err := NewManager(ctx, b, "g", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := manager.RecursiveLock(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first <= 0 {
+		t.Fatalf("unexpected fencing token: %d", first)
+	}
+	if again, err := manager.RecursiveLock(ctx, "a"); err != nil || again != first {
+		t.Errorf("unexpected token on recursive lock: %d, %v", again, err)
+	}
+	other, err := manager.RecursiveLock(ctx, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other <= first {
+		t.Errorf("token %d not greater than earlier %d", other, first)
+	}
+
+	if err := manager.Verify(ctx, "a", first); err != nil {
+		t.Errorf("unexpected error verifying current token: %v", err)
+	}
+	if err := manager.Verify(ctx, "a", other); err != ErrStaleToken {
+		t.Errorf("unexpected result verifying token of another holder: %v", err)
+	}
+
+	// A released and re-taken slot gets a newer token.
+	if err := manager.UnlockIfHeld(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := manager.Verify(ctx, "a", first); err != ErrStaleToken {
+		t.Errorf("unexpected result verifying released token: %v", err)
+	}
+	second, err := manager.RecursiveLock(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second <= other {
+		t.Errorf("token %d not greater than earlier %d", second, other)
+	}
+	if err := manager.Verify(ctx, "a", first); err != ErrStaleToken {
+		t.Errorf("unexpected result verifying superseded token: %v", err)
+	}
+
+	// Holders from before fencing tokens get one on their next lock.
+	legacy := &Semaphore{SchemaVersion: 1, TotalSlots: 1, Holders: []string{"c"}}
+	if _, err := b.CompareAndSwap(ctx, Update{Group: "legacy", Semaphore: legacy, Version: 0}); err != nil {
+		t.Fatal(err)
+	}
+	legacyManager, err := OpenManager(ctx, b, "legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := legacyManager.RecursiveLock(ctx, "c")
+	if err != nil || token <= second {
+		t.Errorf("unexpected token for legacy holder: %d, %v", token, err)
+	}
+	if err := legacyManager.Verify(ctx, "c", token); err != nil {
+		t.Errorf("unexpected error verifying legacy holder token: %v", err)
+	}
+}
+
+// failingBackend fails a given compare-and-swap call with a non-conflict
+// error, e.g. a timeout.
+type failingBackend struct {
+	Backend
+	calls  int
+	failAt int
+}
+
+func (b *failingBackend) CompareAndSwap(ctx context.Context, updates ...Update) (int64, error) {
+	b.calls++
+	if b.calls == b.failAt {
+		return 0, context.DeadlineExceeded
+	}
+	return b.Backend.CompareAndSwap(ctx, updates...)
+}
+
+func TestManagerTokenFailure(t *testing.T) {
+	ctx := context.Background()
+	b := &failingBackend{Backend: NewMemoryBackend()}
+	manager, err := NewManager(ctx, b, "g", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The slot is taken, then recording its token times out.
+	b.failAt = b.calls + 2
+	if _, err := manager.RecursiveLock(ctx, "a"); err != context.DeadlineExceeded {
+		t.Fatalf("unexpected error on failed token write: %v", err)
+	}
+	sem, _, err := b.Get(ctx, "g")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sem.Holders) != 0 {
+		t.Errorf("slot not given back after failed token write: %v", sem.Holders)
+	}
+
+	token, err := manager.RecursiveLock(ctx, "b")
+	if err != nil || token <= 0 {
+		t.Errorf("unexpected result locking after failed token write: %d, %v", token, err)
+	}
+}
+
+// interferingBackend runs a concurrent write right before a given
+// compare-and-swap call.
+type interferingBackend struct {
+	Backend
+	calls     int
+	at        int
+	interfere func()
+}
+
+func (b *interferingBackend) CompareAndSwap(ctx context.Context, updates ...Update) (int64, error) {
+	b.calls++
+	if b.calls == b.at {
+		b.interfere()
+	}
+	return b.Backend.CompareAndSwap(ctx, updates...)
+}
+
+func TestManagerTokenConflict(t *testing.T) {
+	ctx := context.Background()
+	b := &interferingBackend{Backend: NewMemoryBackend()}
+	manager, err := NewManager(ctx, b, "g", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := OpenManager(ctx, b.Backend, "g")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Another node locks between taking the slot and recording its token.
+	b.at, b.interfere = b.calls+2, func() {
+		if _, err := other.RecursiveLock(ctx, "b"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	token, err := manager.RecursiveLock(ctx, "a")
+	if err != nil || token <= 0 {
+		t.Fatalf("unexpected result with conflicting token write: %d, %v", token, err)
+	}
+	sem, _, err := b.Get(ctx, "g")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sem.Token("a") != token || sem.Acquired["a"] == 0 || len(sem.Holders) != 2 {
+		t.Errorf("unexpected semaphore after conflicting token write: %+v", sem)
+	}
+
+	// The slot is released before its token is recorded.
+	if err := manager.UnlockIfHeld(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	b.at, b.interfere = b.calls+2, func() {
+		if err := other.UnlockIfHeld(ctx, "a"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := manager.RecursiveLock(ctx, "a"); err != ErrSlotLost {
+		t.Errorf("unexpected error on slot released before its token: %v", err)
+	}
+}
+
+func TestManagerLockConflict(t *testing.T) {
+	ctx := context.Background()
+	b := &interferingBackend{Backend: NewMemoryBackend()}
+	manager, err := NewManager(ctx, b, "g", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := OpenManager(ctx, b.Backend, "g")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Another node locks right before the slot is taken.
+	b.at, b.interfere = b.calls+1, func() {
+		if _, err := other.RecursiveLock(ctx, "b"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := manager.RecursiveLock(ctx, "a"); err != nil {
+		t.Fatalf("lock not retried on conflict: %v", err)
+	}
+
+	// Another node unlocks right before the slot is released.
+	b.at, b.interfere = b.calls+1, func() {
+		if err := other.UnlockIfHeld(ctx, "b"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := manager.UnlockIfHeld(ctx, "a"); err != nil {
+		t.Fatalf("unlock not retried on conflict: %v", err)
+	}
+	sem, _, err := b.Get(ctx, "g")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sem.Holders) != 0 {
+		t.Errorf("unexpected holders after unlocking: %v", sem.Holders)
+	}
+}
+
+func TestManagerParentGroups(t *testing.T) {
+	ctx := context.Background()
+	b := NewMemoryBackend()
+	for group, slots := range map[string]uint64{"rack-a": 1, "rack-b": 1, "dc": 1} {
+		if _, err := NewManager(ctx, b, group, slots); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := OpenManager(ctx, b, "rack-a", "missing"); err != ErrUnknownGroup {
+		t.Errorf("unexpected error with missing parent: %v", err)
+	}
+	rackA, err := OpenManager(ctx, b, "rack-a", "dc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rackB, err := OpenManager(ctx, b, "rack-b", "dc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := rackA.RecursiveLock(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rackA.Verify(ctx, "a", token); err != nil {
+		t.Errorf("unexpected error verifying token: %v", err)
+	}
+
+	// The parent is full, thus no slot is taken in the other rack either.
+	if _, err := rackB.RecursiveLock(ctx, "b"); err != ErrSemaphoreFull {
+		t.Errorf("unexpected error with full parent: %v", err)
+	}
+	if sem, _, _ := b.Get(ctx, "rack-b"); len(sem.Holders) != 0 {
+		t.Errorf("slot taken in child of full parent: %v", sem.Holders)
+	}
+
+	if err := rackA.UnlockIfHeld(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	for _, group := range []string{"rack-a", "dc"} {
+		if sem, _, _ := b.Get(ctx, group); len(sem.Holders) != 0 {
+			t.Errorf("slot not released in group %s: %v", group, sem.Holders)
+		}
+	}
+	if _, err := rackB.RecursiveLock(ctx, "b"); err != nil {
+		t.Errorf("unexpected error after parent release: %v", err)
+	}
+}
+
+func TestManagerGuard(t *testing.T) {
+	ctx := context.Background()
+	b := NewMemoryBackend()
+	gate, err := NewManager(ctx, b, "gate", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewManager(ctx, b, "g", 2); err != nil {
+		t.Fatal(err)
+	}
+	base, err := OpenManager(ctx, b, "g")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Slots are only granted while nobody holds the gate.
+	errGated := errors.New("gated")
+	manager := base.WithGuard(func(id string, sems map[string]*Semaphore) error {
+		if len(sems["gate"].Holders) > 0 {
+			return errGated
+		}
+		return nil
+	}, "gate")
+
+	if _, err := gate.RecursiveLock(ctx, "x"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := manager.RecursiveLock(ctx, "a"); err != errGated {
+		t.Errorf("unexpected error with closed gate: %v", err)
+	}
+	if err := gate.UnlockIfHeld(ctx, "x"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := manager.RecursiveLock(ctx, "a"); err != nil {
+		t.Errorf("unexpected error with open gate: %v", err)
+	}
+	// Guards only apply to new slots.
+	if _, err := gate.RecursiveLock(ctx, "x"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := manager.RecursiveLock(ctx, "a"); err != nil {
+		t.Errorf("unexpected error re-locking held slot: %v", err)
+	}
+
+	// Observed semaphores are compared, but not written.
+	if sem, version, _ := b.Get(ctx, "gate"); version != 6 || len(sem.Holders) != 1 {
+		t.Errorf("unexpected gate semaphore at version %d: %+v", version, sem)
+	}
+	sem, version, err := b.Get(ctx, "g")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.CompareAndSwap(ctx, Update{Group: "g", Semaphore: sem, Version: version}, Update{Group: "gate", Semaphore: nil, Version: 5}); err != ErrConflict {
+		t.Errorf("unexpected error on stale compared version: %v", err)
+	}
+	if _, err := b.CompareAndSwap(ctx, Update{Group: "g", Semaphore: sem, Version: version}, Update{Group: "gate", Semaphore: nil, Version: 6}); err != nil {
+		t.Errorf("unexpected error on current compared version: %v", err)
+	}
+
+	if err := base.ReportVersion(ctx, "a", "1.2.3"); err != nil {
+		t.Fatal(err)
+	}
+	if sem, _, _ := b.Get(ctx, "g"); sem.Versions["a"] != "1.2.3" {
+		t.Errorf("unexpected reported versions: %v", sem.Versions)
+	}
+}
+
+func TestManagerVersionExpiry(t *testing.T) {
+	ctx := context.Background()
+	b := NewMemoryBackend()
+	manager, err := NewManager(ctx, b, "g", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A decommissioned node reported long ago.
+	sem, version, err := b.Get(ctx, "g")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sem.setVersion("gone", "1", time.Now().Add(-2*time.Hour))
+	if _, err := b.CompareAndSwap(ctx, Update{Group: "g", Semaphore: sem, Version: version}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := manager.RecursiveLock(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := manager.ReportVersion(ctx, "a", "2"); err != nil {
+		t.Fatal(err)
+	}
+	sem, _, _ = b.Get(ctx, "g")
+	if len(sem.Versions) != 2 || len(sem.CurrentVersions(time.Now().Add(-time.Hour))) != 1 {
+		t.Errorf("unexpected versions without TTL: %v %v", sem.Versions, sem.Reported)
+	}
+
+	if err := manager.WithVersionTTL(time.Hour).ReportVersion(ctx, "a", "2"); err != nil {
+		t.Fatal(err)
+	}
+	sem, _, _ = b.Get(ctx, "g")
+	if _, ok := sem.Versions["gone"]; ok || sem.Versions["a"] != "2" {
+		t.Errorf("unexpected versions with TTL: %v", sem.Versions)
+	}
+
+	forgotten, err := manager.ForgetNode(ctx, "a")
+	if err != nil || !forgotten {
+		t.Fatalf("unexpected result forgetting node: %v %v", forgotten, err)
+	}
+	sem, _, _ = b.Get(ctx, "g")
+	if len(sem.Holders) != 0 || len(sem.Versions) != 0 || len(sem.Reported) != 0 {
+		t.Errorf("unexpected semaphore after forgetting node: %+v", sem)
+	}
+	if forgotten, err := manager.ForgetNode(ctx, "a"); err != nil || forgotten {
+		t.Errorf("unexpected result forgetting unknown node: %v %v", forgotten, err)
+	}
+}
+
+func TestManagerEnforceBudget(t *testing.T) {
+	ctx := context.Background()
+	b := NewMemoryBackend()
+	manager, err := NewManager(ctx, b, "g", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"a", "b"} {
+		if _, err := manager.RecursiveLock(ctx, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sem, _, err := b.Get(ctx, "g")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sem.Acquired) != 2 {
+		t.Fatalf("unexpected acquisition times: %v", sem.Acquired)
+	}
+
+	budget := Budget{MaxHold: time.Hour, MaxFailures: 2}
+	now := time.Unix(sem.Acquired["a"], 0)
+	if reason, err := manager.EnforceBudget(ctx, budget, now.Add(time.Minute)); err != nil || reason != "" {
+		t.Errorf("unexpected result within max hold: %q, %v", reason, err)
+	}
+
+	// Overdue holders are counted once, until the budget is exhausted.
+	later := now.Add(2 * time.Hour)
+	if err := manager.UnlockIfHeld(ctx, "b"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if reason, err := manager.EnforceBudget(ctx, budget, later); err != nil || reason != "" {
+			t.Errorf("#%d: unexpected result with one overdue holder: %q, %v", i, reason, err)
+		}
+	}
+	if _, err := manager.RecursiveLock(ctx, "c"); err != nil {
+		t.Fatal(err)
+	}
+	reason, err := manager.EnforceBudget(ctx, budget, later.Add(2*time.Hour))
+	if err != nil || reason == "" {
+		t.Fatalf("unexpected result with exhausted budget: %q, %v", reason, err)
+	}
+	sem, _, _ = b.Get(ctx, "g")
+	if !sem.Paused || sem.PauseReason != reason || sem.Failures != 2 || !reflect.DeepEqual(sem.Overdue, []string{"a", "c"}) {
+		t.Errorf("unexpected paused semaphore: %+v", sem)
+	}
+	if _, err := manager.RecursiveLock(ctx, "d"); err != ErrPaused {
+		t.Errorf("unexpected error on paused group: %v", err)
+	}
+
+	// Resuming resets failures, but not the overdue holders.
+	if err := manager.Resume(ctx); err != nil {
+		t.Fatal(err)
+	}
+	sem, _, _ = b.Get(ctx, "g")
+	if sem.Paused || sem.PauseReason != "" || sem.Failures != 0 || len(sem.Overdue) != 2 {
+		t.Errorf("unexpected resumed semaphore: %+v", sem)
+	}
+	if err := manager.UnlockIfHeld(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	sem, _, _ = b.Get(ctx, "g")
+	if !reflect.DeepEqual(sem.Overdue, []string{"c"}) || sem.Acquired["a"] != 0 {
+		t.Errorf("unexpected semaphore after releasing overdue holder: %+v", sem)
+	}
+
+	// Several holders getting overdue at once are counted once each,
+	// even when sorted before those already counted.
+	for _, id := range []string{"a", "b"} {
+		if _, err := manager.RecursiveLock(ctx, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	budget.MaxFailures = 0
+	if _, err := manager.EnforceBudget(ctx, budget, later.Add(4*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := manager.EnforceBudget(ctx, budget, later.Add(4*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	sem, _, _ = b.Get(ctx, "g")
+	if sem.Failures != 2 || !reflect.DeepEqual(sem.Overdue, []string{"a", "b", "c"}) {
+		t.Errorf("unexpected semaphore with several new overdue holders: %+v", sem)
+	}
+
+	if err := manager.Pause(ctx, "maintenance"); err != nil {
+		t.Fatal(err)
+	}
+	if err := manager.Pause(ctx, "other"); err != nil {
+		t.Fatal(err)
+	}
+	if sem, _, _ = b.Get(ctx, "g"); !sem.Paused || sem.PauseReason != "maintenance" {
+		t.Errorf("unexpected manually paused semaphore: %+v", sem)
+	}
+}
+
+func TestManagerReportFailure(t *testing.T) {
+	ctx := context.Background()
+	b := NewMemoryBackend()
+	for _, group := range []string{"parent", "g"} {
+		if _, err := NewManager(ctx, b, group, 2); err != nil {
+			t.Fatal(err)
+		}
+	}
+	manager, err := OpenManager(ctx, b, "g", "parent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"a", "b"} {
+		if _, err := manager.RecursiveLock(ctx, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	budgets := map[string]Budget{"g": {MaxFailures: 2}}
+	paused, err := manager.ReportFailure(ctx, "a", Failure{Version: "2", Description: "boom", Budgets: budgets})
+	if err != nil || len(paused) != 0 {
+		t.Fatalf("unexpected result for retained failure: %v, %v", paused, err)
+	}
+	paused, err = manager.ReportFailure(ctx, "b", Failure{Version: "2", Description: "boom", Release: true, Budgets: budgets})
+	if err != nil || paused["g"] == "" || len(paused) != 1 {
+		t.Fatalf("unexpected result for released failure: %v, %v", paused, err)
+	}
+
+	sem, _, _ := b.Get(ctx, "g")
+	if !reflect.DeepEqual(sem.Holders, []string{"a"}) || !sem.Paused || sem.Failures != 2 || sem.VersionFailures["2"] != 2 {
+		t.Errorf("unexpected group semaphore: %+v", sem)
+	}
+	if len(sem.NodeFailures) != 2 || sem.NodeFailures["a"].Version != "2" || sem.NodeFailures["b"].Time == 0 {
+		t.Errorf("unexpected node failures: %v", sem.NodeFailures)
+	}
+	// Parents are released, but failures are only counted in budgeted groups.
+	sem, _, _ = b.Get(ctx, "parent")
+	if !reflect.DeepEqual(sem.Holders, []string{"a"}) || sem.Paused || sem.Failures != 0 || len(sem.VersionFailures) != 0 {
+		t.Errorf("unexpected parent semaphore: %+v", sem)
+	}
+}
+
+func TestManagerSpread(t *testing.T) {
+	ctx := context.Background()
+	b := NewMemoryBackend()
+	base, err := NewManager(ctx, b, "g", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base = base.WithSpread("g", Spread{Label: "rack", MaxHolders: 1})
+	node := func(rack string) *Manager {
+		labels := map[string]string{"zone": "z1"}
+		if rack != "" {
+			labels["rack"] = rack
+		}
+		return base.WithLabels(labels)
+	}
+
+	if _, err := node("r1").RecursiveLock(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := node("r2").RecursiveLock(ctx, "b"); err != nil {
+		t.Errorf("unexpected error in other rack: %v", err)
+	}
+	_, err = node("r1").RecursiveLock(ctx, "c")
+	if serr, ok := err.(*SpreadError); !ok || serr.Value != "r1" || serr.Group != "g" {
+		t.Errorf("unexpected error in same rack: %v", err)
+	}
+	if _, err := node("").RecursiveLock(ctx, "d"); err == nil {
+		t.Error("unexpected success without constrained label")
+	}
+	// Held slots are not checked again.
+	if _, err := node("r1").RecursiveLock(ctx, "a"); err != nil {
+		t.Errorf("unexpected error re-locking held slot: %v", err)
+	}
+
+	sem, _, _ := b.Get(ctx, "g")
+	if !reflect.DeepEqual(sem.Labels["a"], map[string]string{"zone": "z1", "rack": "r1"}) || len(sem.Labels) != 2 {
+		t.Errorf("unexpected holder labels: %v", sem.Labels)
+	}
+	if err := base.UnlockIfHeld(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := node("r1").RecursiveLock(ctx, "c"); err != nil {
+		t.Errorf("unexpected error after release: %v", err)
+	}
+
+	// Holders without labels count against every value.
+	sem, version, _ := b.Get(ctx, "g")
+	sem.Holders = append(sem.Holders, "legacy")
+	if _, err := b.CompareAndSwap(ctx, Update{Group: "g", Semaphore: sem, Version: version}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := node("r3").RecursiveLock(ctx, "e"); err == nil {
+		t.Error("unexpected success with unlabeled holder")
+	}
+}
+
+func TestManagerDisruptionBudget(t *testing.T) {
+	ctx := context.Background()
+	b := NewMemoryBackend()
+	m, err := NewManager(ctx, b, "g", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for node, healthy := range map[string]bool{"a": true, "b": true, "c": true, "d": true, "sick": false} {
+		if err := m.Heartbeat(ctx, node, healthy, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Stale heartbeats keep the node known, but not available.
+	if err := m.Heartbeat(ctx, "stale", true, now.Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	m = m.WithDisruptionBudget("g", DisruptionBudget{MinAvailablePercent: 30})
+
+	// 6 known nodes, 2 required (rounded up): a and b can go, c cannot.
+	for _, node := range []string{"a", "b"} {
+		if _, err := m.RecursiveLock(ctx, node); err != nil {
+			t.Fatalf("unexpected error locking %s: %v", node, err)
+		}
+	}
+	_, err = m.RecursiveLock(ctx, "c")
+	if derr, ok := err.(*DisruptionError); !ok || derr.Required != 2 || derr.Available != 1 || derr.Known != 6 {
+		t.Errorf("unexpected error exceeding budget: %v", err)
+	}
+	// Held slots are not checked again.
+	if _, err := m.RecursiveLock(ctx, "a"); err != nil {
+		t.Errorf("unexpected error re-locking held slot: %v", err)
+	}
+	if err := m.UnlockIfHeld(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.RecursiveLock(ctx, "c"); err != nil {
+		t.Errorf("unexpected error after release: %v", err)
+	}
+
+	sem, version, _ := b.Get(ctx, "g")
+	members, err := b.Members(ctx, "g")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if known, available := sem.Availability(members, DisruptionBudget{}, now); known != 6 || available != 2 {
+		t.Errorf("unexpected availability: %d known, %d available", known, available)
+	}
+	// Nodes are forgotten after a while without heartbeats.
+	if known, _ := sem.Availability(members, DisruptionBudget{ForgetAfter: 30 * time.Minute}, now); known != 5 {
+		t.Errorf("unexpected number of known nodes: %d", known)
+	}
+	// Heartbeats do not touch the semaphore, but health changes conflict
+	// with taking slots based on the previous ones.
+	if err := m.Heartbeat(ctx, "d", false, now); err != nil {
+		t.Fatal(err)
+	}
+	if _, v, _ := b.Get(ctx, "g"); v != version {
+		t.Errorf("heartbeat wrote the semaphore: version %d, expected %d", v, version)
+	}
+	if _, err := b.CompareAndSwap(ctx, Update{Group: "g", Version: version, Members: memberHealth(members)}); err != ErrConflict {
+		t.Errorf("expected conflict on changed member record, got %v", err)
+	}
+	if err := m.Heartbeat(ctx, "a", true, now.Add(DefaultForgetAfter-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	b.mu.Lock()
+	_, ok := b.members["g"]["stale"]
+	count := len(b.members["g"])
+	b.mu.Unlock()
+	if ok || count != 5 {
+		t.Errorf("expected expired member record to be dropped, %d left", count)
+	}
+}
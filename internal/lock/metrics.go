@@ -0,0 +1,21 @@
+package lock
+
+import (
+	"github.com/lucab/exp-locksmith2/internal/metrics"
+)
+
+var (
+	casConflicts = metrics.NewCounterVec(
+		"locksmith2_semaphore_cas_conflicts_total",
+		"Number of semaphore updates aborted by a concurrent change.",
+	)
+	casRetries = metrics.NewCounterVec(
+		"locksmith2_semaphore_cas_retries_total",
+		"Number of semaphore updates retried after a conflict.",
+	)
+	etcdErrors = metrics.NewCounterVec(
+		"locksmith2_etcd_errors_total",
+		"Number of failed etcd operations, per operation.",
+		"operation",
+	)
+)
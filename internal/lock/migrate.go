@@ -0,0 +1,225 @@
+package lock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+const (
+	// CurrentSchemaVersion is the newest semaphore document format
+	// understood by this code. Documents written before schema versioning
+	// was introduced decode as version 0. Every change adding persisted
+	// state bumps it once, with its own migration.
+	CurrentSchemaVersion = 6
+)
+
+var (
+	// ErrSchemaTooNew is returned on semaphores written by a newer release.
+	ErrSchemaTooNew = errors.New("semaphore schema is newer than supported, refusing to touch it")
+)
+
+// migration upgrades a semaphore document by a single schema version.
+type migration struct {
+	// from is the schema version this migration applies to.
+	from int
+	// description summarizes the change, for reports.
+	description string
+	// apply upgrades the semaphore in place.
+	apply func(*Semaphore) error
+}
+
+// migrations lists all upgrades, indexed by source schema version.
+var migrations = []migration{
+	{
+		from:        0,
+		description: "add explicit schema version, normalize holders list",
+		apply: func(sem *Semaphore) error {
+			holders := []string{}
+			for _, h := range sem.Holders {
+				if !containsHolder(holders, h) {
+					holders = append(holders, h)
+					sort.Strings(holders)
+				}
+			}
+			sem.Holders = holders
+			return nil
+		},
+	},
+	{
+		// Releases before version 2 would drop fencing tokens on write,
+		// thus they must refuse to touch upgraded semaphores. Existing
+		// holders get a token on their next lock request.
+		from:        1,
+		description: "add per-holder fencing tokens",
+		apply: func(sem *Semaphore) error {
+			return nil
+		},
+	},
+	{
+		// Versions gate rollout stages, thus older releases must not
+		// drop them on write.
+		from:        2,
+		description: "track reported node versions",
+		apply: func(sem *Semaphore) error {
+			return nil
+		},
+	},
+	{
+		// Failure budgets pause semaphores automatically, thus older
+		// releases must not drop failure counts and pause reasons.
+		// Existing holders are timed from the first budget check.
+		from:        3,
+		description: "track hold durations and failures",
+		apply: func(sem *Semaphore) error {
+			return nil
+		},
+	},
+	{
+		// Failure reports count per attempted version and record the
+		// last failure of each node, thus older releases must not drop
+		// them on write. Earlier failures only count for the group.
+		from:        4,
+		description: "track reported failures per version and per node",
+		apply: func(sem *Semaphore) error {
+			return nil
+		},
+	},
+	{
+		// Spread constraints rely on holder labels, thus older releases
+		// must not drop them on write. Existing holders get labels on
+		// their next lock request.
+		from:        5,
+		description: "store node labels of holders",
+		apply: func(sem *Semaphore) error {
+			return nil
+		},
+	},
+}
+
+// MigrationResult describes the upgrade of a single group.
+type MigrationResult struct {
+	Group string
+	From  int
+	To    int
+	// Steps are the descriptions of applied migrations.
+	Steps []string
+}
+
+// upgradeSemaphore applies all pending migrations to a semaphore, in memory.
+// It returns the descriptions of the applied steps, or ErrSchemaTooNew.
+func upgradeSemaphore(sem *Semaphore) ([]string, error) {
+	if sem == nil {
+		return nil, ErrNilSemaphore
+	}
+	if sem.SchemaVersion > CurrentSchemaVersion {
+		return nil, ErrSchemaTooNew
+	}
+
+	steps := []string{}
+	for sem.SchemaVersion < CurrentSchemaVersion {
+		if sem.SchemaVersion < 0 || sem.SchemaVersion >= len(migrations) {
+			return nil, fmt.Errorf("no migration from schema version %d", sem.SchemaVersion)
+		}
+		m := migrations[sem.SchemaVersion]
+		if err := m.apply(sem); err != nil {
+			return nil, fmt.Errorf("migration from schema version %d failed: %s", m.from, err)
+		}
+		sem.SchemaVersion = m.from + 1
+		steps = append(steps, m.description)
+	}
+
+	return steps, nil
+}
+
+// Migrate upgrades all semaphores to the current schema version, writing
+// each one back with a compare-and-swap on the version it was read at.
+// With `dryRun`, it only reports what would change.
+func Migrate(ctx context.Context, backend Backend, dryRun bool) ([]MigrationResult, error) {
+	if backend == nil {
+		return nil, ErrNilBackend
+	}
+
+	sems, _, err := backend.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	groups := make([]string, 0, len(sems))
+	for group := range sems {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+
+	results := []MigrationResult{}
+	for _, group := range groups {
+		if sems[group].SchemaVersion == CurrentSchemaVersion {
+			continue
+		}
+		result, err := migrateGroup(ctx, backend, group, dryRun)
+		if err != nil {
+			return results, fmt.Errorf("failed to migrate group %q: %s", group, err)
+		}
+		if result != nil {
+			results = append(results, *result)
+		}
+	}
+
+	return results, nil
+}
+
+// migrateGroup upgrades the semaphore of a single group, retrying on
+// concurrent updates. It returns nil if the semaphore is already current.
+func migrateGroup(ctx context.Context, backend Backend, group string, dryRun bool) (*MigrationResult, error) {
+	var err error
+	for attempt := 0; attempt <= maxConflictRetries; attempt++ {
+		var sem *Semaphore
+		var version int64
+		sem, version, err = backend.Get(ctx, group)
+		if err != nil {
+			return nil, err
+		}
+
+		result := MigrationResult{Group: group, From: sem.SchemaVersion}
+		if result.Steps, err = upgradeSemaphore(sem); err != nil {
+			return nil, err
+		}
+		if len(result.Steps) == 0 {
+			return nil, nil
+		}
+		result.To = sem.SchemaVersion
+		if dryRun {
+			return &result, nil
+		}
+
+		_, err = backend.CompareAndSwap(ctx, Update{Group: group, Semaphore: sem, Version: version})
+		if err == nil {
+			return &result, nil
+		}
+		if err != ErrConflict {
+			return nil, err
+		}
+	}
+
+	return nil, err
+}
+
+// CheckSchema verifies that no semaphore has been written with a schema
+// newer than `CurrentSchemaVersion`, returning ErrSchemaTooNew otherwise.
+func CheckSchema(ctx context.Context, backend Backend) error {
+	if backend == nil {
+		return ErrNilBackend
+	}
+
+	sems, _, err := backend.List(ctx)
+	if err != nil {
+		return err
+	}
+	for group, sem := range sems {
+		if sem.SchemaVersion > CurrentSchemaVersion {
+			return fmt.Errorf("group %q has schema version %d, newer than %d: %s", group, sem.SchemaVersion, CurrentSchemaVersion, ErrSchemaTooNew)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,73 @@
+package lock
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	b := NewMemoryBackend()
+
+	legacy := &Semaphore{TotalSlots: 2, Holders: []string{"b", "a", "b"}}
+	if _, err := b.CompareAndSwap(ctx, Update{Group: "legacy", Semaphore: legacy, Version: 0}, Update{Group: "current", Semaphore: NewSemaphore(1), Version: 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := Migrate(ctx, b, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Group != "legacy" || results[0].From != 0 || results[0].To != CurrentSchemaVersion {
+		t.Errorf("unexpected dry-run results: %+v", results)
+	}
+	if sem, version, _ := b.Get(ctx, "legacy"); version != 1 || sem.SchemaVersion != 0 {
+		t.Errorf("dry-run modified the semaphore: %+v at version %d", sem, version)
+	}
+
+	if _, err := Migrate(ctx, b, false); err != nil {
+		t.Fatal(err)
+	}
+	sem, version, err := b.Get(ctx, "legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 2 || sem.SchemaVersion != CurrentSchemaVersion || !reflect.DeepEqual(sem.Holders, []string{"a", "b"}) {
+		t.Errorf("unexpected migrated semaphore: %+v at version %d", sem, version)
+	}
+
+	results, err = Migrate(ctx, b, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 0 {
+		t.Errorf("unexpected results on current schema: %+v", results)
+	}
+}
+
+func TestSchemaTooNew(t *testing.T) {
+	ctx := context.Background()
+	b := NewMemoryBackend()
+
+	future := NewSemaphore(1)
+	future.SchemaVersion = CurrentSchemaVersion + 1
+	if _, err := b.CompareAndSwap(ctx, Update{Group: "future", Semaphore: future, Version: 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CheckSchema(ctx, b); err == nil {
+		t.Error("unexpected success with newer schema")
+	}
+	if _, err := Migrate(ctx, b, false); err == nil {
+		t.Error("unexpected migration of newer schema")
+	}
+
+	manager, err := NewManager(ctx, b, "future", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := manager.RecursiveLock(ctx, "a"); err != ErrSchemaTooNew {
+		t.Errorf("unexpected error locking newer schema: %v", err)
+	}
+}
@@ -5,22 +5,63 @@ import (
 	"errors"
 	"fmt"
 	"sort"
+	"time"
 )
 
 var (
 	// ErrNilSemaphore is returned on nil semaphore.
 	ErrNilSemaphore = errors.New("nil Semaphore")
+	// ErrPaused is returned when taking a slot on a paused semaphore.
+	ErrPaused = errors.New("semaphore is paused")
+	// ErrSemaphoreFull is returned when all semaphore slots are taken.
+	ErrSemaphoreFull = errors.New("all semaphore slots currently locked")
 )
 
 // Semaphore is a struct representation of the information held by the semaphore
 type Semaphore struct {
-	TotalSlots uint64   `json:"total_slots"`
-	Holders    []string `json:"holders"`
+	// SchemaVersion is the version of the document format (see `CurrentSchemaVersion`).
+	SchemaVersion int      `json:"schema_version"`
+	TotalSlots    uint64   `json:"total_slots"`
+	Holders       []string `json:"holders"`
+	Paused        bool     `json:"paused,omitempty"`
+	// Tokens are the fencing tokens of current holders, i.e. the revisions
+	// at which they took their slot.
+	Tokens map[string]int64 `json:"tokens,omitempty"`
+	// Versions are the `current_version` last reported by each node.
+	Versions map[string]string `json:"versions,omitempty"`
+	// Reported are the times (in Unix seconds) at which nodes last
+	// reported their version.
+	Reported map[string]int64 `json:"reported,omitempty"`
+	// Acquired are the times (in Unix seconds) at which current holders
+	// took their slot.
+	Acquired map[string]int64 `json:"acquired,omitempty"`
+	// Overdue are the current holders which exceeded the maximum hold
+	// duration, already counted as failures.
+	Overdue []string `json:"overdue,omitempty"`
+	// Failures is the number of failures counted since the semaphore
+	// was last resumed.
+	Failures uint64 `json:"failures,omitempty"`
+	// PauseReason explains why the semaphore got paused, if known.
+	PauseReason string `json:"pause_reason,omitempty"`
+	// VersionFailures are the numbers of failures reported by nodes,
+	// per attempted version, for the versions with most failures. They
+	// are not reset on resume.
+	VersionFailures map[string]uint64 `json:"version_failures,omitempty"`
+	// NodeFailures are the last failures reported by nodes, for the nodes
+	// with the most recent ones. They are not reset on resume.
+	NodeFailures map[string]NodeFailure `json:"node_failures,omitempty"`
+	// Labels are the node labels of current holders, e.g. their zone
+	// and rack, for spread constraints.
+	Labels map[string]map[string]string `json:"labels,omitempty"`
 }
 
 // NewSemaphore returns a new empty semaphore.
 func NewSemaphore(slots uint64) (sem *Semaphore) {
-	return &Semaphore{slots, []string{}}
+	return &Semaphore{
+		SchemaVersion: CurrentSchemaVersion,
+		TotalSlots:    slots,
+		Holders:       []string{},
+	}
 }
 
 // SetTotalSlots sets the number of holders slots for the semaphore
@@ -57,8 +98,11 @@ func (s *Semaphore) addHolder(h string) error {
 	if s == nil {
 		return ErrNilSemaphore
 	}
+	if s.Paused {
+		return ErrPaused
+	}
 	if len(s.Holders) >= int(s.TotalSlots) {
-		return fmt.Errorf("all %d semaphore slots currently locked", s.TotalSlots)
+		return ErrSemaphoreFull
 	}
 
 	loc := sort.SearchStrings(s.Holders, h)
@@ -82,6 +126,10 @@ func (s *Semaphore) removeHolderIfPresent(h string) (bool, error) {
 	loc := sort.SearchStrings(s.Holders, h)
 	if loc < len(s.Holders) && s.Holders[loc] == h {
 		s.Holders = append(s.Holders[:loc], s.Holders[loc+1:]...)
+		delete(s.Tokens, h)
+		delete(s.Acquired, h)
+		delete(s.Labels, h)
+		s.Overdue = removeString(s.Overdue, h)
 		return true, nil
 	}
 
@@ -122,3 +170,140 @@ func (s *Semaphore) UnlockIfHeld(h string) error {
 
 	return nil
 }
+
+// Token returns the fencing token of a holder, or 0 if it has none.
+func (s *Semaphore) Token(h string) int64 {
+	if s == nil || !containsHolder(s.Holders, h) {
+		return 0
+	}
+
+	return s.Tokens[h]
+}
+
+// setToken records the fencing token of a current holder.
+func (s *Semaphore) setToken(h string, token int64) {
+	if s.Tokens == nil {
+		s.Tokens = map[string]int64{}
+	}
+	s.Tokens[h] = token
+}
+
+// setVersion records the version reported by a node at a given time.
+func (s *Semaphore) setVersion(node string, version string, at time.Time) {
+	if s.Versions == nil {
+		s.Versions = map[string]string{}
+	}
+	if s.Reported == nil {
+		s.Reported = map[string]int64{}
+	}
+	s.Versions[node] = version
+	s.Reported[node] = at.Unix()
+}
+
+// CurrentVersions returns the versions reported by nodes since a given
+// time, by node. A zero time returns all of them.
+func (s *Semaphore) CurrentVersions(since time.Time) map[string]string {
+	versions := map[string]string{}
+	if s == nil {
+		return versions
+	}
+
+	for node, version := range s.Versions {
+		if since.IsZero() || s.Reported[node] >= since.Unix() {
+			versions[node] = version
+		}
+	}
+
+	return versions
+}
+
+// expireVersions forgets the versions of nodes which did not report
+// since a given time. It returns whether any was forgotten.
+func (s *Semaphore) expireVersions(since time.Time) bool {
+	expired := false
+	for node := range s.Versions {
+		if s.Reported[node] < since.Unix() {
+			delete(s.Versions, node)
+			delete(s.Reported, node)
+			expired = true
+		}
+	}
+
+	return expired
+}
+
+// forgetNode releases the slot of a node, if any, and forgets its
+// version and last failure. It returns whether anything was recorded
+// for the node.
+func (s *Semaphore) forgetNode(node string) (bool, error) {
+	held, err := s.removeHolderIfPresent(node)
+	if err != nil {
+		return false, err
+	}
+	_, reported := s.Versions[node]
+	_, failed := s.NodeFailures[node]
+	delete(s.Versions, node)
+	delete(s.Reported, node)
+	delete(s.NodeFailures, node)
+
+	return held || reported || failed, nil
+}
+
+// setAcquired records the time at which a current holder took its slot.
+func (s *Semaphore) setAcquired(h string, at time.Time) {
+	if s.Acquired == nil {
+		s.Acquired = map[string]int64{}
+	}
+	s.Acquired[h] = at.Unix()
+}
+
+// OverdueHolders returns the current holders which took their slot more
+// than `maxHold` before `now`, sorted. Holders without an acquisition
+// time (i.e. from before it was tracked) are never overdue.
+func (s *Semaphore) OverdueHolders(maxHold time.Duration, now time.Time) []string {
+	overdue := []string{}
+	if s == nil || maxHold <= 0 {
+		return overdue
+	}
+
+	for _, h := range s.Holders {
+		if at, ok := s.Acquired[h]; ok && now.Sub(time.Unix(at, 0)) > maxHold {
+			overdue = append(overdue, h)
+		}
+	}
+
+	return overdue
+}
+
+// recordFailure counts a failure, pausing the semaphore once `budget`
+// failures are reached (zero never pauses). It returns whether this
+// failure paused the semaphore.
+func (s *Semaphore) recordFailure(budget uint64, cause string) bool {
+	s.Failures++
+	if budget == 0 || s.Failures < budget || s.Paused {
+		return false
+	}
+
+	s.Paused = true
+	s.PauseReason = fmt.Sprintf("failure budget of %d exhausted, last failure: %s", budget, cause)
+	return true
+}
+
+// insertString adds a string to a sorted list, keeping it sorted, if
+// not present yet.
+func insertString(list []string, str string) []string {
+	loc := sort.SearchStrings(list, str)
+	if loc < len(list) && list[loc] == str {
+		return list
+	}
+	return append(list[:loc], append([]string{str}, list[loc:]...)...)
+}
+
+// removeString removes a string from a sorted list, if present.
+func removeString(list []string, str string) []string {
+	loc := sort.SearchStrings(list, str)
+	if loc < len(list) && list[loc] == str {
+		return append(list[:loc], list[loc+1:]...)
+	}
+	return list
+}
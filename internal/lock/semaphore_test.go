@@ -1,8 +1,10 @@
 package lock
 
 import (
+	"fmt"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestSingleLock(t *testing.T) {
@@ -99,3 +101,63 @@ func TestSetTotalSlots(t *testing.T) {
 
 	}
 }
+
+func TestPausedLock(t *testing.T) {
+	sem := NewSemaphore(2)
+	if _, err := sem.RecursiveLock("a"); err != nil {
+		t.Error(err)
+	}
+
+	sem.Paused = true
+	if _, err := sem.RecursiveLock("b"); err != ErrPaused {
+		t.Errorf("unexpected error on paused semaphore: %v", err)
+	}
+	held, err := sem.RecursiveLock("a")
+	if err != nil {
+		t.Error(err)
+	}
+	if !held {
+		t.Error("unexpected not holding lock")
+	}
+	if err := sem.UnlockIfHeld("a"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRecordVersionFailure(t *testing.T) {
+	sem := NewSemaphore(1)
+	for i := 0; i < maxVersionFailures; i++ {
+		sem.recordVersionFailure(fmt.Sprintf("v%d", i))
+		sem.recordVersionFailure(fmt.Sprintf("v%d", i))
+	}
+	sem.recordVersionFailure("v0")
+	sem.recordVersionFailure("new")
+	if len(sem.VersionFailures) != maxVersionFailures {
+		t.Fatalf("unexpected number of tracked versions: %d", len(sem.VersionFailures))
+	}
+	if sem.VersionFailures["v0"] != 3 || sem.VersionFailures["new"] != 1 {
+		t.Errorf("unexpected failures: %v", sem.VersionFailures)
+	}
+	if _, ok := sem.VersionFailures["v1"]; ok {
+		t.Errorf("version with fewest failures not evicted: %v", sem.VersionFailures)
+	}
+}
+
+func TestRecordNodeFailure(t *testing.T) {
+	sem := NewSemaphore(1)
+	start := time.Unix(1000, 0)
+	for i := 0; i < maxNodeFailures; i++ {
+		sem.recordNodeFailure(fmt.Sprintf("n%d", i), "1", start.Add(time.Duration(i)*time.Second))
+	}
+	sem.recordNodeFailure("n0", "2", start.Add(time.Hour))
+	sem.recordNodeFailure("new", "2", start.Add(time.Hour))
+	if len(sem.NodeFailures) != maxNodeFailures {
+		t.Fatalf("unexpected number of tracked nodes: %d", len(sem.NodeFailures))
+	}
+	if f := sem.NodeFailures["n0"]; f.Version != "2" || f.Time != start.Add(time.Hour).Unix() {
+		t.Errorf("unexpected last failure of n0: %+v", f)
+	}
+	if _, ok := sem.NodeFailures["n1"]; ok {
+		t.Errorf("node with oldest failure not evicted: %v", sem.NodeFailures)
+	}
+}
@@ -0,0 +1,96 @@
+package lock
+
+import (
+	"fmt"
+)
+
+// Spread limits the number of holders sharing the same value of a node
+// label, e.g. at most one holder per rack.
+type Spread struct {
+	Label      string `json:"label"`
+	MaxHolders int    `json:"max_holders"`
+}
+
+// SpreadError is returned when taking a slot would violate a spread
+// constraint of a group.
+type SpreadError struct {
+	Group  string
+	Spread Spread
+	// Value is the label value of the node, empty if it lacks the label.
+	Value string
+}
+
+func (e *SpreadError) Error() string {
+	if e.Value == "" {
+		return fmt.Sprintf("node lacks label %q, required by the spread constraint of group %q", e.Spread.Label, e.Group)
+	}
+	return fmt.Sprintf("group %q already has %d holders with %s=%s", e.Group, e.Spread.MaxHolders, e.Spread.Label, e.Value)
+}
+
+// WithLabels returns a copy of the manager which records `labels` along
+// with new slots, and checks them against spread constraints.
+func (m *Manager) WithLabels(labels map[string]string) *Manager {
+	if m == nil {
+		return nil
+	}
+
+	labeled := *m
+	labeled.labels = labels
+	return &labeled
+}
+
+// WithSpread returns a copy of the manager which enforces spread
+// constraints on a group, in the same transaction taking the slot.
+func (m *Manager) WithSpread(group string, spreads ...Spread) *Manager {
+	if m == nil {
+		return nil
+	}
+
+	spread := *m
+	spread.spreads = map[string][]Spread{}
+	for g, s := range m.spreads {
+		spread.spreads[g] = s
+	}
+	group = groupName(group)
+	spread.spreads[group] = append(append([]Spread{}, m.spreads[group]...), spreads...)
+	return &spread
+}
+
+// checkSpread returns a SpreadError if a node with the given labels
+// cannot take a slot in a group. Holders without the constrained label,
+// e.g. from before labels were tracked, count against every value.
+func checkSpread(group string, sem *Semaphore, id string, labels map[string]string, spreads []Spread) error {
+	for _, spread := range spreads {
+		value := labels[spread.Label]
+		if value == "" {
+			return &SpreadError{group, spread, ""}
+		}
+
+		count := 0
+		for _, h := range sem.Holders {
+			if h == id {
+				continue
+			}
+			if v := sem.Labels[h][spread.Label]; v == "" || v == value {
+				count++
+			}
+		}
+		if count >= spread.MaxHolders {
+			return &SpreadError{group, spread, value}
+		}
+	}
+
+	return nil
+}
+
+// setLabels records the labels of a current holder.
+func (s *Semaphore) setLabels(h string, labels map[string]string) {
+	if len(labels) == 0 {
+		delete(s.Labels, h)
+		return
+	}
+	if s.Labels == nil {
+		s.Labels = map[string]map[string]string{}
+	}
+	s.Labels[h] = labels
+}
@@ -0,0 +1,47 @@
+package lock
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+)
+
+// ListSemaphores returns the semaphores of all groups, together with
+// the revision they have been read at.
+func ListSemaphores(ctx context.Context, backend Backend) (map[string]*Semaphore, int64, error) {
+	if backend == nil {
+		return nil, 0, ErrNilBackend
+	}
+
+	return backend.List(ctx)
+}
+
+// WatchSemaphores streams the latest semaphore value of every changed group
+// to `fn`, starting from the given revision, until the context is canceled
+// or an error occurs. A nil semaphore means that the group has been removed.
+func WatchSemaphores(ctx context.Context, backend Backend, fromRevision int64, fn func(string, *Semaphore) error) error {
+	if backend == nil {
+		return ErrNilBackend
+	}
+	if fn == nil {
+		return errors.New("nil semaphores callback")
+	}
+
+	return backend.Watch(ctx, "", fromRevision, func(change Change) error {
+		return fn(change.Group, change.Cur)
+	})
+}
+
+// decodeSemaphore parses a stored semaphore value.
+func decodeSemaphore(data []byte) (*Semaphore, error) {
+	if len(data) == 0 {
+		return nil, errors.New("empty semaphore value")
+	}
+
+	sem := &Semaphore{}
+	if err := json.Unmarshal(data, sem); err != nil {
+		return nil, err
+	}
+
+	return sem, nil
+}
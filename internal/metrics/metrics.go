@@ -0,0 +1,305 @@
+// Package metrics implements the counters, gauges and histograms exposed on
+// `/metrics`, in the Prometheus text exposition format.
+//
+// The official client library would work with the vendored dependencies
+// (its v0.9 releases build against the pinned golang/protobuf), but it would
+// add client_golang, client_model, common, procfs, perks and
+// golang_protobuf_extensions to the vendor tree, for a handful of metrics.
+// This package only covers the subset the server needs: labeled counters,
+// gauges and fixed-bucket histograms, written in the text format version
+// 0.0.4 and named after the client library conventions, so that switching
+// to it later does not change the exposed series.
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// contentType is the Prometheus text exposition format.
+	contentType = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+var (
+	// defaultRegistry holds all metrics created by this package.
+	defaultRegistry = &registry{}
+
+	// DefaultBuckets are histogram buckets suitable for request latencies, in seconds.
+	DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+)
+
+// collector is a metric family which can be exposed.
+type collector interface {
+	write(w io.Writer)
+}
+
+// registry is a set of metric families.
+type registry struct {
+	mu         sync.Mutex
+	collectors []collector
+}
+
+func (r *registry) register(c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+// WriteText writes all registered metrics in the Prometheus text format.
+func WriteText(w io.Writer) error {
+	defaultRegistry.mu.Lock()
+	collectors := append([]collector{}, defaultRegistry.collectors...)
+	defaultRegistry.mu.Unlock()
+
+	var buf bytes.Buffer
+	for _, c := range collectors {
+		c.write(&buf)
+	}
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// Handler returns an HTTP handler exposing all registered metrics.
+func Handler() http.Handler {
+	handler := func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		WriteText(w)
+	}
+	return http.HandlerFunc(handler)
+}
+
+// family holds the common parts of a labeled metric family.
+type family struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+}
+
+func (f *family) key(labelValues []string) string {
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf("metric %s: expected %d label values, got %d", f.name, len(f.labels), len(labelValues)))
+	}
+	return strings.Join(labelValues, "\xff")
+}
+
+func (f *family) writeHeader(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, escape(f.help, false))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+}
+
+// labelPairs formats label names and values, plus an optional extra pair.
+func (f *family) labelPairs(labelValues []string, extraName, extraValue string) string {
+	pairs := []string{}
+	for i, l := range f.labels {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, l, escape(labelValues[i], true)))
+	}
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extraName, escape(extraValue, true)))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// scalarVec is a labeled family of single-valued series.
+type scalarVec struct {
+	family
+	mu     sync.Mutex
+	values map[string]float64
+	series map[string][]string
+}
+
+func newScalarVec(kind, name, help string, labels []string) *scalarVec {
+	v := &scalarVec{
+		family: family{name, help, kind, labels},
+		values: map[string]float64{},
+		series: map[string][]string{},
+	}
+	defaultRegistry.register(v)
+	return v
+}
+
+func (v *scalarVec) update(labelValues []string, fn func(float64) float64) {
+	key := v.key(labelValues)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.values[key] = fn(v.values[key])
+	v.series[key] = append([]string{}, labelValues...)
+}
+
+func (v *scalarVec) write(w io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.writeHeader(w)
+	for _, key := range sortedKeys(v.series) {
+		fmt.Fprintf(w, "%s%s %s\n", v.name, v.labelPairs(v.series[key], "", ""), formatFloat(v.values[key]))
+	}
+}
+
+// CounterVec is a family of monotonically increasing counters.
+type CounterVec struct {
+	vec *scalarVec
+}
+
+// NewCounterVec registers a new counter family.
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{newScalarVec("counter", name, help, labels)}
+}
+
+// Inc increments by one the counter for the given label values.
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add increases by a non-negative delta the counter for the given label values.
+func (c *CounterVec) Add(delta float64, labelValues ...string) {
+	if delta < 0 {
+		panic(fmt.Sprintf("metric %s: counters cannot decrease", c.vec.name))
+	}
+	c.vec.update(labelValues, func(v float64) float64 { return v + delta })
+}
+
+// GaugeVec is a family of values which can go up and down.
+type GaugeVec struct {
+	vec *scalarVec
+}
+
+// NewGaugeVec registers a new gauge family.
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{newScalarVec("gauge", name, help, labels)}
+}
+
+// Set sets the gauge for the given label values.
+func (g *GaugeVec) Set(value float64, labelValues ...string) {
+	g.vec.update(labelValues, func(float64) float64 { return value })
+}
+
+// Add adds a (possibly negative) delta to the gauge for the given label values.
+func (g *GaugeVec) Add(delta float64, labelValues ...string) {
+	g.vec.update(labelValues, func(v float64) float64 { return v + delta })
+}
+
+// Delete removes the series for the given label values.
+func (g *GaugeVec) Delete(labelValues ...string) {
+	key := g.vec.key(labelValues)
+	g.vec.mu.Lock()
+	defer g.vec.mu.Unlock()
+	delete(g.vec.values, key)
+	delete(g.vec.series, key)
+}
+
+// Reset removes all series.
+func (g *GaugeVec) Reset() {
+	g.vec.mu.Lock()
+	defer g.vec.mu.Unlock()
+	g.vec.values = map[string]float64{}
+	g.vec.series = map[string][]string{}
+}
+
+// HistogramVec is a family of histograms with fixed buckets.
+type HistogramVec struct {
+	family
+	buckets []float64
+
+	mu     sync.Mutex
+	counts map[string][]uint64
+	sums   map[string]float64
+	series map[string][]string
+}
+
+// NewHistogramVec registers a new histogram family, with the given
+// upper bounds for buckets (in increasing order).
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{
+		family:  family{name, help, "histogram", labels},
+		buckets: append([]float64{}, buckets...),
+		counts:  map[string][]uint64{},
+		sums:    map[string]float64{},
+		series:  map[string][]string{},
+	}
+	sort.Float64s(h.buckets)
+	defaultRegistry.register(h)
+	return h
+}
+
+// Observe records a value in the histogram for the given label values.
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	key := h.key(labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	counts, ok := h.counts[key]
+	if !ok {
+		// One extra bucket for `+Inf`.
+		counts = make([]uint64, len(h.buckets)+1)
+		h.counts[key] = counts
+		h.series[key] = append([]string{}, labelValues...)
+	}
+	for i, upper := range h.buckets {
+		if value <= upper {
+			counts[i]++
+		}
+	}
+	counts[len(h.buckets)]++
+	h.sums[key] += value
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.writeHeader(w)
+	for _, key := range sortedKeys(h.series) {
+		labelValues := h.series[key]
+		counts := h.counts[key]
+		for i, upper := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelPairs(labelValues, "le", formatFloat(upper)), counts[i])
+		}
+		total := counts[len(h.buckets)]
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelPairs(labelValues, "le", "+Inf"), total)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labelPairs(labelValues, "", ""), formatFloat(h.sums[key]))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labelPairs(labelValues, "", ""), total)
+	}
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// escape escapes help texts and (if `quotes` is set) label values.
+func escape(s string, quotes bool) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, "\n", `\n`, -1)
+	if quotes {
+		s = strings.Replace(s, `"`, `\"`, -1)
+	}
+	return s
+}
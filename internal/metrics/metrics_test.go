@@ -0,0 +1,55 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestExposition(t *testing.T) {
+	// Metrics register globally, thus isolate this test in a fresh registry.
+	saved := defaultRegistry
+	defaultRegistry = &registry{}
+	defer func() { defaultRegistry = saved }()
+
+	counter := NewCounterVec("test_requests_total", "Total requests.", "endpoint")
+	counter.Inc("/b")
+	counter.Add(2, "/a")
+	counter.Inc("/b")
+
+	gauge := NewGaugeVec("test_slots", "Slots per group.", "group")
+	gauge.Set(3, `we"ird`)
+	gauge.Set(1, "gone")
+	gauge.Delete("gone")
+
+	histogram := NewHistogramVec("test_duration_seconds", "Durations.", []float64{0.5, 0.1}, "endpoint")
+	histogram.Observe(0.05, "/a")
+	histogram.Observe(0.3, "/a")
+	histogram.Observe(7, "/a")
+
+	var buf bytes.Buffer
+	if err := WriteText(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := strings.Join([]string{
+		"# HELP test_requests_total Total requests.",
+		"# TYPE test_requests_total counter",
+		`test_requests_total{endpoint="/a"} 2`,
+		`test_requests_total{endpoint="/b"} 2`,
+		"# HELP test_slots Slots per group.",
+		"# TYPE test_slots gauge",
+		`test_slots{group="we\"ird"} 3`,
+		"# HELP test_duration_seconds Durations.",
+		"# TYPE test_duration_seconds histogram",
+		`test_duration_seconds_bucket{endpoint="/a",le="0.1"} 1`,
+		`test_duration_seconds_bucket{endpoint="/a",le="0.5"} 2`,
+		`test_duration_seconds_bucket{endpoint="/a",le="+Inf"} 3`,
+		`test_duration_seconds_sum{endpoint="/a"} 7.35`,
+		`test_duration_seconds_count{endpoint="/a"} 3`,
+		"",
+	}, "\n")
+	if buf.String() != expected {
+		t.Errorf("unexpected exposition:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+}
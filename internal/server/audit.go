@@ -0,0 +1,144 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/lucab/exp-locksmith2/internal/audit"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// AuditEndpoint is the endpoint for querying the audit trail.
+	AuditEndpoint = "/v1/audit"
+
+	// DefaultAuditLimit is the number of entries returned by a query
+	// without limit.
+	DefaultAuditLimit = 100
+	// MaxAuditLimit caps the number of entries returned by a query.
+	MaxAuditLimit = 1000
+)
+
+// Audit is the handler for the `/v1/audit` endpoint.
+//
+// Entries can be filtered with `group`, `node`, `since` and `until`
+// (RFC3339 timestamps) query parameters, and capped with `limit`
+// (default `DefaultAuditLimit`, at most `MaxAuditLimit`). Older entries
+// are paged through with `until`.
+func (sc *ServerConfig) Audit() http.Handler {
+	handler := func(w http.ResponseWriter, req *http.Request) {
+		logrus.Debug("got audit query")
+		if sc == nil {
+			http.Error(w, errNilServerConfig.Error(), 500)
+			return
+		}
+		if req.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if sc.AuditLog == nil {
+			http.Error(w, "audit log disabled", http.StatusNotFound)
+			return
+		}
+
+		filter, err := parseAuditFilter(req)
+		if err != nil {
+			logrus.Errorln("failed to parse audit query: ", err)
+			http.Error(w, err.Error(), 400)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(req.Context(), sc.LockTimeout)
+		defer cancel()
+		entries, err := sc.AuditLog.Query(ctx, filter)
+		if err != nil {
+			logrus.Errorln("failed to query audit log: ", err)
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(entries); err != nil {
+			logrus.Errorln("failed to write audit entries: ", err)
+		}
+	}
+
+	return http.HandlerFunc(handler)
+}
+
+// recordAudit appends an entry to the audit trail, if enabled.
+func (sc *ServerConfig) recordAudit(entry *audit.Entry) {
+	if sc == nil || sc.AuditLog == nil || entry == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), sc.LockTimeout)
+	defer cancel()
+	if err := sc.AuditLog.Append(ctx, *entry); err != nil {
+		logrus.Errorln("failed to record audit entry: ", err)
+	}
+}
+
+// recordAutoPause appends an entry for a group paused by the server, on
+// behalf of `node` if a node report caused it.
+func (sc *ServerConfig) recordAutoPause(group string, node string, reason string) {
+	sc.recordAudit(&audit.Entry{
+		Action:  audit.ActionAutoPause,
+		Group:   group,
+		Node:    node,
+		Outcome: audit.OutcomeDone,
+		Message: reason,
+	})
+}
+
+// setAuditOutcome records the outcome of a request in its audit entry.
+func setAuditOutcome(entry *audit.Entry, outcome string, errKind string, err error) {
+	entry.Outcome = outcome
+	entry.ErrorKind = errKind
+	if err != nil {
+		entry.Message = err.Error()
+	}
+}
+
+// parseAuditFilter builds an audit filter from query parameters.
+func parseAuditFilter(req *http.Request) (audit.Filter, error) {
+	query := req.URL.Query()
+	filter := audit.Filter{
+		Group: query.Get("group"),
+		Node:  query.Get("node"),
+		Limit: DefaultAuditLimit,
+	}
+
+	if since := query.Get("since"); since != "" {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			return filter, fmt.Errorf("invalid since %q: %s", since, err)
+		}
+		filter.Since = t
+	}
+	if until := query.Get("until"); until != "" {
+		t, err := time.Parse(time.RFC3339, until)
+		if err != nil {
+			return filter, fmt.Errorf("invalid until %q: %s", until, err)
+		}
+		filter.Until = t
+	}
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 0 {
+			return filter, fmt.Errorf("invalid limit %q", limit)
+		}
+		if n > 0 {
+			filter.Limit = n
+		}
+	}
+	if filter.Limit > MaxAuditLimit {
+		filter.Limit = MaxAuditLimit
+	}
+
+	return filter, nil
+}
@@ -0,0 +1,264 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// TimestampHeader carries the signing time of a request, in Unix seconds.
+	TimestampHeader = "X-Locksmith2-Timestamp"
+	// NonceHeader carries a unique per-request value.
+	NonceHeader = "X-Locksmith2-Nonce"
+	// SignatureHeader carries the hex-encoded HMAC-SHA256 signature of a request.
+	SignatureHeader = "X-Locksmith2-Signature"
+
+	// defaultMaxClockSkew is the default tolerance on request timestamps.
+	defaultMaxClockSkew = 5 * time.Minute
+	// maxNonces bounds the number of nonces remembered for replay protection.
+	maxNonces = 100000
+)
+
+// AuthConfig holds settings for authenticating lock requests.
+type AuthConfig struct {
+	// GroupTokens are the bearer tokens accepted for each group.
+	GroupTokens map[string][]string
+	// GroupSecrets are the HMAC shared secrets for each group.
+	GroupSecrets map[string][]byte
+	// NodeSecrets are the HMAC shared secrets for each node UUID,
+	// taking precedence over group secrets.
+	NodeSecrets map[string][]byte
+	// AdminTokens and AdminSecrets are the bearer tokens and HMAC shared
+	// secrets accepted for endpoints which are not lock requests.
+	AdminTokens  []string
+	AdminSecrets [][]byte
+	// MaxClockSkew is the tolerance on signed request timestamps (default 5m).
+	MaxClockSkew time.Duration
+	// Required rejects unauthenticated requests for groups without credentials.
+	Required bool
+}
+
+// Authenticator checks bearer tokens and HMAC signatures of lock requests.
+type Authenticator struct {
+	cfg AuthConfig
+
+	mu     sync.Mutex
+	nonces map[string]time.Time
+}
+
+// NewAuthenticator returns an authenticator for the given settings.
+func NewAuthenticator(cfg AuthConfig) *Authenticator {
+	if cfg.MaxClockSkew <= 0 {
+		cfg.MaxClockSkew = defaultMaxClockSkew
+	}
+
+	return &Authenticator{
+		cfg:    cfg,
+		nonces: map[string]time.Time{},
+	}
+}
+
+// SignRequest adds timestamp, nonce and signature headers to a request,
+// signing its path, query and body with a shared secret.
+func SignRequest(req *http.Request, body []byte, secret []byte, nonce string) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(NonceHeader, nonce)
+	req.Header.Set(SignatureHeader, signature(secret, req.Method, req.URL.RequestURI(), timestamp, nonce, body))
+}
+
+// authenticate checks the credentials of a request for the given identity.
+func (a *Authenticator) authenticate(req *http.Request, body []byte, identity *NodeIdentity) error {
+	if a == nil {
+		return nil
+	}
+
+	err := a.check(req, body, identity)
+	if err != nil {
+		return &requestError{errKindUnauthorized, http.StatusUnauthorized, err}
+	}
+
+	return nil
+}
+
+// check verifies that the credentials of a request are accepted by all
+// requested groups. Nonces of signed requests are used up only once.
+func (a *Authenticator) check(req *http.Request, body []byte, identity *NodeIdentity) error {
+	for _, group := range identity.groups() {
+		if err := a.checkGroup(req, body, identity.UUID, group); err != nil {
+			return err
+		}
+	}
+
+	if req.Header.Get(SignatureHeader) != "" {
+		return a.useNonce(req.Header.Get(NonceHeader), time.Now())
+	}
+	return nil
+}
+
+// checkGroup verifies the credentials of a request for a single group.
+func (a *Authenticator) checkGroup(req *http.Request, body []byte, node, group string) error {
+	tokens := a.cfg.GroupTokens[group]
+	secret, hasSecret := a.cfg.NodeSecrets[node]
+	if !hasSecret {
+		secret, hasSecret = a.cfg.GroupSecrets[group]
+	}
+
+	if req.Header.Get(SignatureHeader) != "" {
+		if !hasSecret {
+			return fmt.Errorf("no HMAC secret configured for node %q in group %q", node, group)
+		}
+		return a.checkSignature(req, body, secret)
+	}
+
+	if auth := req.Header.Get("Authorization"); auth != "" {
+		if !strings.HasPrefix(auth, "Bearer ") {
+			return errors.New("unsupported authorization scheme")
+		}
+		token := strings.TrimPrefix(auth, "Bearer ")
+		for _, t := range tokens {
+			if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+				return nil
+			}
+		}
+		return fmt.Errorf("invalid bearer token for group %q", group)
+	}
+
+	if a.cfg.Required || len(tokens) > 0 || hasSecret {
+		return fmt.Errorf("missing credentials for node %q in group %q", node, group)
+	}
+
+	return nil
+}
+
+// RequireAuth wraps the handler of an endpoint which is not a lock request,
+// e.g. status, event and audit queries, rejecting requests without valid
+// credentials. As such requests are not made on behalf of a node in a group,
+// only admin bearer tokens and HMAC secrets are accepted; signatures cover an
+// empty body. Requests pass without credentials only if none are configured
+// and they are not required. A nil authenticator lets all requests pass.
+func RequireAuth(a *Authenticator, h http.Handler) http.Handler {
+	if a == nil {
+		return h
+	}
+
+	handler := func(w http.ResponseWriter, req *http.Request) {
+		if err := a.checkAdmin(req); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, req)
+	}
+
+	return http.HandlerFunc(handler)
+}
+
+// checkAdmin verifies that the credentials of a request are admin ones.
+// Node and group credentials are not accepted.
+func (a *Authenticator) checkAdmin(req *http.Request) error {
+	if req.Header.Get(SignatureHeader) != "" {
+		err := errors.New("no admin HMAC secret configured")
+		for _, secret := range a.cfg.AdminSecrets {
+			if err = a.checkSignature(req, nil, secret); err == nil {
+				return a.useNonce(req.Header.Get(NonceHeader), time.Now())
+			}
+		}
+		return err
+	}
+
+	if auth := req.Header.Get("Authorization"); auth != "" {
+		if !strings.HasPrefix(auth, "Bearer ") {
+			return errors.New("unsupported authorization scheme")
+		}
+		token := strings.TrimPrefix(auth, "Bearer ")
+		for _, t := range a.cfg.AdminTokens {
+			if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+				return nil
+			}
+		}
+		return errors.New("invalid admin bearer token")
+	}
+
+	if a.cfg.Required || a.configured() {
+		return errors.New("missing admin credentials")
+	}
+
+	return nil
+}
+
+// configured returns whether any credentials are configured.
+func (a *Authenticator) configured() bool {
+	return len(a.cfg.GroupTokens) > 0 || len(a.cfg.GroupSecrets) > 0 || len(a.cfg.NodeSecrets) > 0 ||
+		len(a.cfg.AdminTokens) > 0 || len(a.cfg.AdminSecrets) > 0
+}
+
+// checkSignature verifies the HMAC signature of a request, rejecting
+// stale timestamps. Replayed nonces are checked by the caller.
+func (a *Authenticator) checkSignature(req *http.Request, body []byte, secret []byte) error {
+	timestamp := req.Header.Get(TimestampHeader)
+	nonce := req.Header.Get(NonceHeader)
+	if timestamp == "" || nonce == "" {
+		return errors.New("missing signature timestamp or nonce")
+	}
+
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("invalid signature timestamp")
+	}
+	now := time.Now()
+	signedAt := time.Unix(unix, 0)
+	if signedAt.Before(now.Add(-a.cfg.MaxClockSkew)) || signedAt.After(now.Add(a.cfg.MaxClockSkew)) {
+		return errors.New("signature timestamp outside of allowed clock skew")
+	}
+
+	expected := signature(secret, req.Method, req.URL.RequestURI(), timestamp, nonce, body)
+	if !hmac.Equal([]byte(expected), []byte(req.Header.Get(SignatureHeader))) {
+		return errors.New("invalid request signature")
+	}
+
+	return nil
+}
+
+// useNonce records a nonce, failing if it has already been seen.
+// Nonces are forgotten once their timestamps would be rejected anyway.
+func (a *Authenticator) useNonce(nonce string, now time.Time) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if expiry, ok := a.nonces[nonce]; ok && now.Before(expiry) {
+		return errors.New("replayed request nonce")
+	}
+
+	if len(a.nonces) >= maxNonces {
+		for n, expiry := range a.nonces {
+			if !now.Before(expiry) {
+				delete(a.nonces, n)
+			}
+		}
+		// Evicting live nonces would allow replays, thus fail closed.
+		if len(a.nonces) >= maxNonces {
+			return errors.New("too many in-flight nonces")
+		}
+	}
+	a.nonces[nonce] = now.Add(2 * a.cfg.MaxClockSkew)
+
+	return nil
+}
+
+// signature computes the hex-encoded HMAC-SHA256 of a request, given its
+// request URI, i.e. its path and query.
+func signature(secret []byte, method, uri, timestamp, nonce string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%s", method, uri, timestamp, nonce, hex.EncodeToString(bodyHash[:]))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestAuthenticate(t *testing.T) {
+	auth := NewAuthenticator(AuthConfig{
+		GroupTokens:  map[string][]string{"tokens": {"s3cr3t"}},
+		GroupSecrets: map[string][]byte{"signed": []byte("group-key")},
+		NodeSecrets:  map[string][]byte{"special": []byte("node-key")},
+	})
+	body := []byte(`{"client_params":{"node_uuid":"a"}}`)
+	newReq := func() *http.Request {
+		return httptest.NewRequest("POST", PreRebootEndpoint, bytes.NewReader(body))
+	}
+
+	// Groups without credentials are open.
+	if err := auth.authenticate(newReq(), body, &NodeIdentity{"a", "open", nil}); err != nil {
+		t.Errorf("unexpected error for open group: %s", err)
+	}
+
+	req := newReq()
+	if err := auth.authenticate(req, body, &NodeIdentity{"a", "tokens", nil}); err == nil {
+		t.Error("unexpected success without token")
+	} else if kind, code := errorStatus(err, "", 0); kind != errKindUnauthorized || code != 401 {
+		t.Errorf("unexpected error status: %s %d", kind, code)
+	}
+	req.Header.Set("Authorization", "Bearer s3cr3t")
+	if err := auth.authenticate(req, body, &NodeIdentity{"a", "tokens", nil}); err != nil {
+		t.Errorf("unexpected error with valid token: %s", err)
+	}
+	req.Header.Set("Authorization", "Bearer wrong")
+	if err := auth.authenticate(req, body, &NodeIdentity{"a", "tokens", nil}); err == nil {
+		t.Error("unexpected success with invalid token")
+	}
+
+	req = newReq()
+	SignRequest(req, body, []byte("group-key"), "nonce-1")
+	if err := auth.authenticate(req, body, &NodeIdentity{"a", "signed", nil}); err != nil {
+		t.Errorf("unexpected error with valid signature: %s", err)
+	}
+	if err := auth.authenticate(req, body, &NodeIdentity{"a", "signed", nil}); err == nil {
+		t.Error("unexpected success with replayed nonce")
+	}
+
+	req = newReq()
+	SignRequest(req, body, []byte("group-key"), "nonce-2")
+	if err := auth.authenticate(req, []byte("tampered"), &NodeIdentity{"a", "signed", nil}); err == nil {
+		t.Error("unexpected success with tampered body")
+	}
+
+	// Node secrets take precedence over group ones.
+	req = newReq()
+	SignRequest(req, body, []byte("group-key"), "nonce-3")
+	if err := auth.authenticate(req, body, &NodeIdentity{"special", "signed", nil}); err == nil {
+		t.Error("unexpected success with group secret for node with its own secret")
+	}
+	req = newReq()
+	SignRequest(req, body, []byte("node-key"), "nonce-4")
+	if err := auth.authenticate(req, body, &NodeIdentity{"special", "signed", nil}); err != nil {
+		t.Errorf("unexpected error with node secret: %s", err)
+	}
+
+	req = newReq()
+	SignRequest(req, body, []byte("group-key"), "nonce-5")
+	stale := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	req.Header.Set(TimestampHeader, stale)
+	req.Header.Set(SignatureHeader, signature([]byte("group-key"), req.Method, req.URL.Path, stale, "nonce-5", body))
+	if err := auth.authenticate(req, body, &NodeIdentity{"a", "signed", nil}); err == nil {
+		t.Error("unexpected success with stale timestamp")
+	}
+
+	// Multi-group requests must be accepted by every group, with nonces used once.
+	multi := &NodeIdentity{"special", "signed", []string{"signed", "tokens"}}
+	req = newReq()
+	SignRequest(req, body, []byte("node-key"), "nonce-6")
+	if err := auth.authenticate(req, body, multi); err != nil {
+		t.Errorf("unexpected error with node secret for several groups: %s", err)
+	}
+	req = newReq()
+	req.Header.Set("Authorization", "Bearer s3cr3t")
+	if err := auth.authenticate(req, body, &NodeIdentity{"a", "tokens", []string{"tokens", "signed"}}); err == nil {
+		t.Error("unexpected success with token not accepted by all groups")
+	}
+
+	required := NewAuthenticator(AuthConfig{Required: true})
+	if err := required.authenticate(newReq(), body, &NodeIdentity{"a", "open", nil}); err == nil {
+		t.Error("unexpected success without credentials when required")
+	}
+}
+
+func TestRequireAuth(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+	do := func(h http.Handler, req *http.Request) int {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// Without credentials configured, requests pass.
+	open := RequireAuth(NewAuthenticator(AuthConfig{}), ok)
+	if code := do(open, httptest.NewRequest("GET", AuditEndpoint, nil)); code != 200 {
+		t.Errorf("unexpected status without configured credentials: %d", code)
+	}
+
+	h := RequireAuth(NewAuthenticator(AuthConfig{
+		GroupTokens:  map[string][]string{"tokens": {"s3cr3t"}},
+		NodeSecrets:  map[string][]byte{"special": []byte("node-key")},
+		AdminTokens:  []string{"admin-s3cr3t"},
+		AdminSecrets: [][]byte{[]byte("admin-key")},
+	}), ok)
+	if code := do(h, httptest.NewRequest("GET", AuditEndpoint, nil)); code != http.StatusUnauthorized {
+		t.Errorf("unexpected status without credentials: %d", code)
+	}
+
+	req := httptest.NewRequest("GET", AuditEndpoint, nil)
+	req.Header.Set("Authorization", "Bearer admin-s3cr3t")
+	if code := do(h, req); code != 200 {
+		t.Errorf("unexpected status with token: %d", code)
+	}
+	// Group and node credentials are not admin ones.
+	req = httptest.NewRequest("GET", AuditEndpoint, nil)
+	req.Header.Set("Authorization", "Bearer s3cr3t")
+	if code := do(h, req); code != http.StatusUnauthorized {
+		t.Errorf("unexpected status with group token: %d", code)
+	}
+	req = httptest.NewRequest("GET", AuditEndpoint, nil)
+	SignRequest(req, nil, []byte("node-key"), "n0")
+	if code := do(h, req); code != http.StatusUnauthorized {
+		t.Errorf("unexpected status with node signature: %d", code)
+	}
+	req = httptest.NewRequest("GET", AuditEndpoint, nil)
+	req.Header.Set("Authorization", "Bearer wrong")
+	if code := do(h, req); code != http.StatusUnauthorized {
+		t.Errorf("unexpected status with wrong token: %d", code)
+	}
+
+	req = httptest.NewRequest("GET", AuditEndpoint+"?group=a", nil)
+	SignRequest(req, nil, []byte("admin-key"), "n1")
+	if code := do(h, req); code != 200 {
+		t.Errorf("unexpected status with signature: %d", code)
+	}
+	if code := do(h, req); code != http.StatusUnauthorized {
+		t.Errorf("unexpected status with replayed signature: %d", code)
+	}
+	// Signatures cover the query.
+	req = httptest.NewRequest("GET", AuditEndpoint+"?group=a", nil)
+	SignRequest(req, nil, []byte("admin-key"), "n3")
+	req.URL.RawQuery = "group=b"
+	if code := do(h, req); code != http.StatusUnauthorized {
+		t.Errorf("unexpected status with tampered query: %d", code)
+	}
+	req = httptest.NewRequest("GET", AuditEndpoint, nil)
+	SignRequest(req, nil, []byte("wrong-key"), "n2")
+	if code := do(h, req); code != http.StatusUnauthorized {
+		t.Errorf("unexpected status with wrong signature: %d", code)
+	}
+}
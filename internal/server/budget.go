@@ -0,0 +1,196 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/lucab/exp-locksmith2/internal/lock"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// GroupsEndpoint is the endpoint for querying the status of groups.
+	GroupsEndpoint = "/v1/groups"
+
+	// budgetCheckInterval is the delay between checks of maximum hold
+	// durations.
+	budgetCheckInterval = 30 * time.Second
+
+	// pauseCauseMaxHold is the metrics cause of groups paused because
+	// of holders exceeding the maximum hold duration.
+	pauseCauseMaxHold = "max_hold"
+)
+
+// GroupStatus is the current state of a group semaphore.
+type GroupStatus struct {
+	Group      string   `json:"group"`
+	TotalSlots uint64   `json:"total_slots"`
+	Holders    []string `json:"holders"`
+	// Overdue are holders which exceeded the maximum hold duration.
+	Overdue  []string `json:"overdue,omitempty"`
+	Failures uint64   `json:"failures"`
+	// HolderLabels are the node labels of holders.
+	HolderLabels map[string]map[string]string `json:"holder_labels,omitempty"`
+	// VersionFailures are the failures reported per attempted version.
+	VersionFailures map[string]uint64 `json:"version_failures,omitempty"`
+	// NodeFailures are the last failures reported by nodes.
+	NodeFailures map[string]lock.NodeFailure `json:"node_failures,omitempty"`
+	Paused       bool                        `json:"paused"`
+	PauseReason  string                      `json:"pause_reason,omitempty"`
+	// MaxHold and FailureBudget are the configured limits, if any.
+	MaxHold       string `json:"max_hold,omitempty"`
+	FailureBudget uint64 `json:"failure_budget,omitempty"`
+	// KnownNodes and AvailableNodes are the membership view of heartbeats,
+	// MinAvailable the nodes required by the disruption budget, if any.
+	KnownNodes     int `json:"known_nodes"`
+	AvailableNodes int `json:"available_nodes"`
+	MinAvailable   int `json:"min_available,omitempty"`
+}
+
+// groupBudget returns the hold and failure limits of a group.
+func (sc *ServerConfig) groupBudget(group string) lock.Budget {
+	gc := sc.Groups[group]
+	return lock.Budget{MaxHold: gc.MaxHold, MaxFailures: gc.FailureBudget}
+}
+
+// EnforceBudgets periodically counts holders exceeding the maximum hold
+// duration of their group as failures, pausing groups whose failure
+// budget is exhausted, until the context is canceled.
+func (sc *ServerConfig) EnforceBudgets(ctx context.Context) {
+	if sc == nil {
+		return
+	}
+
+	ticker := time.NewTicker(budgetCheckInterval)
+	defer ticker.Stop()
+	for {
+		sc.enforceBudgets(ctx, time.Now())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// enforceBudgets checks all groups with a maximum hold duration once.
+func (sc *ServerConfig) enforceBudgets(ctx context.Context, now time.Time) {
+	for group, gc := range sc.Groups {
+		if gc.MaxHold <= 0 {
+			continue
+		}
+
+		checkCtx, cancel := context.WithTimeout(ctx, sc.LockTimeout)
+		reason, err := sc.enforceBudget(checkCtx, group, now)
+		cancel()
+		if err != nil {
+			logrus.WithField("group", group).Errorln("failed to check hold durations: ", err)
+			continue
+		}
+		if reason != "" {
+			autoPausesTotal.Inc(group, pauseCauseMaxHold)
+			sc.recordAutoPause(group, "", reason)
+			logrus.WithFields(logrus.Fields{
+				"group":  group,
+				"reason": reason,
+			}).Warn("group paused")
+		}
+	}
+}
+
+func (sc *ServerConfig) enforceBudget(ctx context.Context, group string, now time.Time) (string, error) {
+	manager, err := lock.OpenManager(ctx, sc.Backend, group)
+	if err == lock.ErrUnknownGroup {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return manager.EnforceBudget(ctx, sc.groupBudget(group), now)
+}
+
+// groupStatus returns the status of a group semaphore, given the member
+// records of its nodes.
+func (sc *ServerConfig) groupStatus(group string, sem *lock.Semaphore, members map[string]lock.Member) GroupStatus {
+	status := GroupStatus{
+		Group:           group,
+		TotalSlots:      sem.TotalSlots,
+		Holders:         sem.Holders,
+		Overdue:         sem.Overdue,
+		Failures:        sem.Failures,
+		HolderLabels:    sem.Labels,
+		VersionFailures: sem.VersionFailures,
+		NodeFailures:    sem.NodeFailures,
+		Paused:          sem.Paused,
+		PauseReason:     sem.PauseReason,
+		FailureBudget:   sc.Groups[group].FailureBudget,
+	}
+	if maxHold := sc.Groups[group].MaxHold; maxHold > 0 {
+		status.MaxHold = maxHold.String()
+	}
+	budget := lock.DisruptionBudget{}
+	if b := sc.Groups[group].DisruptionBudget; b != nil {
+		budget = *b
+	}
+	status.KnownNodes, status.AvailableNodes = sem.Availability(members, budget, time.Now())
+	if sc.Groups[group].DisruptionBudget != nil {
+		status.MinAvailable = budget.Required(status.KnownNodes)
+	}
+
+	return status
+}
+
+// GroupsStatus is the handler for the `/v1/groups` endpoint, listing the
+// status of every group semaphore.
+func (sc *ServerConfig) GroupsStatus() http.Handler {
+	handler := func(w http.ResponseWriter, req *http.Request) {
+		logrus.Debug("got groups query")
+		if sc == nil {
+			http.Error(w, errNilServerConfig.Error(), 500)
+			return
+		}
+		if req.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if sc.Backend == nil {
+			http.Error(w, lock.ErrNilBackend.Error(), 500)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(req.Context(), sc.LockTimeout)
+		defer cancel()
+		sems, _, err := sc.Backend.List(ctx)
+		if err != nil {
+			logrus.Errorln("failed to list semaphores: ", err)
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		statuses := []GroupStatus{}
+		for group, sem := range sems {
+			members, err := sc.Backend.Members(ctx, group)
+			if err != nil {
+				logrus.Errorln("failed to list group members: ", err)
+				http.Error(w, err.Error(), 500)
+				return
+			}
+			statuses = append(statuses, sc.groupStatus(group, sem, members))
+		}
+		sort.Slice(statuses, func(i, j int) bool {
+			return statuses[i].Group < statuses[j].Group
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(statuses); err != nil {
+			logrus.Errorln("failed to write groups: ", err)
+		}
+	}
+
+	return http.HandlerFunc(handler)
+}
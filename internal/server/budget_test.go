@@ -0,0 +1,155 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lucab/exp-locksmith2/internal/audit"
+)
+
+func TestEnforceBudgets(t *testing.T) {
+	ctx := context.Background()
+	sc := newTestServerConfig()
+	sc.SemaphoreSlots = 2
+	sc.Groups = map[string]GroupConfig{
+		"workers": {MaxHold: time.Hour, FailureBudget: 2},
+	}
+	if err := sc.EnsureGroups(ctx); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "locksmith2-budget")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	auditLog, err := audit.NewFileLog(filepath.Join(dir, "audit.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auditLog.Close()
+	sc.AuditLog = auditLog
+	preReboot := sc.PreReboot()
+
+	groups := func() []GroupStatus {
+		w := httptest.NewRecorder()
+		sc.GroupsStatus().ServeHTTP(w, httptest.NewRequest("GET", GroupsEndpoint, nil))
+		var statuses []GroupStatus
+		if err := json.Unmarshal(w.Body.Bytes(), &statuses); err != nil {
+			t.Fatal(err)
+		}
+		return statuses
+	}
+
+	for _, node := range []string{testNodeA, testNodeB} {
+		if w := doLockRequest(preReboot, PreRebootEndpoint, node, "workers"); w.Code != 200 {
+			t.Fatalf("unexpected status for lock: %d %s", w.Code, w.Body)
+		}
+	}
+	sc.enforceBudgets(ctx, time.Now())
+	if statuses := groups(); len(statuses) != 1 || statuses[0].Paused || len(statuses[0].Overdue) != 0 {
+		t.Errorf("unexpected groups within max hold: %+v", statuses)
+	}
+
+	sc.enforceBudgets(ctx, time.Now().Add(2*time.Hour))
+	statuses := groups()
+	if len(statuses) != 1 {
+		t.Fatalf("unexpected groups: %+v", statuses)
+	}
+	status := statuses[0]
+	if !status.Paused || status.PauseReason == "" || status.Failures != 2 || len(status.Overdue) != 2 {
+		t.Errorf("unexpected group with exhausted budget: %+v", status)
+	}
+	if status.MaxHold != "1h0m0s" || status.FailureBudget != 2 {
+		t.Errorf("unexpected group limits: %+v", status)
+	}
+
+	entries, err := auditLog.Query(ctx, audit.Filter{Group: "workers"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pauses []audit.Entry
+	for _, e := range entries {
+		if e.Action == audit.ActionAutoPause {
+			pauses = append(pauses, e)
+		}
+	}
+	if len(pauses) != 1 || pauses[0].Outcome != audit.OutcomeDone || pauses[0].Message != status.PauseReason {
+		t.Errorf("unexpected auto-pause audit entries: %+v", pauses)
+	}
+}
+
+func TestReportFailure(t *testing.T) {
+	sc := newTestServerConfig()
+	sc.SemaphoreSlots = 2
+	sc.Groups = map[string]GroupConfig{
+		"workers":  {FailureBudget: 2},
+		"database": {FailurePolicy: FailurePolicyRetain},
+	}
+	if err := sc.EnsureGroups(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	preReboot, reportFailure := sc.PreReboot(), sc.ReportFailure()
+	doFailureRequest := func(node, group string) *httptest.ResponseRecorder {
+		body := fmt.Sprintf(`{"client_params":{"node_uuid":%q,"group":%q,"error":"boot failed","attempted_version":"2"}}`, node, group)
+		w := httptest.NewRecorder()
+		reportFailure.ServeHTTP(w, httptest.NewRequest("POST", ReportFailureEndpoint, strings.NewReader(body)))
+		return w
+	}
+	failureResponse := func(w *httptest.ResponseRecorder) FailureResponse {
+		if w.Code != 200 {
+			t.Fatalf("unexpected status for failure report: %d %s", w.Code, w.Body)
+		}
+		var resp FailureResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// The error description and attempted version are mandatory.
+	if w := doLockRequest(reportFailure, ReportFailureEndpoint, testNodeA, "workers"); w.Code != 400 {
+		t.Errorf("unexpected status for incomplete failure report: %d %s", w.Code, w.Body)
+	}
+
+	for _, group := range []string{"workers", "database"} {
+		if w := doLockRequest(preReboot, PreRebootEndpoint, testNodeA, group); w.Code != 200 {
+			t.Fatalf("unexpected status for lock: %d %s", w.Code, w.Body)
+		}
+	}
+	if resp := failureResponse(doFailureRequest(testNodeA, "workers")); !resp.Released || len(resp.PausedGroups) != 0 {
+		t.Errorf("unexpected response for first failure: %+v", resp)
+	}
+	if resp := failureResponse(doFailureRequest(testNodeA, "database")); resp.Released {
+		t.Errorf("unexpected response with retain policy: %+v", resp)
+	}
+	if resp := failureResponse(doFailureRequest(testNodeB, "workers")); !reflect.DeepEqual(resp.PausedGroups, []string{"workers"}) {
+		t.Errorf("unexpected response with exhausted budget: %+v", resp)
+	}
+
+	sems, _, err := sc.Backend.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	workers, database := sems["workers"], sems["database"]
+	if len(workers.Holders) != 0 || !workers.Paused || workers.VersionFailures["2"] != 2 {
+		t.Errorf("unexpected workers semaphore: %+v", workers)
+	}
+	if len(database.Holders) != 1 || database.Paused || database.VersionFailures["2"] != 1 {
+		t.Errorf("unexpected database semaphore: %+v", database)
+	}
+
+	bad := newTestServerConfig()
+	bad.Groups = map[string]GroupConfig{"workers": {FailurePolicy: "ignore"}}
+	if err := bad.EnsureGroups(context.Background()); err == nil {
+		t.Error("unexpected success with invalid failure policy")
+	}
+}
@@ -2,7 +2,14 @@ package server
 
 import (
 	"errors"
+	"regexp"
+	"sync"
 	"time"
+
+	"github.com/lucab/exp-locksmith2/internal/audit"
+	"github.com/lucab/exp-locksmith2/internal/lock"
+	"github.com/lucab/exp-locksmith2/internal/webhook"
+	"go.etcd.io/etcd/clientv3"
 )
 
 var (
@@ -12,7 +19,42 @@ var (
 
 // ServerConfig hold server configuration.
 type ServerConfig struct {
-	EtcdURLs       []string
+	// Etcd holds settings for connecting to etcd.
+	Etcd           lock.ClientConfig
 	LockTimeout    time.Duration
 	SemaphoreSlots uint64
+	// Backend stores the semaphores of all groups.
+	Backend lock.Backend
+	// EtcdClient is the shared etcd client, built from `Etcd`, if any.
+	EtcdClient *clientv3.Client
+	// CertIdentity binds node identities to client certificates (see `CertIdentity*`).
+	CertIdentity string
+	// Auth authenticates lock requests, if not nil.
+	Auth *Authenticator
+	// MaxBodyBytes limits the size of request bodies (default `DefaultMaxBodyBytes`).
+	MaxBodyBytes int64
+	// NodeUUIDPattern must fully match node UUIDs (default `DefaultNodeUUIDPattern`).
+	NodeUUIDPattern *regexp.Regexp
+	// Groups holds per-group settings.
+	Groups map[string]GroupConfig
+	// RestrictGroups rejects requests for groups not listed in `Groups`.
+	RestrictGroups bool
+	// DisableImplicitGroups rejects requests for groups whose semaphore
+	// does not exist yet, instead of creating it.
+	DisableImplicitGroups bool
+	// Rollouts are ordered stages of groups, by rollout name.
+	Rollouts map[string]RolloutConfig
+	// VersionTTL is how long the reported version of a node is tracked
+	// without a new report, zero meaning forever.
+	VersionTTL time.Duration
+	// RateLimiter limits lock requests, if not nil.
+	RateLimiter *RateLimiter
+	// AuditLog records lock decisions, if not nil.
+	AuditLog audit.Log
+	// Webhooks notifies lock events, if not nil.
+	Webhooks *webhook.Dispatcher
+
+	// drainMu protects drained, closed on graceful shutdown.
+	drainMu sync.Mutex
+	drained chan struct{}
 }
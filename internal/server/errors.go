@@ -0,0 +1,102 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/lucab/exp-locksmith2/internal/lock"
+)
+
+// Error kinds, classifying failed requests for logs and audit trail.
+const (
+	// errKindInvalidRequest is a malformed or incomplete client request.
+	errKindInvalidRequest = "invalid_request"
+	// errKindSemaphoreFull is a lock request while all slots are taken.
+	errKindSemaphoreFull = "semaphore_full"
+	// errKindPaused is a lock request on a paused semaphore.
+	errKindPaused = "paused"
+	// errKindConflict is a concurrent semaphore update.
+	errKindConflict = "conflict"
+	// errKindUnauthorized is a request with missing or invalid credentials.
+	errKindUnauthorized = "unauthorized"
+	// errKindIdentityMismatch is a node identity not matching its client certificate.
+	errKindIdentityMismatch = "identity_mismatch"
+	// errKindRequestTooLarge is a request body exceeding the size limit.
+	errKindRequestTooLarge = "request_too_large"
+	// errKindUnsupportedMediaType is a request body which is not JSON.
+	errKindUnsupportedMediaType = "unsupported_media_type"
+	// errKindRateLimited is a request exceeding a rate limit.
+	errKindRateLimited = "rate_limited"
+	// errKindUnknownGroup is a request for a group which is not allowed or does not exist.
+	errKindUnknownGroup = "unknown_group"
+	// errKindForbidden is a node which is not allowed in the requested group.
+	errKindForbidden = "forbidden"
+	// errKindRolloutPending is a lock request while earlier rollout stages are incomplete.
+	errKindRolloutPending = "rollout_pending"
+	// errKindSpreadViolation is a lock request refused by a spread constraint.
+	errKindSpreadViolation = "spread_violation"
+	// errKindDisruptionBudget is a lock request refused by a disruption budget.
+	errKindDisruptionBudget = "disruption_budget"
+	// errKindGateClosed is a lock request refused by a group gate.
+	errKindGateClosed = "gate_closed"
+	// errKindStaleToken is a fencing token which is no longer current.
+	errKindStaleToken = "stale_token"
+	// errKindInternal is any other server-side failure.
+	errKindInternal = "internal"
+)
+
+// requestError is a failed client request, with its kind and HTTP status code.
+type requestError struct {
+	kind string
+	code int
+	err  error
+}
+
+func (e *requestError) Error() string {
+	return e.err.Error()
+}
+
+// errorStatus returns the kind and status code of a failed request,
+// falling back to the given defaults for errors which are not a requestError.
+//
+// Refusals are client errors: 409 for full semaphores, policy
+// violations, lost slots and conflicts which outlasted the retries, 423
+// for paused groups.
+func errorStatus(err error, defaultKind string, defaultCode int) (string, int) {
+	switch err {
+	case lock.ErrSemaphoreFull:
+		return errKindSemaphoreFull, http.StatusConflict
+	case lock.ErrPaused:
+		return errKindPaused, http.StatusLocked
+	case lock.ErrConflict, lock.ErrSlotLost:
+		return errKindConflict, http.StatusConflict
+	}
+
+	switch e := err.(type) {
+	case *requestError:
+		return e.kind, e.code
+	case *rateLimitError:
+		return errKindRateLimited, http.StatusTooManyRequests
+	case *lock.SpreadError:
+		return errKindSpreadViolation, http.StatusConflict
+	case *lock.DisruptionError:
+		return errKindDisruptionBudget, http.StatusConflict
+	default:
+		return defaultKind, defaultCode
+	}
+}
+
+// lockErrorKind classifies errors returned by the lock manager.
+func lockErrorKind(err error) string {
+	switch err {
+	case lock.ErrSemaphoreFull:
+		return errKindSemaphoreFull
+	case lock.ErrPaused:
+		return errKindPaused
+	case lock.ErrConflict, lock.ErrSlotLost:
+		return errKindConflict
+	case lock.ErrStaleToken:
+		return errKindStaleToken
+	default:
+		return errKindInternal
+	}
+}
@@ -0,0 +1,197 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/lucab/exp-locksmith2/internal/lock"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// EventsEndpoint is the endpoint for streaming semaphore events.
+	EventsEndpoint = "/v1/events"
+
+	contentTypeSSE    = "text/event-stream"
+	contentTypeNDJSON = "application/x-ndjson"
+)
+
+// streamError is the last message of an event stream interrupted by the
+// server, so that clients can tell it from a plain disconnection.
+type streamError struct {
+	// Kind is always "error".
+	Kind  string `json:"kind"`
+	Error string `json:"error"`
+	// Compacted is set when the requested revision is no longer
+	// available, thus the stream cannot be resumed from there.
+	Compacted bool `json:"compacted,omitempty"`
+}
+
+// Events is the handler for the `/v1/events` endpoint.
+//
+// Events are streamed as Server-Sent Events, or as newline-delimited JSON
+// if requested via `format=ndjson` or the `Accept` header. Streams can be
+// filtered with `group=<name>` and started at `revision=<rev>[.<index>]`,
+// or resumed after the event in the `Last-Event-ID` header. Events carry
+// their index within their revision, as a single revision can produce
+// several events, and SSE event IDs are `<revision>.<index>`.
+//
+// Headers are sent before the backend is watched, thus a stream which cannot
+// be started or resumed (e.g. from a compacted revision) ends with an `error`
+// event instead of an error status.
+func (sc *ServerConfig) Events() http.Handler {
+	handler := func(w http.ResponseWriter, req *http.Request) {
+		logrus.Debug("got events request")
+		if sc == nil {
+			http.Error(w, errNilServerConfig.Error(), 500)
+			return
+		}
+		if req.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming not supported", 500)
+			return
+		}
+
+		query := req.URL.Query()
+		group := query.Get("group")
+		fromRevision, skip, err := parseStartRevision(req)
+		if err != nil {
+			logrus.Errorln("failed to parse start revision: ", err)
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		ndjson := query.Get("format") == "ndjson" || strings.Contains(req.Header.Get("Accept"), contentTypeNDJSON)
+
+		if sc.Backend == nil {
+			http.Error(w, lock.ErrNilBackend.Error(), 500)
+			return
+		}
+
+		if ndjson {
+			w.Header().Set("Content-Type", contentTypeNDJSON)
+		} else {
+			w.Header().Set("Content-Type", contentTypeSSE)
+		}
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		logrus.WithFields(logrus.Fields{
+			"group":    group,
+			"revision": fromRevision,
+		}).Debug("streaming events")
+
+		// Streams end when the server starts draining, while other
+		// requests are still served until shutdown.
+		ctx, cancel := context.WithCancel(req.Context())
+		defer cancel()
+		go func() {
+			select {
+			case <-ctx.Done():
+			case <-sc.drainedChan():
+				cancel()
+			}
+		}()
+
+		encoder := json.NewEncoder(w)
+		err = lock.WatchEvents(ctx, sc.Backend, group, fromRevision, func(ev lock.Event) error {
+			if ev.Revision == fromRevision && ev.Index < skip {
+				// Already delivered before the client reconnected.
+				return nil
+			}
+
+			if ndjson {
+				if err := encoder.Encode(ev); err != nil {
+					return err
+				}
+			} else {
+				data, err := json.Marshal(ev)
+				if err != nil {
+					return err
+				}
+				if _, err := fmt.Fprintf(w, "id: %d.%d\nevent: %s\ndata: %s\n\n", ev.Revision, ev.Index, ev.Kind, data); err != nil {
+					return err
+				}
+			}
+			flusher.Flush()
+			return nil
+		})
+		if err == nil || ctx.Err() != nil {
+			return
+		}
+		logrus.Errorln("events stream interrupted: ", err)
+
+		streamErr := streamError{Kind: "error", Error: err.Error(), Compacted: err == lock.ErrCompacted}
+		if ndjson {
+			encoder.Encode(streamErr)
+		} else {
+			data, _ := json.Marshal(streamErr)
+			fmt.Fprintf(w, "event: error\ndata: %s\n\n", data)
+		}
+		flusher.Flush()
+	}
+
+	return http.HandlerFunc(handler)
+}
+
+// parseStartRevision returns the backend revision to start streaming from,
+// and the number of events of that revision to skip. An explicit `revision`
+// query parameter, `<rev>` or `<rev>.<index>`, starts at that event and
+// takes precedence over the `Last-Event-ID` header, which resumes right
+// after the last seen event, possibly within its revision.
+func parseStartRevision(req *http.Request) (int64, int, error) {
+	if rev := req.URL.Query().Get("revision"); rev != "" {
+		revision, index, err := parseEventID(rev)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid revision %q", rev)
+		}
+		if index < 0 {
+			index = 0
+		}
+		return revision, index, nil
+	}
+
+	lastID := req.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		return 0, 0, nil
+	}
+	lastRevision, lastIndex, err := parseEventID(lastID)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid Last-Event-ID %q", lastID)
+	}
+	if lastIndex < 0 {
+		// IDs without an index cover their whole revision.
+		return lastRevision + 1, 0, nil
+	}
+
+	return lastRevision, lastIndex + 1, nil
+}
+
+// parseEventID parses `<revision>[.<index>]`, returning a negative index
+// if there is none.
+func parseEventID(id string) (int64, int, error) {
+	parts := strings.SplitN(id, ".", 2)
+	revision, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || revision < 0 {
+		return 0, 0, errors.New("invalid revision")
+	}
+	if len(parts) == 1 {
+		return revision, -1, nil
+	}
+	index, err := strconv.Atoi(parts[1])
+	if err != nil || index < 0 {
+		return 0, 0, errors.New("invalid index")
+	}
+
+	return revision, index, nil
+}
@@ -0,0 +1,354 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/lucab/exp-locksmith2/internal/lock"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultGateTimeout is the default timeout of a single gate check.
+	DefaultGateTimeout = 5 * time.Second
+
+	// maxGateResponseBytes limits the response bodies read from HTTP gates.
+	maxGateResponseBytes = 1024 * 1024
+	// maxGateOutputBytes limits the output collected from exec gates.
+	maxGateOutputBytes = 4 * 1024
+	// maxGateMessageLength limits gate outputs reported in refusals.
+	maxGateMessageLength = 256
+)
+
+// Gate is an external check consulted before granting a slot in a group,
+// e.g. asking a storage cluster whether a node can go down. It is either
+// an HTTP check (URL) or an exec hook (Command).
+type Gate struct {
+	// Name identifies the gate in refusals, logs and metrics.
+	Name string
+	// URL is requested with GET. Occurrences of `{node}` and `{group}`
+	// are replaced with the (escaped) node UUID and group.
+	URL string
+	// ExpectStatus is the HTTP status code of an open gate (default 200).
+	ExpectStatus int
+	// JSONField, if set, is a dot-separated path in the JSON response
+	// which must be equal to JSONValue (default "true").
+	JSONField string
+	JSONValue string
+	// Command is run with the node UUID and group in the environment
+	// (`LOCKSMITH2_NODE` and `LOCKSMITH2_GROUP`), and must exit with 0.
+	Command []string
+	// Timeout bounds a single check (default `DefaultGateTimeout`).
+	Timeout time.Duration
+	// CacheTTL, if set, is how long the result for a node is reused.
+	CacheTTL time.Duration
+
+	mu    sync.Mutex
+	cache map[string]cachedGateResult
+}
+
+// cachedGateResult is a gate result, with its expiry time.
+type cachedGateResult struct {
+	result  GateResult
+	expires time.Time
+}
+
+// GateResult is the outcome of a gate check for a node.
+type GateResult struct {
+	Group string `json:"group"`
+	Gate  string `json:"gate"`
+	Open  bool   `json:"open"`
+	// Message explains a closed gate.
+	Message string `json:"message,omitempty"`
+	Cached  bool   `json:"cached,omitempty"`
+}
+
+// GateRefusal is the body of a lock request refused by gates.
+type GateRefusal struct {
+	Error string       `json:"error"`
+	Kind  string       `json:"kind"`
+	Gates []GateResult `json:"gates"`
+}
+
+// checkGates validates the gates of all groups.
+func (sc *ServerConfig) checkGates() error {
+	for group, gc := range sc.Groups {
+		names := map[string]bool{}
+		for _, gate := range gc.Gates {
+			if gate == nil || gate.Name == "" {
+				return fmt.Errorf("gate without name in group %q", group)
+			}
+			if names[gate.Name] {
+				return fmt.Errorf("duplicate gate %q in group %q", gate.Name, group)
+			}
+			names[gate.Name] = true
+			if (gate.URL == "") == (len(gate.Command) == 0) {
+				return fmt.Errorf("gate %q in group %q needs either a URL or a command", gate.Name, group)
+			}
+		}
+	}
+
+	return nil
+}
+
+// evaluateGates checks the gates of all requested groups and their
+// parents, unless the node already holds its slots. It returns all
+// results, and whether all gates are open.
+func (sc *ServerConfig) evaluateGates(ctx context.Context, identity *NodeIdentity) ([]GateResult, bool, error) {
+	type pending struct {
+		group string
+		gate  *Gate
+	}
+	gates := []pending{}
+	seen := map[string]bool{}
+	for _, requested := range identity.groups() {
+		chain, err := sc.groupChain(requested)
+		if err != nil {
+			return nil, false, err
+		}
+		for _, group := range chain {
+			if seen[group] {
+				continue
+			}
+			seen[group] = true
+			for _, gate := range sc.Groups[group].Gates {
+				gates = append(gates, pending{group, gate})
+			}
+		}
+	}
+	if len(gates) == 0 {
+		return nil, true, nil
+	}
+
+	held, err := sc.holdsSlots(ctx, identity)
+	if err != nil || held {
+		return nil, held, err
+	}
+
+	results := make([]GateResult, len(gates))
+	var wg sync.WaitGroup
+	for i, p := range gates {
+		wg.Add(1)
+		go func(i int, p pending) {
+			defer wg.Done()
+			results[i] = p.gate.check(ctx, p.group, identity.UUID, time.Now())
+		}(i, p)
+	}
+	wg.Wait()
+
+	open := true
+	for _, result := range results {
+		status := "open"
+		if !result.Open {
+			open, status = false, "closed"
+		}
+		gateChecksTotal.Inc(result.Group, result.Gate, status)
+	}
+
+	return results, open, nil
+}
+
+// holdsSlots returns whether a node holds slots in all requested groups,
+// thus in their parents too.
+func (sc *ServerConfig) holdsSlots(ctx context.Context, identity *NodeIdentity) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, sc.LockTimeout)
+	defer cancel()
+
+	for _, group := range identity.groups() {
+		sem, _, err := sc.Backend.Get(ctx, group)
+		if err == lock.ErrUnknownGroup {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if sem.Token(identity.UUID) == 0 {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// check returns the result of the gate for a node, possibly cached.
+func (g *Gate) check(ctx context.Context, group, node string, now time.Time) GateResult {
+	if g.CacheTTL > 0 {
+		g.mu.Lock()
+		cached, ok := g.cache[node]
+		g.mu.Unlock()
+		if ok && now.Before(cached.expires) {
+			cached.result.Cached = true
+			return cached.result
+		}
+	}
+
+	timeout := g.Timeout
+	if timeout <= 0 {
+		timeout = DefaultGateTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	result := GateResult{Group: group, Gate: g.Name, Open: true}
+	var err error
+	if g.URL != "" {
+		err = g.checkHTTP(ctx, group, node)
+	} else {
+		err = g.checkExec(ctx, group, node)
+	}
+	if err != nil {
+		result.Open, result.Message = false, truncate(err.Error(), maxGateMessageLength)
+		logrus.WithFields(logrus.Fields{
+			"group": group,
+			"gate":  g.Name,
+			"UUID":  node,
+		}).Info("gate closed: ", result.Message)
+	}
+
+	if g.CacheTTL > 0 {
+		g.mu.Lock()
+		if g.cache == nil {
+			g.cache = map[string]cachedGateResult{}
+		}
+		for n, cached := range g.cache {
+			if !now.Before(cached.expires) {
+				delete(g.cache, n)
+			}
+		}
+		g.cache[node] = cachedGateResult{result, now.Add(g.CacheTTL)}
+		g.mu.Unlock()
+	}
+
+	return result
+}
+
+// checkHTTP requests the gate URL, returning why the gate is closed.
+func (g *Gate) checkHTTP(ctx context.Context, group, node string) error {
+	target := strings.NewReplacer("{node}", url.QueryEscape(node), "{group}", url.QueryEscape(group)).Replace(g.URL)
+	req, err := http.NewRequest(http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	expectStatus := g.ExpectStatus
+	if expectStatus == 0 {
+		expectStatus = http.StatusOK
+	}
+	if resp.StatusCode != expectStatus {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	if g.JSONField == "" {
+		return nil
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxGateResponseBytes))
+	if err != nil {
+		return err
+	}
+	var doc interface{}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return fmt.Errorf("invalid JSON response: %s", err)
+	}
+	value, ok := jsonField(doc, g.JSONField)
+	expected := g.JSONValue
+	if expected == "" {
+		expected = "true"
+	}
+	if !ok {
+		return fmt.Errorf("missing field %q", g.JSONField)
+	}
+	if value != expected {
+		return fmt.Errorf("field %q is %q, expected %q", g.JSONField, value, expected)
+	}
+
+	return nil
+}
+
+// checkExec runs the gate command, returning why the gate is closed.
+func (g *Gate) checkExec(ctx context.Context, group, node string) error {
+	cmd := exec.CommandContext(ctx, g.Command[0], g.Command[1:]...)
+	cmd.Env = append(os.Environ(), "LOCKSMITH2_NODE="+node, "LOCKSMITH2_GROUP="+group)
+	output := &limitedBuffer{max: maxGateOutputBytes}
+	cmd.Stdout, cmd.Stderr = output, output
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return errors.New("timed out")
+		}
+		if msg := strings.TrimSpace(output.String()); msg != "" {
+			return fmt.Errorf("%s: %s", err, msg)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// jsonField returns the string representation of a field in a decoded
+// JSON document, given its dot-separated path.
+func jsonField(doc interface{}, path string) (string, bool) {
+	for _, key := range strings.Split(path, ".") {
+		obj, ok := doc.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		if doc, ok = obj[key]; !ok {
+			return "", false
+		}
+	}
+
+	if s, ok := doc.(string); ok {
+		return s, true
+	}
+	b, err := json.Marshal(doc)
+	return string(b), err == nil
+}
+
+// limitedBuffer collects up to `max` bytes, silently discarding the rest
+// so that commands writing more are not interrupted.
+type limitedBuffer struct {
+	bytes.Buffer
+	max int
+}
+
+// Write implements io.Writer.
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - b.Len(); room > 0 {
+		if len(p) > room {
+			b.Buffer.Write(p[:room])
+		} else {
+			b.Buffer.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+// truncate limits the length of a message to `max` bytes, without
+// splitting UTF-8 sequences.
+func truncate(msg string, max int) string {
+	if len(msg) <= max {
+		return msg
+	}
+	for max > 0 && !utf8.RuneStart(msg[max]) {
+		max--
+	}
+	return msg[:max] + "..."
+}
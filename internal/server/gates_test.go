@@ -0,0 +1,151 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestGateCheck(t *testing.T) {
+	var safe, requests int32
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if req.URL.Query().Get("node") != "node-a" {
+			http.Error(w, "unknown node", http.StatusNotFound)
+			return
+		}
+		fmt.Fprintf(w, `{"cluster": {"safe": %t, "state": "ok"}}`, atomic.LoadInt32(&safe) == 1)
+	}))
+	defer storage.Close()
+
+	ctx := context.Background()
+	now := time.Now()
+	tests := []struct {
+		gate *Gate
+		node string
+		open bool
+	}{
+		{&Gate{URL: storage.URL + "?node={node}"}, "node-a", true},
+		{&Gate{URL: storage.URL + "?node={node}"}, "node-b", false},
+		{&Gate{URL: storage.URL + "?node={node}", ExpectStatus: 404}, "node-b", true},
+		{&Gate{URL: storage.URL + "?node={node}", JSONField: "cluster.safe"}, "node-a", false},
+		{&Gate{URL: storage.URL + "?node={node}", JSONField: "cluster.state", JSONValue: "ok"}, "node-a", true},
+		{&Gate{URL: storage.URL + "?node={node}", JSONField: "cluster.missing"}, "node-a", false},
+		{&Gate{URL: "http://127.0.0.1:1/"}, "node-a", false},
+		{&Gate{Command: []string{"sh", "-c", `test "$LOCKSMITH2_NODE" = node-a`}}, "node-a", true},
+		{&Gate{Command: []string{"sh", "-c", "echo not safe; exit 1"}}, "node-a", false},
+		{&Gate{Command: []string{"sleep", "5"}, Timeout: 50 * time.Millisecond}, "node-a", false},
+	}
+	// Outputs are bounded, and truncated on character boundaries.
+	verbose := &Gate{Name: "verbose", Command: []string{"sh", "-c", "yes é | head -c 1000000; exit 1"}}
+	if result := verbose.check(ctx, "storage", "node-a", now); result.Open || len(result.Message) > maxGateMessageLength+3 || !utf8.ValidString(result.Message) {
+		t.Errorf("unexpected result for verbose gate: %+v", result)
+	}
+	output := &limitedBuffer{max: 4}
+	if n, err := output.Write([]byte("abcdef")); n != 6 || err != nil || output.String() != "abcd" {
+		t.Errorf("unexpected limited write: %d %v %q", n, err, output.String())
+	}
+	if msg := truncate("aé", 2); msg != "a..." {
+		t.Errorf("unexpected truncated message: %q", msg)
+	}
+
+	for i, tt := range tests {
+		tt.gate.Name = "test"
+		result := tt.gate.check(ctx, "storage", tt.node, now)
+		if result.Open != tt.open || (!result.Open && result.Message == "") {
+			t.Errorf("#%d: unexpected result %+v", i, result)
+		}
+	}
+
+	// Results are cached per node.
+	gate := &Gate{Name: "cached", URL: storage.URL + "?node={node}", JSONField: "cluster.safe", CacheTTL: time.Minute}
+	atomic.StoreInt32(&requests, 0)
+	if result := gate.check(ctx, "storage", "node-a", now); result.Open || result.Cached {
+		t.Errorf("unexpected first result %+v", result)
+	}
+	atomic.StoreInt32(&safe, 1)
+	if result := gate.check(ctx, "storage", "node-a", now.Add(time.Second)); result.Open || !result.Cached {
+		t.Errorf("unexpected cached result %+v", result)
+	}
+	if result := gate.check(ctx, "storage", "node-a", now.Add(2*time.Minute)); !result.Open || result.Cached {
+		t.Errorf("unexpected result after expiry %+v", result)
+	}
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("unexpected number of gate requests: %d", n)
+	}
+}
+
+func TestPreRebootGates(t *testing.T) {
+	var safe int32
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, `{"safe": %t}`, atomic.LoadInt32(&safe) == 1)
+	}))
+	defer storage.Close()
+
+	sc := newTestServerConfig()
+	sc.Groups = map[string]GroupConfig{
+		"storage": {Gates: []*Gate{
+			{Name: "cluster", URL: storage.URL, JSONField: "safe"},
+			{Name: "hook", Command: []string{"true"}},
+		}},
+	}
+	if err := sc.EnsureGroups(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	preReboot := sc.PreReboot()
+
+	w := doLockRequest(preReboot, PreRebootEndpoint, testNodeA, "storage")
+	if w.Code != http.StatusConflict {
+		t.Fatalf("unexpected status with closed gate: %d %s", w.Code, w.Body)
+	}
+	var refusal GateRefusal
+	if err := json.Unmarshal(w.Body.Bytes(), &refusal); err != nil {
+		t.Fatal(err)
+	}
+	if refusal.Kind != errKindGateClosed || len(refusal.Gates) != 2 || refusal.Gates[0].Open || !refusal.Gates[1].Open {
+		t.Errorf("unexpected refusal: %+v", refusal)
+	}
+
+	atomic.StoreInt32(&safe, 1)
+	if w := doLockRequest(preReboot, PreRebootEndpoint, testNodeA, "storage"); w.Code != 200 {
+		t.Fatalf("unexpected status with open gates: %d %s", w.Code, w.Body)
+	}
+	// Holders get their token back, even if gates closed meanwhile.
+	atomic.StoreInt32(&safe, 0)
+	if w := doLockRequest(preReboot, PreRebootEndpoint, testNodeA, "storage"); w.Code != 200 {
+		t.Errorf("unexpected status for holder with closed gate: %d %s", w.Code, w.Body)
+	}
+
+	// Gates of parent groups apply to their children.
+	sc.Groups["rack"] = GroupConfig{Parent: "storage"}
+	if err := sc.EnsureGroups(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	w = doLockRequest(preReboot, PreRebootEndpoint, testNodeB, "rack")
+	refusal = GateRefusal{}
+	if err := json.Unmarshal(w.Body.Bytes(), &refusal); err != nil || w.Code != http.StatusConflict {
+		t.Fatalf("unexpected response with closed gate in parent group: %d %s", w.Code, w.Body)
+	}
+	if len(refusal.Gates) != 2 || refusal.Gates[0].Group != "storage" || refusal.Gates[0].Open {
+		t.Errorf("unexpected refusal for child group: %+v", refusal)
+	}
+
+	for _, gates := range [][]*Gate{
+		{{URL: storage.URL}},
+		{{Name: "a"}},
+		{{Name: "a", URL: storage.URL, Command: []string{"true"}}},
+		{{Name: "a", URL: storage.URL}, {Name: "a", Command: []string{"true"}}},
+	} {
+		bad := newTestServerConfig()
+		bad.Groups = map[string]GroupConfig{"storage": {Gates: gates}}
+		if err := bad.EnsureGroups(context.Background()); err == nil {
+			t.Errorf("unexpected success with invalid gates: %+v", gates)
+		}
+	}
+}
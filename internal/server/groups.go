@@ -0,0 +1,231 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/lucab/exp-locksmith2/internal/lock"
+	"github.com/sirupsen/logrus"
+)
+
+// GroupConfig holds settings for a single group.
+type GroupConfig struct {
+	// Slots is the number of semaphore slots, overriding the default.
+	Slots uint64
+	// NodePattern, if set, must fully match the UUID of member nodes.
+	NodePattern *regexp.Regexp
+	// CertIdentities, if set, lists the client certificate identities
+	// (Common Name or Subject Alternative Names) allowed in the group.
+	CertIdentities []string
+	// RateLimit, if set, overrides the per-node rate limit for the group.
+	RateLimit *RateLimit
+	// Parent, if set, is a declared group whose slots are taken together
+	// with the ones of this group, e.g. a datacenter for a rack.
+	Parent string
+	// MaxHold, if set, is how long a node may hold a slot before this
+	// counts as a failure.
+	MaxHold time.Duration
+	// FailureBudget, if set, is the number of failures which pauses the
+	// group automatically.
+	FailureBudget uint64
+	// FailurePolicy is what happens to the slot of a node reporting a
+	// failure (see `FailurePolicy*`, default `FailurePolicyRelease`).
+	FailurePolicy string
+	// Gates are external checks which must all pass before a node gets
+	// a new slot.
+	Gates []*Gate
+	// Spread limits holders sharing node label values, e.g. at most one
+	// per rack, checked atomically with the slot acquisition.
+	Spread []lock.Spread
+	// DisruptionBudget, if set, is the minimum of known nodes which must
+	// stay available, according to heartbeats, when granting a slot.
+	DisruptionBudget *lock.DisruptionBudget
+}
+
+// EnsureGroups creates the semaphores of all configured groups,
+// if they do not exist yet.
+func (sc *ServerConfig) EnsureGroups(ctx context.Context) error {
+	if sc == nil {
+		return errNilServerConfig
+	}
+
+	if err := sc.checkRollouts(); err != nil {
+		return err
+	}
+	if err := sc.checkFailurePolicy(); err != nil {
+		return err
+	}
+	if err := sc.checkGates(); err != nil {
+		return err
+	}
+	if err := sc.checkSpread(); err != nil {
+		return err
+	}
+	if err := sc.checkDisruptionBudgets(); err != nil {
+		return err
+	}
+
+	// Rollout stages observe the semaphores of their groups, thus
+	// these must exist too.
+	groups := map[string]bool{}
+	for group := range sc.Groups {
+		if _, err := sc.groupChain(group); err != nil {
+			return err
+		}
+		groups[group] = true
+	}
+	for _, rc := range sc.Rollouts {
+		for _, stage := range rc.Stages {
+			for _, group := range stage {
+				groups[group] = true
+			}
+		}
+	}
+
+	for group := range groups {
+		if _, err := lock.NewManager(ctx, sc.Backend, group, sc.groupSlots(group)); err != nil {
+			return fmt.Errorf("failed to initialize group %q: %s", group, err)
+		}
+		logrus.WithField("group", group).Debug("group semaphore initialized")
+	}
+
+	return nil
+}
+
+// lockManager returns the lock manager for the requested groups and all
+// their parents, creating the semaphores of requested groups on first
+// use unless implicit groups are disabled. The first group is the one
+// whose fencing tokens are returned.
+func (sc *ServerConfig) lockManager(ctx context.Context, groups []string) (*lock.Manager, error) {
+	all := []string{}
+	for _, group := range groups {
+		chain, err := sc.groupChain(group)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, chain...)
+
+		if !sc.DisableImplicitGroups {
+			if _, err := lock.NewManager(ctx, sc.Backend, group, sc.groupSlots(group)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	manager, err := lock.OpenManager(ctx, sc.Backend, all[0], all[1:]...)
+	if err == lock.ErrUnknownGroup {
+		return nil, &requestError{errKindUnknownGroup, http.StatusForbidden, fmt.Errorf("unknown group in %q", groups)}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if sc.VersionTTL > 0 {
+		manager = manager.WithVersionTTL(sc.VersionTTL)
+	}
+	for _, group := range all {
+		if spreads := sc.Groups[group].Spread; len(spreads) > 0 {
+			manager = manager.WithSpread(group, spreads...)
+		}
+		if budget := sc.Groups[group].DisruptionBudget; budget != nil {
+			manager = manager.WithDisruptionBudget(group, *budget)
+		}
+	}
+	for _, group := range groups {
+		if name, stage, ok := sc.rolloutStage(group); ok && stage > 0 {
+			guard, observed := sc.rolloutGuard(name, stage, group)
+			manager = manager.WithGuard(guard, observed...)
+		}
+	}
+
+	return manager, nil
+}
+
+// checkSpread validates the spread constraints of all groups.
+func (sc *ServerConfig) checkSpread() error {
+	for group, gc := range sc.Groups {
+		for _, spread := range gc.Spread {
+			if !labelPattern.MatchString(spread.Label) || spread.MaxHolders < 1 {
+				return fmt.Errorf("invalid spread constraint %+v for group %q", spread, group)
+			}
+		}
+	}
+
+	return nil
+}
+
+// groupChain returns a group followed by all its ancestors, failing on
+// undeclared parents and loops.
+func (sc *ServerConfig) groupChain(group string) ([]string, error) {
+	chain := []string{group}
+	for parent := sc.Groups[group].Parent; parent != ""; parent = sc.Groups[parent].Parent {
+		if _, ok := sc.Groups[parent]; !ok {
+			return nil, fmt.Errorf("group %q has undeclared parent %q", chain[len(chain)-1], parent)
+		}
+		for _, g := range chain {
+			if g == parent {
+				return nil, fmt.Errorf("parent chain of group %q loops at %q", group, parent)
+			}
+		}
+		chain = append(chain, parent)
+	}
+
+	return chain, nil
+}
+
+// groupSlots returns the number of semaphore slots for a group.
+func (sc *ServerConfig) groupSlots(group string) uint64 {
+	if gc, ok := sc.Groups[group]; ok && gc.Slots > 0 {
+		return gc.Slots
+	}
+	return sc.SemaphoreSlots
+}
+
+// authorize checks that a node is allowed to join all requested groups.
+func (sc *ServerConfig) authorize(req *http.Request, identity *NodeIdentity) error {
+	for _, group := range identity.groups() {
+		if err := sc.authorizeGroup(req, identity.UUID, group); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// authorizeGroup checks that a node is allowed to join a single group.
+func (sc *ServerConfig) authorizeGroup(req *http.Request, node, group string) error {
+	gc, known := sc.Groups[group]
+	if !known {
+		if sc.RestrictGroups {
+			return &requestError{errKindUnknownGroup, http.StatusForbidden, fmt.Errorf("unknown group %q", group)}
+		}
+		return nil
+	}
+
+	if gc.NodePattern != nil && !gc.NodePattern.MatchString(node) {
+		return &requestError{errKindForbidden, http.StatusForbidden, fmt.Errorf("node %q is not allowed in group %q", node, group)}
+	}
+
+	if len(gc.CertIdentities) > 0 {
+		allowed := false
+		if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 && len(req.TLS.VerifiedChains[0]) > 0 {
+			cert := req.TLS.VerifiedChains[0][0]
+			names := append(certIdentities(cert, CertIdentityCN), certIdentities(cert, CertIdentitySAN)...)
+			for _, name := range names {
+				for _, id := range gc.CertIdentities {
+					if name == id {
+						allowed = true
+					}
+				}
+			}
+		}
+		if !allowed {
+			return &requestError{errKindForbidden, http.StatusForbidden, fmt.Errorf("client certificate is not allowed in group %q", group)}
+		}
+	}
+
+	return nil
+}
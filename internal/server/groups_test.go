@@ -0,0 +1,165 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/lucab/exp-locksmith2/internal/lock"
+)
+
+func TestAuthorize(t *testing.T) {
+	sc := &ServerConfig{
+		SemaphoreSlots: 1,
+		Groups: map[string]GroupConfig{
+			"workers": {
+				Slots:       3,
+				NodePattern: regexp.MustCompile("^worker-[0-9]+$"),
+			},
+			"controllers": {
+				CertIdentities: []string{"controller.example.com"},
+			},
+		},
+	}
+	withCert := func(cn string) *http.Request {
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: cn}}
+		return &http.Request{
+			TLS: &tls.ConnectionState{
+				VerifiedChains: [][]*x509.Certificate{{cert}},
+			},
+		}
+	}
+
+	tests := []struct {
+		restrict bool
+		req      *http.Request
+		identity NodeIdentity
+		kind     string
+	}{
+		{false, &http.Request{}, NodeIdentity{"anything", "other", nil}, ""},
+		{true, &http.Request{}, NodeIdentity{"anything", "other", nil}, errKindUnknownGroup},
+		{true, &http.Request{}, NodeIdentity{"worker-1", "workers", nil}, ""},
+		{true, &http.Request{}, NodeIdentity{"controller-1", "workers", nil}, errKindForbidden},
+		{true, &http.Request{}, NodeIdentity{"controller-1", "controllers", nil}, errKindForbidden},
+		{true, withCert("other.example.com"), NodeIdentity{"controller-1", "controllers", nil}, errKindForbidden},
+		{true, withCert("controller.example.com"), NodeIdentity{"controller-1", "controllers", nil}, ""},
+	}
+
+	for _, tt := range tests {
+		sc.RestrictGroups = tt.restrict
+		err := sc.authorize(tt.req, &tt.identity)
+		kind := ""
+		if err != nil {
+			kind, _ = errorStatus(err, errKindInternal, 500)
+		}
+		if kind != tt.kind {
+			t.Errorf("authorize(%v, restrict=%t): expected kind %q, got %q (%v)", tt.identity, tt.restrict, tt.kind, kind, err)
+		}
+	}
+
+	if slots := sc.groupSlots("workers"); slots != 3 {
+		t.Errorf("expected 3 slots for configured group, got %d", slots)
+	}
+	if slots := sc.groupSlots("other"); slots != 1 {
+		t.Errorf("expected default slots for unconfigured group, got %d", slots)
+	}
+}
+
+func TestGroupParents(t *testing.T) {
+	sc := newTestServerConfig()
+	sc.Groups = map[string]GroupConfig{
+		"fleet": {Slots: 2},
+		"dc":    {Slots: 1, Parent: "fleet"},
+		"rack1": {Slots: 1, Parent: "dc"},
+		"rack2": {Slots: 1, Parent: "dc"},
+	}
+	if err := sc.EnsureGroups(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if chain, err := sc.groupChain("rack1"); err != nil || !reflect.DeepEqual(chain, []string{"rack1", "dc", "fleet"}) {
+		t.Errorf("unexpected chain: %v, %v", chain, err)
+	}
+
+	preReboot, steadyState := sc.PreReboot(), sc.SteadyState()
+	if w := doLockRequest(preReboot, PreRebootEndpoint, testNodeA, "rack1"); w.Code != 200 {
+		t.Fatalf("unexpected status for lock: %d %s", w.Code, w.Body)
+	}
+	// Another rack in the same datacenter is limited by the datacenter slot.
+	if w := doLockRequest(preReboot, PreRebootEndpoint, testNodeB, "rack2"); w.Code == 200 {
+		t.Error("unexpected lock with full parent")
+	}
+	if w := doLockRequest(steadyState, SteadyStateEndpoint, testNodeA, "rack1"); w.Code != 200 {
+		t.Fatalf("unexpected status for unlock: %d %s", w.Code, w.Body)
+	}
+	if w := doLockRequest(preReboot, PreRebootEndpoint, testNodeB, "rack2"); w.Code != 200 {
+		t.Errorf("unexpected status after parent release: %d %s", w.Code, w.Body)
+	}
+
+	for _, groups := range []map[string]GroupConfig{
+		{"a": {Parent: "missing"}},
+		{"a": {Parent: "b"}, "b": {Parent: "a"}},
+	} {
+		bad := newTestServerConfig()
+		bad.Groups = groups
+		if err := bad.EnsureGroups(context.Background()); err == nil {
+			t.Errorf("unexpected success with invalid parents: %v", groups)
+		}
+	}
+}
+
+func TestGroupSpread(t *testing.T) {
+	sc := newTestServerConfig()
+	sc.SemaphoreSlots = 5
+	sc.Groups = map[string]GroupConfig{
+		"dc-1":    {Spread: []lock.Spread{{Label: "rack", MaxHolders: 1}}},
+		"storage": {Parent: "dc-1"},
+	}
+	if err := sc.EnsureGroups(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	preReboot := sc.PreReboot()
+	doLabeledRequest := func(node, rack string) *httptest.ResponseRecorder {
+		body := fmt.Sprintf(`{"client_params":{"node_uuid":%q,"group":"storage","labels":{"rack":%q,"role":"osd"}}}`, node, rack)
+		w := httptest.NewRecorder()
+		preReboot.ServeHTTP(w, httptest.NewRequest("POST", PreRebootEndpoint, strings.NewReader(body)))
+		return w
+	}
+
+	if w := doLabeledRequest(testNodeA, "r1"); w.Code != 200 {
+		t.Fatalf("unexpected status for first lock: %d %s", w.Code, w.Body)
+	}
+	// Spread constraints of parents apply too.
+	if w := doLabeledRequest(testNodeB, "r1"); w.Code != http.StatusConflict {
+		t.Errorf("unexpected status in same rack: %d %s", w.Code, w.Body)
+	}
+	if w := doLabeledRequest(testNodeB, "r2"); w.Code != 200 {
+		t.Errorf("unexpected status in other rack: %d %s", w.Code, w.Body)
+	}
+
+	w := httptest.NewRecorder()
+	sc.GroupsStatus().ServeHTTP(w, httptest.NewRequest("GET", GroupsEndpoint, nil))
+	var statuses []GroupStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &statuses); err != nil {
+		t.Fatal(err)
+	}
+	for _, status := range statuses {
+		if status.HolderLabels[testNodeA]["rack"] != "r1" || status.HolderLabels[testNodeB]["rack"] != "r2" {
+			t.Errorf("unexpected holder labels in %s: %v", status.Group, status.HolderLabels)
+		}
+	}
+
+	bad := newTestServerConfig()
+	bad.Groups = map[string]GroupConfig{"dc-1": {Spread: []lock.Spread{{Label: "rack"}}}}
+	if err := bad.EnsureGroups(context.Background()); err == nil {
+		t.Error("unexpected success with invalid spread constraint")
+	}
+}
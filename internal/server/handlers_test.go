@@ -0,0 +1,412 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lucab/exp-locksmith2/internal/lock"
+)
+
+const (
+	testNodeA = "0d2e4c9a7b1f4e6a8c3d5b7f9e1a2c4d"
+	testNodeB = "7f3a1c5e9b2d4f6a8e0c2b4d6f8a1c3e"
+)
+
+// newTestServerConfig returns a server configuration on top of an
+// in-memory backend.
+func newTestServerConfig() *ServerConfig {
+	return &ServerConfig{
+		Backend:        lock.NewMemoryBackend(),
+		LockTimeout:    time.Second,
+		SemaphoreSlots: 1,
+	}
+}
+
+// doLockRequest sends a lock request for a node to a handler.
+func doLockRequest(h http.Handler, endpoint, node, group string) *httptest.ResponseRecorder {
+	body := fmt.Sprintf(`{"client_params":{"node_uuid":%q,"group":%q}}`, node, group)
+	req := httptest.NewRequest("POST", endpoint, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestPreRebootSteadyState(t *testing.T) {
+	sc := newTestServerConfig()
+	preReboot, steadyState := sc.PreReboot(), sc.SteadyState()
+
+	if w := doLockRequest(preReboot, PreRebootEndpoint, testNodeA, "workers"); w.Code != 200 {
+		t.Fatalf("unexpected status for first lock: %d %s", w.Code, w.Body)
+	}
+	// Locks are recursive.
+	if w := doLockRequest(preReboot, PreRebootEndpoint, testNodeA, "workers"); w.Code != 200 {
+		t.Fatalf("unexpected status for recursive lock: %d %s", w.Code, w.Body)
+	}
+	if w := doLockRequest(preReboot, PreRebootEndpoint, testNodeB, "workers"); w.Code != http.StatusConflict {
+		t.Fatalf("unexpected status for lock on full semaphore: %d %s", w.Code, w.Body)
+	}
+	// Groups are independent.
+	if w := doLockRequest(preReboot, PreRebootEndpoint, testNodeB, "controllers"); w.Code != 200 {
+		t.Fatalf("unexpected status in other group: %d %s", w.Code, w.Body)
+	}
+
+	if w := doLockRequest(steadyState, SteadyStateEndpoint, testNodeA, "workers"); w.Code != 200 {
+		t.Fatalf("unexpected status for unlock: %d %s", w.Code, w.Body)
+	}
+	if w := doLockRequest(preReboot, PreRebootEndpoint, testNodeB, "workers"); w.Code != 200 {
+		t.Fatalf("unexpected status for lock after release: %d %s", w.Code, w.Body)
+	}
+
+	sem, _, err := sc.Backend.Get(context.Background(), "workers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sem.Holders) != 1 || sem.Holders[0] != testNodeB {
+		t.Errorf("unexpected holders: %v", sem.Holders)
+	}
+}
+
+func TestFencingTokenVerify(t *testing.T) {
+	sc := newTestServerConfig()
+	preReboot, steadyState, verify := sc.PreReboot(), sc.SteadyState(), sc.Verify()
+
+	w := doLockRequest(preReboot, PreRebootEndpoint, testNodeA, "workers")
+	if w.Code != 200 || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("unexpected response for lock: %d %v %s", w.Code, w.Header(), w.Body)
+	}
+	var granted LockResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &granted); err != nil {
+		t.Fatal(err)
+	}
+	if granted.FencingToken <= 0 {
+		t.Fatalf("unexpected fencing token: %d", granted.FencingToken)
+	}
+
+	doVerify := func(node string, token int64) *httptest.ResponseRecorder {
+		body := fmt.Sprintf(`{"client_params":{"node_uuid":%q,"group":"workers","fencing_token":%d}}`, node, token)
+		w := httptest.NewRecorder()
+		verify.ServeHTTP(w, httptest.NewRequest("POST", VerifyEndpoint, strings.NewReader(body)))
+		return w
+	}
+	if w := doVerify(testNodeA, granted.FencingToken); w.Code != 200 {
+		t.Errorf("unexpected status for current token: %d %s", w.Code, w.Body)
+	}
+	if w := doVerify(testNodeB, granted.FencingToken); w.Code != http.StatusConflict {
+		t.Errorf("unexpected status for token of another node: %d", w.Code)
+	}
+	if w := doLockRequest(verify, VerifyEndpoint, testNodeA, "workers"); w.Code != 400 {
+		t.Errorf("unexpected status for missing token: %d", w.Code)
+	}
+
+	if w := doLockRequest(steadyState, SteadyStateEndpoint, testNodeA, "workers"); w.Code != 200 {
+		t.Fatalf("unexpected status for unlock: %d %s", w.Code, w.Body)
+	}
+	if w := doVerify(testNodeA, granted.FencingToken); w.Code != http.StatusConflict {
+		t.Errorf("unexpected status for released token: %d", w.Code)
+	}
+}
+
+func TestMultiGroupLock(t *testing.T) {
+	sc := newTestServerConfig()
+	preReboot, steadyState := sc.PreReboot(), sc.SteadyState()
+	doGroupsRequest := func(h http.Handler, endpoint, node string, groups ...string) *httptest.ResponseRecorder {
+		encoded, _ := json.Marshal(groups)
+		body := fmt.Sprintf(`{"client_params":{"node_uuid":%q,"groups":%s}}`, node, encoded)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("POST", endpoint, strings.NewReader(body)))
+		return w
+	}
+	holders := func(group string) []string {
+		sem, _, err := sc.Backend.Get(context.Background(), group)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sem.Holders
+	}
+
+	if w := doGroupsRequest(preReboot, PreRebootEndpoint, testNodeA, "service", "replicas"); w.Code != 200 {
+		t.Fatalf("unexpected status for multi-group lock: %d %s", w.Code, w.Body)
+	}
+	// No slot is taken in "storage", as "replicas" is full.
+	if w := doGroupsRequest(preReboot, PreRebootEndpoint, testNodeB, "storage", "replicas"); w.Code == 200 {
+		t.Fatal("unexpected lock with a full group")
+	}
+	if h := holders("storage"); len(h) != 0 {
+		t.Errorf("partial set of slots held: %v", h)
+	}
+
+	if w := doGroupsRequest(steadyState, SteadyStateEndpoint, testNodeA, "service", "replicas"); w.Code != 200 {
+		t.Fatalf("unexpected status for multi-group unlock: %d %s", w.Code, w.Body)
+	}
+	for _, group := range []string{"service", "replicas"} {
+		if h := holders(group); len(h) != 0 {
+			t.Errorf("slot not released in group %s: %v", group, h)
+		}
+	}
+	if w := doGroupsRequest(preReboot, PreRebootEndpoint, testNodeB, "storage", "replicas"); w.Code != 200 {
+		t.Errorf("unexpected status after release: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestLockRequestValidation(t *testing.T) {
+	sc := newTestServerConfig()
+	sc.DisableImplicitGroups = true
+	sc.Groups = map[string]GroupConfig{"workers": {Slots: 2}}
+	if err := sc.EnsureGroups(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	preReboot := sc.PreReboot()
+
+	w := httptest.NewRecorder()
+	preReboot.ServeHTTP(w, httptest.NewRequest("GET", PreRebootEndpoint, nil))
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "POST" {
+		t.Errorf("unexpected response to GET: %d %v", w.Code, w.Header())
+	}
+
+	if w := doLockRequest(preReboot, PreRebootEndpoint, "not-a-uuid", "workers"); w.Code != 400 {
+		t.Errorf("unexpected status for invalid node: %d", w.Code)
+	}
+	if w := doLockRequest(preReboot, PreRebootEndpoint, testNodeA, "undeclared"); w.Code != 403 {
+		t.Errorf("unexpected status for undeclared group: %d", w.Code)
+	}
+	if w := doLockRequest(preReboot, PreRebootEndpoint, testNodeA, "workers"); w.Code != 200 {
+		t.Errorf("unexpected status for declared group: %d %s", w.Code, w.Body)
+	}
+	if w := doLockRequest(preReboot, PreRebootEndpoint, testNodeB, "workers"); w.Code != 200 {
+		t.Errorf("unexpected status for second slot: %d %s", w.Code, w.Body)
+	}
+
+	sc.RateLimiter = NewRateLimiter(RateLimitConfig{PerIP: RateLimit{Rate: 0.001, Burst: 1}})
+	doLockRequest(preReboot, PreRebootEndpoint, testNodeA, "workers")
+	w = doLockRequest(preReboot, PreRebootEndpoint, testNodeA, "workers")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("unexpected response when rate limited: %d %v", w.Code, w.Header())
+	}
+}
+
+func TestEventsStream(t *testing.T) {
+	sc := newTestServerConfig()
+	srv := httptest.NewServer(sc.Events())
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequest("GET", srv.URL+"?format=ndjson&group=workers&revision=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != contentTypeNDJSON {
+		t.Errorf("unexpected content type: %s", ct)
+	}
+
+	if w := doLockRequest(sc.PreReboot(), PreRebootEndpoint, testNodeA, "workers"); w.Code != 200 {
+		t.Fatalf("unexpected status for lock: %d %s", w.Code, w.Body)
+	}
+
+	line, err := bufio.NewReader(resp.Body).ReadBytes('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ev lock.Event
+	if err := json.Unmarshal(line, &ev); err != nil {
+		t.Fatal(err)
+	}
+	if ev.Kind != lock.EventAcquired || ev.Group != "workers" || ev.Node != testNodeA || ev.Revision == 0 {
+		t.Errorf("unexpected event: %+v", ev)
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	sc := newTestServerConfig()
+
+	w := httptest.NewRecorder()
+	sc.Readiness().ServeHTTP(w, httptest.NewRequest("GET", ReadinessEndpoint, nil))
+	if w.Code != 200 {
+		t.Errorf("unexpected readiness status: %d", w.Code)
+	}
+
+	sc.StartDraining()
+	w = httptest.NewRecorder()
+	sc.Readiness().ServeHTTP(w, httptest.NewRequest("GET", ReadinessEndpoint, nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("unexpected readiness status while draining: %d", w.Code)
+	}
+}
+
+func TestEventsResumeWithinRevision(t *testing.T) {
+	sc := newTestServerConfig()
+	body := fmt.Sprintf(`{"client_params":{"node_uuid":%q,"groups":["service","replicas"]}}`, testNodeA)
+	w := httptest.NewRecorder()
+	sc.PreReboot().ServeHTTP(w, httptest.NewRequest("POST", PreRebootEndpoint, strings.NewReader(body)))
+	var resp struct {
+		FencingToken int64 `json:"fencing_token"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	// Both slots are taken in the same revision, the fencing token.
+	revision := resp.FencingToken
+
+	srv := httptest.NewServer(sc.Events())
+	defer srv.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequest("GET", srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Last-Event-ID", fmt.Sprintf("%d.0", revision))
+	stream, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Body.Close()
+
+	line, err := bufio.NewReader(stream.Body).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := fmt.Sprintf("id: %d.1\n", revision); line != expected {
+		t.Errorf("unexpected first line %q, expected %q", line, expected)
+	}
+
+	for _, tt := range []struct {
+		lastID   string
+		revision int64
+		skip     int
+	}{
+		{"42", 43, 0},
+		{"42.0", 42, 1},
+		{"42.3", 42, 4},
+	} {
+		req := httptest.NewRequest("GET", EventsEndpoint, nil)
+		req.Header.Set("Last-Event-ID", tt.lastID)
+		revision, skip, err := parseStartRevision(req)
+		if err != nil || revision != tt.revision || skip != tt.skip {
+			t.Errorf("unexpected start for %q: %d %d %v", tt.lastID, revision, skip, err)
+		}
+	}
+	for _, lastID := range []string{"x", "42.", "42.-1", "-1.0"} {
+		req := httptest.NewRequest("GET", EventsEndpoint, nil)
+		req.Header.Set("Last-Event-ID", lastID)
+		if _, _, err := parseStartRevision(req); err == nil {
+			t.Errorf("unexpected success for %q", lastID)
+		}
+	}
+	// Explicit revisions start at the given event.
+	for _, tt := range []struct {
+		rev      string
+		revision int64
+		skip     int
+	}{
+		{"42", 42, 0},
+		{"42.0", 42, 0},
+		{"42.3", 42, 3},
+	} {
+		req := httptest.NewRequest("GET", EventsEndpoint+"?revision="+tt.rev, nil)
+		revision, skip, err := parseStartRevision(req)
+		if err != nil || revision != tt.revision || skip != tt.skip {
+			t.Errorf("unexpected start for revision %q: %d %d %v", tt.rev, revision, skip, err)
+		}
+	}
+
+	// NDJSON events carry their index, to resume from.
+	req, err = http.NewRequest("GET", fmt.Sprintf("%s?format=ndjson&revision=%d.1", srv.URL, revision), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ndjson, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ndjson.Body.Close()
+	data, err := bufio.NewReader(ndjson.Body).ReadBytes('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ev lock.Event
+	if err := json.Unmarshal(data, &ev); err != nil {
+		t.Fatal(err)
+	}
+	if ev.Revision != revision || ev.Index != 1 {
+		t.Errorf("unexpected first NDJSON event: %+v", ev)
+	}
+}
+
+func TestEventsCompacted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "locksmith2-events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	backend, err := lock.NewFileBackend(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := newTestServerConfig()
+	sc.Backend = backend
+	if w := doLockRequest(sc.PreReboot(), PreRebootEndpoint, testNodeA, "workers"); w.Code != 200 {
+		t.Fatalf("unexpected status for lock: %d %s", w.Code, w.Body)
+	}
+
+	// The file backend cannot replay past changes.
+	srv := httptest.NewServer(sc.Events())
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "?format=ndjson&revision=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var streamErr streamError
+	if err := json.Unmarshal(body, &streamErr); err != nil {
+		t.Fatalf("unexpected stream %q: %s", body, err)
+	}
+	if streamErr.Kind != "error" || !streamErr.Compacted {
+		t.Errorf("unexpected stream error: %+v", streamErr)
+	}
+}
+
+func TestEventsEndOnDraining(t *testing.T) {
+	sc := newTestServerConfig()
+	srv := httptest.NewServer(sc.Events())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "?format=ndjson")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	sc.StartDraining()
+	done := make(chan error, 1)
+	go func() {
+		_, err := ioutil.ReadAll(resp.Body)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("unexpected stream error: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream still open while draining")
+	}
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/lucab/exp-locksmith2/internal/lock"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// LivenessEndpoint is the endpoint for process liveness probes.
+	LivenessEndpoint = "/healthz"
+	// ReadinessEndpoint is the endpoint for readiness probes.
+	ReadinessEndpoint = "/readyz"
+
+	// readinessTimeout bounds the etcd round-trip of a readiness check.
+	readinessTimeout = time.Second
+	// readinessKey is read, below the key prefix, to check that etcd can serve requests.
+	readinessKey = "health"
+)
+
+// Liveness is the handler for the `/healthz` endpoint.
+func (sc *ServerConfig) Liveness() http.Handler {
+	handler := func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("ok\n"))
+	}
+
+	return http.HandlerFunc(handler)
+}
+
+// Readiness is the handler for the `/readyz` endpoint.
+//
+// The server is ready when it is not draining and, with the etcd
+// backend, the shared etcd client can reach a quorum of the cluster.
+func (sc *ServerConfig) Readiness() http.Handler {
+	handler := func(w http.ResponseWriter, req *http.Request) {
+		if sc == nil {
+			http.Error(w, errNilServerConfig.Error(), 500)
+			return
+		}
+		if sc.IsDraining() {
+			http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		if sc.Backend == nil {
+			http.Error(w, lock.ErrNilBackend.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		// A linearizable read must be confirmed by a quorum of members.
+		if sc.EtcdClient != nil {
+			prefix := sc.Etcd.KeyPrefix
+			if prefix == "" {
+				prefix = lock.DefaultKeyPrefix
+			}
+			ctx, cancel := context.WithTimeout(req.Context(), readinessTimeout)
+			defer cancel()
+			if _, err := sc.EtcdClient.Get(ctx, prefix+readinessKey); err != nil {
+				logrus.Errorln("readiness check failed: ", err)
+				http.Error(w, "etcd unavailable: "+err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+		}
+
+		w.Write([]byte("ok\n"))
+	}
+
+	return http.HandlerFunc(handler)
+}
+
+// StartDraining flags the server as shutting down, so that readiness
+// checks fail and load balancers stop routing new requests to it. Event
+// streams end right away, for clients to reconnect to another server.
+func (sc *ServerConfig) StartDraining() {
+	if sc == nil {
+		return
+	}
+
+	sc.drainMu.Lock()
+	defer sc.drainMu.Unlock()
+	if sc.drained == nil {
+		sc.drained = make(chan struct{})
+	}
+	select {
+	case <-sc.drained:
+	default:
+		close(sc.drained)
+	}
+}
+
+// IsDraining returns whether the server is shutting down.
+func (sc *ServerConfig) IsDraining() bool {
+	if sc == nil {
+		return false
+	}
+
+	select {
+	case <-sc.drainedChan():
+		return true
+	default:
+		return false
+	}
+}
+
+// drainedChan returns a channel which is closed once the server starts
+// draining.
+func (sc *ServerConfig) drainedChan() <-chan struct{} {
+	sc.drainMu.Lock()
+	defer sc.drainMu.Unlock()
+	if sc.drained == nil {
+		sc.drained = make(chan struct{})
+	}
+	return sc.drained
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// HeartbeatEndpoint is the endpoint for node heartbeats.
+	HeartbeatEndpoint = "/v1/heartbeat"
+)
+
+// checkDisruptionBudgets validates the disruption budgets of all groups.
+func (sc *ServerConfig) checkDisruptionBudgets() error {
+	for group, gc := range sc.Groups {
+		b := gc.DisruptionBudget
+		if b == nil {
+			continue
+		}
+		if (b.MinAvailable > 0) == (b.MinAvailablePercent > 0) || b.MinAvailable < 0 || b.MinAvailablePercent < 0 || b.MinAvailablePercent > 100 {
+			return fmt.Errorf("disruption budget of group %q needs either a number or a percentage (up to 100) of available nodes", group)
+		}
+		if b.HeartbeatTTL < 0 || b.ForgetAfter < 0 {
+			return fmt.Errorf("invalid heartbeat durations in disruption budget of group %q", group)
+		}
+	}
+
+	return nil
+}
+
+// Heartbeat is the handler for the `/v1/heartbeat` endpoint, recording
+// the health of a node in all requested groups and their parents.
+func (sc *ServerConfig) Heartbeat() http.Handler {
+	handler := func(w http.ResponseWriter, req *http.Request) {
+		logrus.Debug("got heartbeat")
+		if sc == nil {
+			http.Error(w, errNilServerConfig.Error(), 500)
+			return
+		}
+		if req.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		nodeIdentity, params, err := sc.validateHeartbeat(req)
+		if err != nil {
+			errKind, code := errorStatus(err, errKindInvalidRequest, 400)
+			logrus.WithField("kind", errKind).Errorln("failed to validate client identity: ", err)
+			setRetryAfter(w, err)
+			http.Error(w, err.Error(), code)
+			return
+		}
+		healthy := params.Healthy == nil || *params.Healthy
+
+		ctx, cancel := context.WithTimeout(context.Background(), sc.LockTimeout)
+		defer cancel()
+		lockManager, err := sc.lockManager(ctx, nodeIdentity.groups())
+		if err != nil {
+			errKind, code := errorStatus(err, errKindInternal, 500)
+			logrus.WithField("kind", errKind).Errorln("failed to initialize semaphore manager: ", err)
+			http.Error(w, err.Error(), code)
+			return
+		}
+
+		if err := lockManager.Heartbeat(ctx, nodeIdentity.UUID, healthy, time.Now()); err != nil {
+			logrus.Errorln("failed to record heartbeat: ", err)
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"group":   nodeIdentity.Group,
+			"UUID":    nodeIdentity.UUID,
+			"healthy": healthy,
+		}).Debug("heartbeat recorded")
+	}
+
+	return http.HandlerFunc(handler)
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lucab/exp-locksmith2/internal/lock"
+)
+
+func TestDisruptionBudget(t *testing.T) {
+	const testNodeC = "3c5e7a9b1d2f4e6a8c0b2d4f6a8e1c3b"
+
+	sc := newTestServerConfig()
+	sc.SemaphoreSlots = 5
+	sc.Groups = map[string]GroupConfig{
+		"dc-1":    {DisruptionBudget: &lock.DisruptionBudget{MinAvailable: 1}},
+		"storage": {Parent: "dc-1"},
+	}
+	if err := sc.EnsureGroups(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	preReboot, heartbeat := sc.PreReboot(), sc.Heartbeat()
+	doHeartbeat := func(node string, healthy bool) {
+		body := fmt.Sprintf(`{"client_params":{"node_uuid":%q,"group":"storage","healthy":%t}}`, node, healthy)
+		w := httptest.NewRecorder()
+		heartbeat.ServeHTTP(w, httptest.NewRequest("POST", HeartbeatEndpoint, strings.NewReader(body)))
+		if w.Code != 200 {
+			t.Fatalf("unexpected heartbeat status: %d %s", w.Code, w.Body)
+		}
+	}
+
+	doHeartbeat(testNodeA, true)
+	doHeartbeat(testNodeB, true)
+	doHeartbeat(testNodeC, false)
+	if w := doLockRequest(preReboot, PreRebootEndpoint, testNodeA, "storage"); w.Code != 200 {
+		t.Fatalf("unexpected status for first lock: %d %s", w.Code, w.Body)
+	}
+	// Budgets of parents apply too, and unhealthy nodes are not available.
+	if w := doLockRequest(preReboot, PreRebootEndpoint, testNodeB, "storage"); w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "requires 1 available") {
+		t.Errorf("unexpected status exceeding budget: %d %s", w.Code, w.Body)
+	}
+	doHeartbeat(testNodeC, true)
+	if w := doLockRequest(preReboot, PreRebootEndpoint, testNodeB, "storage"); w.Code != 200 {
+		t.Errorf("unexpected status with healthy node: %d %s", w.Code, w.Body)
+	}
+
+	w := httptest.NewRecorder()
+	sc.GroupsStatus().ServeHTTP(w, httptest.NewRequest("GET", GroupsEndpoint, nil))
+	var statuses []GroupStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &statuses); err != nil {
+		t.Fatal(err)
+	}
+	for _, status := range statuses {
+		if status.KnownNodes != 3 || status.AvailableNodes != 1 || (status.Group == "dc-1") != (status.MinAvailable == 1) {
+			t.Errorf("unexpected membership of %s: %+v", status.Group, status)
+		}
+	}
+
+	for _, budget := range []lock.DisruptionBudget{
+		{},
+		{MinAvailable: 1, MinAvailablePercent: 50},
+		{MinAvailablePercent: 150},
+		{MinAvailable: 1, HeartbeatTTL: -1},
+	} {
+		bad := newTestServerConfig()
+		bad.Groups = map[string]GroupConfig{"dc-1": {DisruptionBudget: &budget}}
+		if err := bad.EnsureGroups(context.Background()); err == nil {
+			t.Errorf("unexpected success with invalid disruption budget: %+v", budget)
+		}
+	}
+}
@@ -1,9 +1,55 @@
 package server
 
 import (
+	"bytes"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
 	"net/http"
+	"regexp"
+)
+
+const (
+	// CertIdentityNone does not bind node identities to client certificates.
+	CertIdentityNone = ""
+	// CertIdentityCN binds node identities to the client certificate Common Name.
+	CertIdentityCN = "cn"
+	// CertIdentitySAN binds node identities to the client certificate Subject Alternative Names.
+	CertIdentitySAN = "san"
+
+	// DefaultNodeUUIDPattern matches RFC 4122 UUIDs and systemd machine-ids.
+	DefaultNodeUUIDPattern = "[0-9a-fA-F]{8}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{12}"
+	// DefaultMaxBodyBytes is the default limit on request body size.
+	DefaultMaxBodyBytes = 16 * 1024
+
+	// maxGroupLength is the maximum length of a group name.
+	maxGroupLength = 64
+	// maxGroups is the maximum number of groups in a single request.
+	maxGroups = 8
+	// maxFailureLength is the maximum length of a reported error.
+	maxFailureLength = 1024
+	// maxLabels is the maximum number of node labels in a single request.
+	maxLabels = 16
+	// maxLabelLength is the maximum length of label names and values.
+	maxLabelLength = 63
+	// maxVersionLength is the maximum length of reported versions.
+	maxVersionLength = 128
+)
+
+var (
+	// defaultNodeUUIDPattern is the compiled `DefaultNodeUUIDPattern`.
+	defaultNodeUUIDPattern = regexp.MustCompile("^(?:" + DefaultNodeUUIDPattern + ")$")
+	// groupPattern restricts group names to a safe charset, as they end up in etcd keys.
+	groupPattern = regexp.MustCompile("^[A-Za-z0-9][A-Za-z0-9._-]*$")
+	// labelPattern restricts label names and values.
+	labelPattern = regexp.MustCompile("^[A-Za-z0-9][A-Za-z0-9._/-]*$")
+	// versionPattern restricts reported versions, as they end up in metric
+	// labels and semaphore keys.
+	versionPattern = regexp.MustCompile("^[A-Za-z0-9][A-Za-z0-9._+~-]*$")
 )
 
 // HTTPParams contains all parameters for a remote lock
@@ -18,39 +64,254 @@ type Params struct {
 	CurrentVersion string `json:"current_version,omitempty"`
 	NodeUUID       string `json:"node_uuid"`
 	Group          string `json:"group,omitempty"`
+	// Groups, alternatively to Group, lists several groups in which slots
+	// are taken and released together.
+	Groups []string `json:"groups,omitempty"`
+	// FencingToken is the token to check, for verify requests.
+	FencingToken int64 `json:"fencing_token,omitempty"`
+	// Error and AttemptedVersion describe a failed update, for failure
+	// reports.
+	Error            string `json:"error,omitempty"`
+	AttemptedVersion string `json:"attempted_version,omitempty"`
+	// Labels describe the node, e.g. its zone, rack and role, for
+	// spread constraints.
+	Labels map[string]string `json:"labels,omitempty"`
+	// Healthy is the health of the node, for heartbeats (default true).
+	Healthy *bool `json:"healthy,omitempty"`
 }
 
 // NodeIdentity contains validated client identity from
 // request parameters.
 type NodeIdentity struct {
-	UUID  string
+	UUID string
+	// Group is the primary group, i.e. the first requested one.
 	Group string
+	// Groups are all requested groups, if more than one.
+	Groups []string
+}
+
+// groups returns all requested groups, starting with the primary one.
+func (p *Params) groups() []string {
+	if len(p.Groups) > 0 {
+		return p.Groups
+	}
+	return []string{p.Group}
 }
 
-func validateIdentity(req *http.Request) (*NodeIdentity, error) {
-	var group string
-	var nodeID string
+// groups returns all requested groups, starting with the primary one.
+func (id *NodeIdentity) groups() []string {
+	if len(id.Groups) > 0 {
+		return id.Groups
+	}
+	return []string{id.Group}
+}
+
+// validateRequest decodes a lock request, checks the identity of the
+// node and returns it along with all request parameters.
+func (sc *ServerConfig) validateRequest(req *http.Request) (*NodeIdentity, *Params, error) {
+	identity, params, err := sc.decodeRequest(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := sc.RateLimiter.limitNode(identity, sc.Groups[identity.Group].RateLimit); err != nil {
+		return nil, nil, err
+	}
 
-	decoder := json.NewDecoder(req.Body)
+	return identity, params, nil
+}
+
+// validateHeartbeat is validateRequest for heartbeats, which have their
+// own per-node rate limit instead of the per-node and global ones.
+func (sc *ServerConfig) validateHeartbeat(req *http.Request) (*NodeIdentity, *Params, error) {
+	identity, params, err := sc.decodeRequest(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := sc.RateLimiter.limitHeartbeat(identity); err != nil {
+		return nil, nil, err
+	}
+
+	return identity, params, nil
+}
+
+// decodeRequest decodes a request, and authenticates and authorizes the
+// node, before any per-node rate limit.
+func (sc *ServerConfig) decodeRequest(req *http.Request) (*NodeIdentity, *Params, error) {
+	if err := sc.RateLimiter.limitIP(req); err != nil {
+		return nil, nil, err
+	}
+
+	if contentType := req.Header.Get("Content-Type"); contentType != "" {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil || mediaType != "application/json" {
+			return nil, nil, &requestError{errKindUnsupportedMediaType, http.StatusUnsupportedMediaType, fmt.Errorf("unsupported content type %q", contentType)}
+		}
+	}
+
+	maxBodyBytes := sc.MaxBodyBytes
+	if maxBodyBytes <= 0 {
+		maxBodyBytes = DefaultMaxBodyBytes
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxBodyBytes+1))
+	if err != nil {
+		return nil, nil, err
+	}
+	if int64(len(body)) > maxBodyBytes {
+		return nil, nil, &requestError{errKindRequestTooLarge, http.StatusRequestEntityTooLarge, fmt.Errorf("request body exceeds %d bytes", maxBodyBytes)}
+	}
+
+	nodePattern := sc.NodeUUIDPattern
+	if nodePattern == nil {
+		nodePattern = defaultNodeUUIDPattern
+	}
+	params, err := decodeParams(body, nodePattern)
+	if err != nil {
+		return nil, nil, err
+	}
+	groups := params.groups()
+	nodeID := params.NodeUUID
+
+	if err := checkCertIdentity(req, sc.CertIdentity, nodeID); err != nil {
+		return nil, nil, &requestError{errKindIdentityMismatch, http.StatusForbidden, err}
+	}
+
+	identity := NodeIdentity{
+		Group: groups[0],
+		UUID:  nodeID,
+	}
+	if len(groups) > 1 {
+		identity.Groups = groups
+	}
+
+	if err := sc.Auth.authenticate(req, body, &identity); err != nil {
+		return nil, nil, err
+	}
+	if err := sc.authorize(req, &identity); err != nil {
+		return nil, nil, err
+	}
+
+	return &identity, params, nil
+}
+
+// decodeParams strictly decodes the JSON body of a lock request, and
+// checks the format of node UUID and group.
+func decodeParams(body []byte, nodePattern *regexp.Regexp) (*Params, error) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.DisallowUnknownFields()
 	var input HTTPParams
 	if err := decoder.Decode(&input); err != nil {
 		return nil, err
 	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, errors.New("unexpected trailing data after JSON body")
+	}
+
+	params := input.ClientParams
+	if params.Group != "" && len(params.Groups) > 0 {
+		return nil, errors.New("group and groups are mutually exclusive")
+	}
+	if len(params.Groups) > maxGroups {
+		return nil, fmt.Errorf("more than %d groups", maxGroups)
+	}
+	groups := params.groups()
+	for i, group := range groups {
+		if group == "" {
+			return nil, errors.New("empty group")
+		}
+		if len(group) > maxGroupLength {
+			return nil, fmt.Errorf("group name longer than %d characters", maxGroupLength)
+		}
+		if !groupPattern.MatchString(group) {
+			return nil, fmt.Errorf("invalid group name %q", group)
+		}
+		for _, other := range groups[:i] {
+			if other == group {
+				return nil, fmt.Errorf("duplicate group %q", group)
+			}
+		}
+	}
+
+	if len(params.Labels) > maxLabels {
+		return nil, fmt.Errorf("more than %d labels", maxLabels)
+	}
+	for name, value := range params.Labels {
+		for _, s := range []string{name, value} {
+			if len(s) > maxLabelLength || !labelPattern.MatchString(s) {
+				return nil, fmt.Errorf("invalid label %s=%s", name, value)
+			}
+		}
+	}
 
-	if input.ClientParams.Group == "" {
-		return nil, errors.New("empty group")
+	for _, version := range []string{params.CurrentVersion, params.AttemptedVersion} {
+		if version != "" && (len(version) > maxVersionLength || !versionPattern.MatchString(version)) {
+			return nil, fmt.Errorf("invalid version %q", version)
+		}
 	}
-	group = input.ClientParams.Group
 
-	if input.ClientParams.NodeUUID == "" {
+	if len(params.Error) > maxFailureLength {
+		return nil, fmt.Errorf("error description longer than %d characters", maxFailureLength)
+	}
+
+	if params.NodeUUID == "" {
 		return nil, errors.New("empty node ID")
 	}
-	nodeID = input.ClientParams.NodeUUID
+	if !nodePattern.MatchString(params.NodeUUID) {
+		return nil, fmt.Errorf("invalid node ID %q", params.NodeUUID)
+	}
 
-	identity := NodeIdentity{
-		Group: group,
-		UUID:  nodeID,
+	return &params, nil
+}
+
+// RequireClientCert wraps a handler, rejecting requests without a verified
+// client certificate. With mutual TLS, the listener only verifies the
+// certificates clients present, so that health probes and metrics
+// scrapers can connect without one.
+func RequireClientCert(h http.Handler) http.Handler {
+	handler := func(w http.ResponseWriter, req *http.Request) {
+		if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+			http.Error(w, "missing verified client certificate", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, req)
 	}
 
-	return &identity, nil
+	return http.HandlerFunc(handler)
+}
+
+// checkCertIdentity ensures that the node ID matches the verified client
+// certificate of the request, according to the binding mode.
+func checkCertIdentity(req *http.Request, mode string, nodeID string) error {
+	if mode == CertIdentityNone {
+		return nil
+	}
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return errors.New("missing verified client certificate")
+	}
+
+	cert := req.TLS.VerifiedChains[0][0]
+	for _, name := range certIdentities(cert, mode) {
+		if name == nodeID {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("node ID %q does not match client certificate", nodeID)
+}
+
+// certIdentities returns the identities carried by a certificate, for the
+// given binding mode.
+func certIdentities(cert *x509.Certificate, mode string) []string {
+	switch mode {
+	case CertIdentityCN:
+		return []string{cert.Subject.CommonName}
+	case CertIdentitySAN:
+		names := append([]string{}, cert.DNSNames...)
+		names = append(names, cert.EmailAddresses...)
+		for _, uri := range cert.URIs {
+			names = append(names, uri.String())
+		}
+		return names
+	default:
+		return nil
+	}
 }
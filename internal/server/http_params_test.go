@@ -0,0 +1,201 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCheckCertIdentity(t *testing.T) {
+	uri, _ := url.Parse("spiffe://cluster/node-c")
+	cert := &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "node-a"},
+		DNSNames: []string{"node-b"},
+		URIs:     []*url.URL{uri},
+	}
+	req := &http.Request{
+		TLS: &tls.ConnectionState{
+			VerifiedChains: [][]*x509.Certificate{{cert}},
+		},
+	}
+
+	tests := []struct {
+		mode     string
+		nodeID   string
+		expected bool
+	}{
+		{CertIdentityNone, "anything", true},
+		{CertIdentityCN, "node-a", true},
+		{CertIdentityCN, "node-b", false},
+		{CertIdentitySAN, "node-b", true},
+		{CertIdentitySAN, "spiffe://cluster/node-c", true},
+		{CertIdentitySAN, "node-a", false},
+	}
+	for _, tt := range tests {
+		err := checkCertIdentity(req, tt.mode, tt.nodeID)
+		if (err == nil) != tt.expected {
+			t.Errorf("mode %q, node %q: unexpected result %v", tt.mode, tt.nodeID, err)
+		}
+	}
+
+	if err := checkCertIdentity(&http.Request{}, CertIdentityCN, "node-a"); err == nil {
+		t.Error("expected error without client certificate")
+	}
+}
+
+func TestDecodeParams(t *testing.T) {
+	tests := []struct {
+		body  string
+		valid bool
+	}{
+		{`{"client_params":{"node_uuid":"9f2a6c1e4b7d4e0a8c3f5b1d2e6a7c90","group":"workers"}}`, true},
+		{`{"client_params":{"node_uuid":"9f2a6c1e-4b7d-4e0a-8c3f-5b1d2e6a7c90","group":"workers","current_version":"1.2.3"}}`, true},
+		{`{"client_params":{"node_uuid":"9f2a6c1e4b7d4e0a8c3f5b1d2e6a7c90","group":"workers"}} `, true},
+		{`{"client_params":{"node_uuid":"9f2a6c1e4b7d4e0a8c3f5b1d2e6a7c90","group":"workers"}}{}`, false},
+		{`{"client_params":{"node_uuid":"9f2a6c1e4b7d4e0a8c3f5b1d2e6a7c90","group":"workers","extra":1}}`, false},
+		{`{"client_params":{"node_uuid":"node-1","group":"workers"}}`, false},
+		{`{"client_params":{"node_uuid":"9f2a6c1e4b7d4e0a8c3f5b1d2e6a7c90","groups":["workers","replicas"]}}`, true},
+		{`{"client_params":{"node_uuid":"9f2a6c1e4b7d4e0a8c3f5b1d2e6a7c90","group":"workers","groups":["replicas"]}}`, false},
+		{`{"client_params":{"node_uuid":"9f2a6c1e4b7d4e0a8c3f5b1d2e6a7c90","groups":["workers","workers"]}}`, false},
+		{`{"client_params":{"node_uuid":"9f2a6c1e4b7d4e0a8c3f5b1d2e6a7c90","groups":["workers",""]}}`, false},
+		{`{"client_params":{"node_uuid":"9f2a6c1e4b7d4e0a8c3f5b1d2e6a7c90","groups":["a","b","c","d","e","f","g","h","i"]}}`, false},
+		{`{"client_params":{"node_uuid":"9f2a6c1e4b7d4e0a8c3f5b1d2e6a7c90","group":"../workers"}}`, false},
+		{`{"client_params":{"node_uuid":"9f2a6c1e4b7d4e0a8c3f5b1d2e6a7c90","group":"` + strings.Repeat("g", maxGroupLength+1) + `"}}`, false},
+		{`{"client_params":{"node_uuid":"9f2a6c1e4b7d4e0a8c3f5b1d2e6a7c90","group":"workers","error":"boom","attempted_version":"2"}}`, true},
+		{`{"client_params":{"node_uuid":"9f2a6c1e4b7d4e0a8c3f5b1d2e6a7c90","group":"workers","error":"` + strings.Repeat("e", maxFailureLength+1) + `"}}`, false},
+		{`{"client_params":{"node_uuid":"9f2a6c1e4b7d4e0a8c3f5b1d2e6a7c90","group":"workers","attempted_version":"37.20230110.3.1+git~1"}}`, true},
+		{`{"client_params":{"node_uuid":"9f2a6c1e4b7d4e0a8c3f5b1d2e6a7c90","group":"workers","attempted_version":"2\"} 1"}}`, false},
+		{`{"client_params":{"node_uuid":"9f2a6c1e4b7d4e0a8c3f5b1d2e6a7c90","group":"workers","attempted_version":"` + strings.Repeat("v", maxVersionLength+1) + `"}}`, false},
+		{`{"client_params":{"node_uuid":"9f2a6c1e4b7d4e0a8c3f5b1d2e6a7c90","group":"workers","current_version":"1 2"}}`, false},
+		{`{"client_params":{"node_uuid":"9f2a6c1e4b7d4e0a8c3f5b1d2e6a7c90","group":"workers","labels":{"zone":"eu-1a","topology/rack":"r12"}}}`, true},
+		{`{"client_params":{"node_uuid":"9f2a6c1e4b7d4e0a8c3f5b1d2e6a7c90","group":"workers","labels":{"rack":""}}}`, false},
+		{`{"client_params":{"node_uuid":"9f2a6c1e4b7d4e0a8c3f5b1d2e6a7c90","group":"workers","labels":{"rack id":"r1"}}}`, false},
+		{`{"client_params":{"node_uuid":"9f2a6c1e4b7d4e0a8c3f5b1d2e6a7c90","group":"workers","labels":{"rack":"` + strings.Repeat("r", maxLabelLength+1) + `"}}}`, false},
+		{`{"client_params":{"node_uuid":"9f2a6c1e4b7d4e0a8c3f5b1d2e6a7c90"}}`, false},
+		{`{"client_params":{"group":"workers"}}`, false},
+		{`not json`, false},
+	}
+
+	for _, tt := range tests {
+		_, err := decodeParams([]byte(tt.body), defaultNodeUUIDPattern)
+		if (err == nil) != tt.valid {
+			t.Errorf("decodeParams(%s): expected valid=%t, got error %v", tt.body, tt.valid, err)
+		}
+	}
+}
+
+func TestValidateRequestLimits(t *testing.T) {
+	sc := &ServerConfig{MaxBodyBytes: 64}
+	body := `{"client_params":{"node_uuid":"9f2a6c1e4b7d4e0a8c3f5b1d2e6a7c90","group":"workers"}}`
+
+	req := httptest.NewRequest("POST", PreRebootEndpoint, strings.NewReader(body))
+	if _, _, err := sc.validateRequest(req); err == nil {
+		t.Error("unexpected success with oversized body")
+	} else if kind, code := errorStatus(err, "", 0); kind != errKindRequestTooLarge || code != 413 {
+		t.Errorf("unexpected error status for oversized body: %s %d", kind, code)
+	}
+
+	sc.MaxBodyBytes = 0
+	req = httptest.NewRequest("POST", PreRebootEndpoint, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if _, _, err := sc.validateRequest(req); err == nil {
+		t.Error("unexpected success with form content type")
+	} else if kind, code := errorStatus(err, "", 0); kind != errKindUnsupportedMediaType || code != 415 {
+		t.Errorf("unexpected error status for form content type: %s %d", kind, code)
+	}
+
+	req = httptest.NewRequest("POST", PreRebootEndpoint, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	if _, _, err := sc.validateRequest(req); err != nil {
+		t.Errorf("unexpected error with JSON content type: %s", err)
+	}
+}
+
+func FuzzDecodeParams(f *testing.F) {
+	f.Add([]byte(`{"client_params":{"node_uuid":"9f2a6c1e4b7d4e0a8c3f5b1d2e6a7c90","group":"workers"}}`))
+	f.Add([]byte(`{"client_params":{"node_uuid":"9f2a6c1e-4b7d-4e0a-8c3f-5b1d2e6a7c90","group":"a","current_version":"1"}}`))
+	f.Add([]byte(`{"client_params":{"node_uuid":"9f2a6c1e4b7d4e0a8c3f5b1d2e6a7c90","groups":["a","b"]}}`))
+	f.Add([]byte(`{"client_params":{}}`))
+	f.Add([]byte(`[]`))
+
+	f.Fuzz(func(t *testing.T, body []byte) {
+		params, err := decodeParams(body, defaultNodeUUIDPattern)
+		if err != nil {
+			return
+		}
+		if !defaultNodeUUIDPattern.MatchString(params.NodeUUID) {
+			t.Errorf("accepted invalid node ID %q", params.NodeUUID)
+		}
+		for _, group := range params.groups() {
+			if len(group) > maxGroupLength || !groupPattern.MatchString(group) {
+				t.Errorf("accepted invalid group %q", group)
+			}
+		}
+
+		// Accepted params must survive a round-trip.
+		encoded, err := json.Marshal(HTTPParams{*params})
+		if err != nil {
+			t.Fatal(err)
+		}
+		again, err := decodeParams(encoded, defaultNodeUUIDPattern)
+		if err != nil {
+			t.Fatalf("failed to decode re-encoded params %s: %s", encoded, err)
+		}
+		if !reflect.DeepEqual(again, params) {
+			t.Errorf("round-trip mismatch: %+v != %+v", *again, *params)
+		}
+	})
+}
+
+func TestRequireClientCert(t *testing.T) {
+	handler := RequireClientCert(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", PreRebootEndpoint, nil)
+	req.TLS = &tls.ConnectionState{}
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("unexpected status without client certificate: %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	req.TLS.VerifiedChains = [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "node-a"}}}}
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("unexpected status with client certificate: %d", w.Code)
+	}
+}
+
+func TestParseAuditFilter(t *testing.T) {
+	tests := []struct {
+		query string
+		limit int
+	}{
+		{"", DefaultAuditLimit},
+		{"limit=0", DefaultAuditLimit},
+		{"limit=10", 10},
+		{"limit=1000000", MaxAuditLimit},
+	}
+
+	for _, tt := range tests {
+		filter, err := parseAuditFilter(httptest.NewRequest("GET", AuditEndpoint+"?"+tt.query, nil))
+		if err != nil {
+			t.Errorf("unexpected error for %q: %s", tt.query, err)
+			continue
+		}
+		if filter.Limit != tt.limit {
+			t.Errorf("unexpected limit for %q: %d, expected %d", tt.query, filter.Limit, tt.limit)
+		}
+	}
+
+	if _, err := parseAuditFilter(httptest.NewRequest("GET", AuditEndpoint+"?limit=-1", nil)); err == nil {
+		t.Error("unexpected success with negative limit")
+	}
+}
@@ -0,0 +1,204 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/lucab/exp-locksmith2/internal/lock"
+	"github.com/lucab/exp-locksmith2/internal/metrics"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// MetricsEndpoint is the endpoint for Prometheus metrics.
+	MetricsEndpoint = "/metrics"
+
+	// groupMetricsBackoff is the delay before re-syncing group gauges
+	// after a watch failure.
+	groupMetricsBackoff = 5 * time.Second
+)
+
+var (
+	requestsTotal = metrics.NewCounterVec(
+		"locksmith2_http_requests_total",
+		"Number of HTTP requests, per endpoint and outcome (status code).",
+		"endpoint", "code",
+	)
+	requestDuration = metrics.NewHistogramVec(
+		"locksmith2_http_request_duration_seconds",
+		"Latency of HTTP requests, per endpoint and outcome (status code).",
+		metrics.DefaultBuckets,
+		"endpoint", "code",
+	)
+	slotsTotal = metrics.NewGaugeVec(
+		"locksmith2_semaphore_slots_total",
+		"Number of semaphore slots, per group.",
+		"group",
+	)
+	slotsHeld = metrics.NewGaugeVec(
+		"locksmith2_semaphore_slots_held",
+		"Number of semaphore slots currently held, per group.",
+		"group",
+	)
+	groupPaused = metrics.NewGaugeVec(
+		"locksmith2_semaphore_paused",
+		"Whether the semaphore of a group is paused.",
+		"group",
+	)
+	groupFailures = metrics.NewGaugeVec(
+		"locksmith2_semaphore_failures",
+		"Number of failures counted against the failure budget, per group.",
+		"group",
+	)
+	groupOverdue = metrics.NewGaugeVec(
+		"locksmith2_semaphore_overdue_holders",
+		"Number of holders which exceeded the maximum hold duration, per group.",
+		"group",
+	)
+	autoPausesTotal = metrics.NewCounterVec(
+		"locksmith2_semaphore_auto_pauses_total",
+		"Number of times a group got paused by this server, per group and cause.",
+		"group", "cause",
+	)
+	reportedFailuresTotal = metrics.NewCounterVec(
+		"locksmith2_reported_failures_total",
+		"Number of failed updates reported to this server, per group.",
+		"group",
+	)
+	gateChecksTotal = metrics.NewCounterVec(
+		"locksmith2_gate_checks_total",
+		"Number of gate checks, per group, gate and result (open or closed).",
+		"group", "gate", "result",
+	)
+	// requestsInFlight counts the requests being served by each endpoint.
+	// Requests are not queued by the server, the only actual queues are
+	// the ones of webhook deliveries, with their own length gauge.
+	requestsInFlight = metrics.NewGaugeVec(
+		"locksmith2_http_requests_in_flight",
+		"Number of HTTP requests currently being served, per endpoint.",
+		"endpoint",
+	)
+)
+
+// Metrics is the handler for the `/metrics` endpoint.
+func (sc *ServerConfig) Metrics() http.Handler {
+	return metrics.Handler()
+}
+
+// Instrument wraps a handler, counting requests and observing their latency.
+func Instrument(endpoint string, h http.Handler) http.Handler {
+	handler := func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		requestsInFlight.Add(1, endpoint)
+		defer requestsInFlight.Add(-1, endpoint)
+
+		sw := &statusWriter{ResponseWriter: w, code: http.StatusOK}
+		h.ServeHTTP(sw, req)
+
+		code := strconv.Itoa(sw.code)
+		requestsTotal.Inc(endpoint, code)
+		requestDuration.Observe(time.Since(start).Seconds(), endpoint, code)
+	}
+
+	return http.HandlerFunc(handler)
+}
+
+// WatchGroupMetrics keeps per-group gauges in sync with semaphores in etcd,
+// until the context is canceled.
+func (sc *ServerConfig) WatchGroupMetrics(ctx context.Context) {
+	for {
+		err := sc.syncGroupMetrics(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		logrus.Errorln("group metrics watch interrupted: ", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(groupMetricsBackoff):
+		}
+	}
+}
+
+// syncGroupMetrics initializes group gauges from the current semaphores,
+// then updates them on every change.
+func (sc *ServerConfig) syncGroupMetrics(ctx context.Context) error {
+	if sc == nil {
+		return errNilServerConfig
+	}
+	if sc.Backend == nil {
+		return lock.ErrNilBackend
+	}
+
+	sems, revision, err := lock.ListSemaphores(ctx, sc.Backend)
+	if err != nil {
+		return err
+	}
+
+	slotsTotal.Reset()
+	slotsHeld.Reset()
+	groupPaused.Reset()
+	groupFailures.Reset()
+	groupOverdue.Reset()
+	for group, sem := range sems {
+		setGroupMetrics(group, sem)
+	}
+
+	return lock.WatchSemaphores(ctx, sc.Backend, revision+1, func(group string, sem *lock.Semaphore) error {
+		setGroupMetrics(group, sem)
+		return nil
+	})
+}
+
+// setGroupMetrics updates the gauges of a group, removing them if the
+// semaphore is nil.
+func setGroupMetrics(group string, sem *lock.Semaphore) {
+	if sem == nil {
+		slotsTotal.Delete(group)
+		slotsHeld.Delete(group)
+		groupPaused.Delete(group)
+		groupFailures.Delete(group)
+		groupOverdue.Delete(group)
+		return
+	}
+
+	paused := 0.0
+	if sem.Paused {
+		paused = 1
+	}
+	slotsTotal.Set(float64(sem.TotalSlots), group)
+	slotsHeld.Set(float64(len(sem.Holders)), group)
+	groupPaused.Set(paused, group)
+	groupFailures.Set(float64(sem.Failures), group)
+	groupOverdue.Set(float64(len(sem.Overdue)), group)
+}
+
+// statusWriter records the status code of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	code        int
+	wroteHeader bool
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	if !sw.wroteHeader {
+		sw.code = code
+		sw.wroteHeader = true
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	sw.wroteHeader = true
+	return sw.ResponseWriter.Write(b)
+}
+
+// Flush implements http.Flusher, for streaming handlers.
+func (sw *statusWriter) Flush() {
+	if flusher, ok := sw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
@@ -2,9 +2,12 @@ package server
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"net/http"
 
-	"github.com/lucab/exp-locksmith2/internal/lock"
+	"github.com/lucab/exp-locksmith2/internal/audit"
+	"github.com/lucab/exp-locksmith2/internal/webhook"
 	"github.com/sirupsen/logrus"
 )
 
@@ -13,6 +16,13 @@ const (
 	PreRebootEndpoint = "/v1/pre-reboot"
 )
 
+// LockResponse is the body of a granted lock request.
+type LockResponse struct {
+	// FencingToken increases with every acquisition, and can be checked
+	// against `/v1/verify` while the slot is held.
+	FencingToken int64 `json:"fencing_token"`
+}
+
 // PreReboot is the handler for the `/v1/pre-reboot` endpoint.
 func (sc *ServerConfig) PreReboot() http.Handler {
 	handler := func(w http.ResponseWriter, req *http.Request) {
@@ -21,39 +31,114 @@ func (sc *ServerConfig) PreReboot() http.Handler {
 			http.Error(w, errNilServerConfig.Error(), 500)
 			return
 		}
+		if req.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		entry := audit.Entry{
+			Action:    audit.ActionPreReboot,
+			Requester: req.RemoteAddr,
+		}
+		defer sc.recordAudit(&entry)
 
-		nodeIdentity, err := validateIdentity(req)
+		nodeIdentity, params, err := sc.validateRequest(req)
+		if err == nil {
+			err = sc.checkRolloutVersion(nodeIdentity.groups(), params.CurrentVersion)
+		}
 		if err != nil {
-			logrus.Errorln("failed to validate client identity: ", err)
-			http.Error(w, err.Error(), 400)
+			errKind, code := errorStatus(err, errKindInvalidRequest, 400)
+			logrus.WithField("kind", errKind).Errorln("failed to validate client identity: ", err)
+			setAuditOutcome(&entry, audit.OutcomeRefused, errKind, err)
+			setRetryAfter(w, err)
+			http.Error(w, err.Error(), code)
 			return
 		}
+		entry.Group, entry.Groups, entry.Node = nodeIdentity.Group, nodeIdentity.Groups, nodeIdentity.UUID
 		logrus.WithFields(logrus.Fields{
 			"group": nodeIdentity.Group,
 			"UUID":  nodeIdentity.UUID,
 		}).Debug("processing client pre-reboot request")
 
+		// Gates may take longer than semaphore updates, thus they run
+		// before the lock timeout starts.
+		gates, open, err := sc.evaluateGates(req.Context(), nodeIdentity)
+		if err != nil {
+			logrus.Errorln("failed to evaluate gates: ", err)
+			setAuditOutcome(&entry, audit.OutcomeFailed, lockErrorKind(err), err)
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		if !open {
+			err := errors.New("refused by group gates")
+			setAuditOutcome(&entry, audit.OutcomeRefused, errKindGateClosed, err)
+			refusal := GateRefusal{err.Error(), errKindGateClosed, gates}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusConflict)
+			if err := json.NewEncoder(w).Encode(refusal); err != nil {
+				logrus.Errorln("failed to write gate refusal: ", err)
+			}
+			return
+		}
+
 		ctx, cancel := context.WithTimeout(context.Background(), sc.LockTimeout)
 		defer cancel()
-		lockManager, err := lock.NewManager(ctx, sc.EtcdURLs, nodeIdentity.Group, sc.SemaphoreSlots)
+		lockManager, err := sc.lockManager(ctx, nodeIdentity.groups())
 		if err != nil {
-			logrus.Errorln("failed to initialize semaphore manager: ", err)
-			http.Error(w, err.Error(), 500)
+			errKind, code := errorStatus(err, errKindInternal, 500)
+			logrus.WithField("kind", errKind).Errorln("failed to initialize semaphore manager: ", err)
+			outcome := audit.OutcomeFailed
+			if code != 500 {
+				outcome = audit.OutcomeRefused
+			}
+			setAuditOutcome(&entry, outcome, errKind, err)
+			http.Error(w, err.Error(), code)
 			return
 		}
-		defer lockManager.Close()
 
-		err = lockManager.RecursiveLock(ctx, nodeIdentity.UUID)
+		// Nodes are tracked for rollout stages, even if refused.
+		if params.CurrentVersion != "" {
+			if err := lockManager.ReportVersion(ctx, nodeIdentity.UUID, params.CurrentVersion); err != nil {
+				logrus.Errorln("failed to record node version: ", err)
+				setAuditOutcome(&entry, audit.OutcomeFailed, lockErrorKind(err), err)
+				http.Error(w, err.Error(), 500)
+				return
+			}
+		}
+
+		token, err := lockManager.WithLabels(params.Labels).RecursiveLock(ctx, nodeIdentity.UUID)
 		if err != nil {
 			logrus.Errorln(err)
-			http.Error(w, err.Error(), 500)
+			errKind, code := errorStatus(err, lockErrorKind(err), 500)
+			outcome := audit.OutcomeFailed
+			if code != 500 {
+				outcome = audit.OutcomeRefused
+			}
+			if errKind == errKindPaused {
+				sc.Webhooks.Notify(webhook.Event{
+					Kind:   webhook.EventRefused,
+					Group:  nodeIdentity.Group,
+					Node:   nodeIdentity.UUID,
+					Reason: err.Error(),
+				})
+			}
+			setAuditOutcome(&entry, outcome, errKind, err)
+			http.Error(w, err.Error(), code)
 			return
 		}
+		setAuditOutcome(&entry, audit.OutcomeGranted, "", nil)
 
 		logrus.WithFields(logrus.Fields{
-			"group": nodeIdentity.Group,
-			"UUID":  nodeIdentity.UUID,
+			"group":         nodeIdentity.Group,
+			"UUID":          nodeIdentity.UUID,
+			"fencing_token": token,
 		}).Debug("green-flag to pre-reboot request")
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(LockResponse{token}); err != nil {
+			logrus.Errorln("failed to write lock response: ", err)
+		}
 	}
 
 	return http.HandlerFunc(handler)
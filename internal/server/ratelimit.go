@@ -0,0 +1,222 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lucab/exp-locksmith2/internal/metrics"
+)
+
+const (
+	// Rate limiting scopes.
+	rateScopeGlobal    = "global"
+	rateScopeIP        = "ip"
+	rateScopeNode      = "node"
+	rateScopeHeartbeat = "heartbeat"
+
+	// defaultRateLimitMaxKeys bounds the number of buckets per scope.
+	defaultRateLimitMaxKeys = 10000
+)
+
+var (
+	rateLimited = metrics.NewCounterVec(
+		"locksmith2_ratelimit_rejected_total",
+		"Number of lock requests rejected by rate limiting, per scope.",
+		"scope",
+	)
+	rateLimitKeys = metrics.NewGaugeVec(
+		"locksmith2_ratelimit_tracked_keys",
+		"Number of rate limiting buckets currently tracked, per scope.",
+		"scope",
+	)
+	rateLimitEvictions = metrics.NewCounterVec(
+		"locksmith2_ratelimit_evictions_total",
+		"Number of active rate limiting buckets evicted to bound memory, per scope.",
+		"scope",
+	)
+)
+
+// RateLimit is a token bucket, refilled at `Rate` tokens per second up
+// to `Burst` tokens. A zero rate disables limiting.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// burst returns the bucket capacity, at least one token.
+func (l RateLimit) burst() float64 {
+	if l.Burst < 1 {
+		return 1
+	}
+	return float64(l.Burst)
+}
+
+// RateLimitConfig holds settings for rate limiting lock requests.
+type RateLimitConfig struct {
+	// Global limits all lock requests reaching the lock backend.
+	Global RateLimit
+	// PerIP limits requests from each client IP.
+	PerIP RateLimit
+	// PerNode limits requests from each node, unless overridden per group.
+	PerNode RateLimit
+	// Heartbeat limits heartbeats from each node, which are exempt from
+	// the per-node and global limits.
+	Heartbeat RateLimit
+	// MaxKeys bounds the number of tracked IPs and nodes (default 10000).
+	MaxKeys int
+}
+
+// RateLimiter keeps token buckets for lock requests, in memory.
+type RateLimiter struct {
+	cfg RateLimitConfig
+
+	mu      sync.Mutex
+	buckets map[string]map[string]*bucket
+}
+
+// bucket is the state of a token bucket.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimitError is returned when a request exceeds a rate limit.
+type rateLimitError struct {
+	scope      string
+	retryAfter time.Duration
+}
+
+func (e *rateLimitError) Error() string {
+	return fmt.Sprintf("rate limit exceeded (%s), retry in %s", e.scope, e.retryAfter)
+}
+
+// NewRateLimiter returns a rate limiter for the given settings.
+func NewRateLimiter(cfg RateLimitConfig) *RateLimiter {
+	if cfg.MaxKeys <= 0 {
+		cfg.MaxKeys = defaultRateLimitMaxKeys
+	}
+
+	return &RateLimiter{
+		cfg: cfg,
+		buckets: map[string]map[string]*bucket{
+			rateScopeGlobal:    {},
+			rateScopeIP:        {},
+			rateScopeNode:      {},
+			rateScopeHeartbeat: {},
+		},
+	}
+}
+
+// limitIP checks the rate limit for the client IP of a request.
+func (rl *RateLimiter) limitIP(req *http.Request) error {
+	if rl == nil {
+		return nil
+	}
+
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		ip = req.RemoteAddr
+	}
+	return rl.take(rateScopeIP, ip, rl.cfg.PerIP, time.Now())
+}
+
+// limitNode checks the per-node and global rate limits for an identity.
+// A per-group limit, if set, takes precedence over the per-node one.
+func (rl *RateLimiter) limitNode(identity *NodeIdentity, groupLimit *RateLimit) error {
+	if rl == nil {
+		return nil
+	}
+
+	limit := rl.cfg.PerNode
+	if groupLimit != nil {
+		limit = *groupLimit
+	}
+	now := time.Now()
+	if err := rl.take(rateScopeNode, identity.Group+"/"+identity.UUID, limit, now); err != nil {
+		return err
+	}
+	return rl.take(rateScopeGlobal, "", rl.cfg.Global, now)
+}
+
+// limitHeartbeat checks the heartbeat rate limit for an identity.
+func (rl *RateLimiter) limitHeartbeat(identity *NodeIdentity) error {
+	if rl == nil {
+		return nil
+	}
+
+	return rl.take(rateScopeHeartbeat, identity.UUID, rl.cfg.Heartbeat, time.Now())
+}
+
+// take consumes a token from the bucket of `key`, failing if it is empty.
+func (rl *RateLimiter) take(scope, key string, limit RateLimit, now time.Time) error {
+	if limit.Rate <= 0 {
+		return nil
+	}
+	burst := limit.burst()
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	buckets := rl.buckets[scope]
+	b, ok := buckets[key]
+	if !ok {
+		if len(buckets) >= rl.cfg.MaxKeys {
+			rl.evict(scope, limit, now)
+		}
+		b = &bucket{tokens: burst, last: now}
+		buckets[key] = b
+		rateLimitKeys.Set(float64(len(buckets)), scope)
+	}
+
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+	if b.tokens < 1 {
+		rateLimited.Inc(scope)
+		wait := time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+		return &rateLimitError{scope, wait}
+	}
+	b.tokens--
+
+	return nil
+}
+
+// evict makes room in a scope, by dropping buckets which have refilled
+// (and are thus equivalent to new ones) or, failing that, the least
+// recently used one.
+func (rl *RateLimiter) evict(scope string, limit RateLimit, now time.Time) {
+	buckets := rl.buckets[scope]
+	refillTime := time.Duration(limit.burst() / limit.Rate * float64(time.Second))
+
+	var oldestKey string
+	var oldest time.Time
+	for key, b := range buckets {
+		if now.Sub(b.last) >= refillTime {
+			delete(buckets, key)
+			continue
+		}
+		if oldest.IsZero() || b.last.Before(oldest) {
+			oldestKey, oldest = key, b.last
+		}
+	}
+	if len(buckets) >= rl.cfg.MaxKeys {
+		delete(buckets, oldestKey)
+		rateLimitEvictions.Inc(scope)
+	}
+	rateLimitKeys.Set(float64(len(buckets)), scope)
+}
+
+// setRetryAfter advertises when a rate-limited request can be retried.
+func setRetryAfter(w http.ResponseWriter, err error) {
+	if rlErr, ok := err.(*rateLimitError); ok {
+		seconds := int64(math.Ceil(rlErr.retryAfter.Seconds()))
+		if seconds < 1 {
+			seconds = 1
+		}
+		w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+	}
+}
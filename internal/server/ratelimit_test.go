@@ -0,0 +1,105 @@
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterTake(t *testing.T) {
+	rl := NewRateLimiter(RateLimitConfig{MaxKeys: 2})
+	limit := RateLimit{Rate: 1, Burst: 2}
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		if err := rl.take(rateScopeNode, "a", limit, now); err != nil {
+			t.Fatalf("unexpected error within burst: %s", err)
+		}
+	}
+	err := rl.take(rateScopeNode, "a", limit, now)
+	if err == nil {
+		t.Fatal("unexpected success over burst")
+	}
+	if kind, code := errorStatus(err, "", 0); kind != errKindRateLimited || code != 429 {
+		t.Errorf("unexpected error status: %s %d", kind, code)
+	}
+	if wait := err.(*rateLimitError).retryAfter; wait != time.Second {
+		t.Errorf("unexpected retry delay: %s", wait)
+	}
+	w := httptest.NewRecorder()
+	setRetryAfter(w, err)
+	if retry := w.Header().Get("Retry-After"); retry != "1" {
+		t.Errorf("unexpected Retry-After: %q", retry)
+	}
+
+	if err := rl.take(rateScopeNode, "a", limit, now.Add(time.Second)); err != nil {
+		t.Errorf("unexpected error after refill: %s", err)
+	}
+
+	// Buckets are bounded, evicting the least recently used one.
+	rl.take(rateScopeNode, "b", limit, now.Add(time.Second))
+	rl.take(rateScopeNode, "c", limit, now.Add(time.Second))
+	if n := len(rl.buckets[rateScopeNode]); n != 2 {
+		t.Errorf("expected 2 tracked buckets, got %d", n)
+	}
+
+	// A zero rate disables limiting.
+	for i := 0; i < 10; i++ {
+		if err := rl.take(rateScopeGlobal, "", RateLimit{}, now); err != nil {
+			t.Fatalf("unexpected error with disabled limit: %s", err)
+		}
+	}
+}
+
+func TestRateLimiterGroupOverride(t *testing.T) {
+	rl := NewRateLimiter(RateLimitConfig{
+		PerNode: RateLimit{Rate: 1, Burst: 1},
+		Global:  RateLimit{Rate: 1, Burst: 3},
+	})
+	identity := &NodeIdentity{"a", "workers", nil}
+
+	if err := rl.limitNode(identity, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := rl.limitNode(identity, nil); err == nil || err.(*rateLimitError).scope != rateScopeNode {
+		t.Errorf("expected per-node limit, got %v", err)
+	}
+
+	override := &RateLimit{Rate: 10, Burst: 10}
+	if err := rl.limitNode(&NodeIdentity{"b", "canary", nil}, override); err != nil {
+		t.Fatal(err)
+	}
+	if err := rl.limitNode(&NodeIdentity{"b", "canary", nil}, override); err != nil {
+		t.Fatal(err)
+	}
+	if err := rl.limitNode(&NodeIdentity{"b", "canary", nil}, override); err == nil || err.(*rateLimitError).scope != rateScopeGlobal {
+		t.Errorf("expected global limit, got %v", err)
+	}
+
+	var disabled *RateLimiter
+	if err := disabled.limitNode(identity, nil); err != nil {
+		t.Errorf("unexpected error from nil limiter: %s", err)
+	}
+}
+
+func TestRateLimiterHeartbeat(t *testing.T) {
+	rl := NewRateLimiter(RateLimitConfig{
+		PerNode:   RateLimit{Rate: 1, Burst: 1},
+		Global:    RateLimit{Rate: 1, Burst: 1},
+		Heartbeat: RateLimit{Rate: 1, Burst: 2},
+	})
+	identity := &NodeIdentity{"a", "workers", nil}
+
+	// Heartbeats neither consume nor depend on lock request tokens.
+	for i := 0; i < 2; i++ {
+		if err := rl.limitHeartbeat(identity); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rl.limitHeartbeat(identity); err == nil || err.(*rateLimitError).scope != rateScopeHeartbeat {
+		t.Errorf("expected heartbeat limit, got %v", err)
+	}
+	if err := rl.limitNode(identity, nil); err != nil {
+		t.Errorf("unexpected error on lock request after heartbeats: %v", err)
+	}
+}
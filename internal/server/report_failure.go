@@ -0,0 +1,173 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/lucab/exp-locksmith2/internal/audit"
+	"github.com/lucab/exp-locksmith2/internal/lock"
+	"github.com/lucab/exp-locksmith2/internal/webhook"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// ReportFailureEndpoint is the endpoint for reporting a failed update.
+	ReportFailureEndpoint = "/v1/report-failure"
+
+	// FailurePolicyRelease releases the slot of a node reporting a failure.
+	FailurePolicyRelease = "release"
+	// FailurePolicyRetain keeps the slot of a node reporting a failure,
+	// blocking the group until the node recovers or an operator steps in.
+	FailurePolicyRetain = "retain"
+
+	// pauseCauseReportedFailure is the metrics cause of groups paused
+	// because of failures reported by nodes.
+	pauseCauseReportedFailure = "reported_failure"
+)
+
+// FailureResponse is the result of a failure report.
+type FailureResponse struct {
+	// Released is whether the slots of the node have been released.
+	Released bool `json:"released"`
+	// PausedGroups are the groups paused by this failure.
+	PausedGroups []string `json:"paused_groups,omitempty"`
+}
+
+// failureRelease returns whether a failure in the given groups releases
+// the slots of the node. Slots are retained if any requested group says so,
+// as they are taken and released together.
+func (sc *ServerConfig) failureRelease(groups []string) bool {
+	for _, group := range groups {
+		if sc.Groups[group].FailurePolicy == FailurePolicyRetain {
+			return false
+		}
+	}
+	return true
+}
+
+// checkFailurePolicy validates the failure policies of all groups.
+func (sc *ServerConfig) checkFailurePolicy() error {
+	for group, gc := range sc.Groups {
+		switch gc.FailurePolicy {
+		case "", FailurePolicyRelease, FailurePolicyRetain:
+		default:
+			return fmt.Errorf("invalid failure policy %q for group %q", gc.FailurePolicy, group)
+		}
+	}
+	return nil
+}
+
+// ReportFailure is the handler for the `/v1/report-failure` endpoint.
+func (sc *ServerConfig) ReportFailure() http.Handler {
+	handler := func(w http.ResponseWriter, req *http.Request) {
+		logrus.Debug("got failure report")
+		if sc == nil {
+			http.Error(w, errNilServerConfig.Error(), 500)
+			return
+		}
+		if req.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		entry := audit.Entry{
+			Action:    audit.ActionReportFailure,
+			Requester: req.RemoteAddr,
+		}
+		defer sc.recordAudit(&entry)
+
+		nodeIdentity, params, err := sc.validateRequest(req)
+		if err == nil && (params.Error == "" || params.AttemptedVersion == "") {
+			err = errors.New("missing error or attempted version")
+		}
+		if err != nil {
+			errKind, code := errorStatus(err, errKindInvalidRequest, 400)
+			logrus.WithField("kind", errKind).Errorln("failed to validate failure report: ", err)
+			setAuditOutcome(&entry, audit.OutcomeRefused, errKind, err)
+			setRetryAfter(w, err)
+			http.Error(w, err.Error(), code)
+			return
+		}
+		entry.Group, entry.Groups, entry.Node = nodeIdentity.Group, nodeIdentity.Groups, nodeIdentity.UUID
+		entry.Version = params.AttemptedVersion
+		logrus.WithFields(logrus.Fields{
+			"group":   nodeIdentity.Group,
+			"UUID":    nodeIdentity.UUID,
+			"version": params.AttemptedVersion,
+			"error":   params.Error,
+		}).Warn("node reported a failed update")
+
+		ctx, cancel := context.WithTimeout(context.Background(), sc.LockTimeout)
+		defer cancel()
+		lockManager, err := sc.lockManager(ctx, nodeIdentity.groups())
+		if err != nil {
+			errKind, code := errorStatus(err, errKindInternal, 500)
+			logrus.WithField("kind", errKind).Errorln("failed to initialize semaphore manager: ", err)
+			outcome := audit.OutcomeFailed
+			if code != 500 {
+				outcome = audit.OutcomeRefused
+			}
+			setAuditOutcome(&entry, outcome, errKind, err)
+			http.Error(w, err.Error(), code)
+			return
+		}
+
+		failure := lock.Failure{
+			Version:     params.AttemptedVersion,
+			Description: params.Error,
+			Release:     sc.failureRelease(nodeIdentity.groups()),
+			Budgets:     map[string]lock.Budget{},
+		}
+		for _, group := range nodeIdentity.groups() {
+			failure.Budgets[group] = sc.groupBudget(group)
+		}
+		paused, err := lockManager.ReportFailure(ctx, nodeIdentity.UUID, failure)
+		if err != nil {
+			logrus.Errorln("failed to record failure: ", err)
+			setAuditOutcome(&entry, audit.OutcomeFailed, lockErrorKind(err), err)
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		for group := range failure.Budgets {
+			reportedFailuresTotal.Inc(group)
+		}
+		sc.Webhooks.Notify(webhook.Event{
+			Kind:    webhook.EventFailed,
+			Group:   nodeIdentity.Group,
+			Node:    nodeIdentity.UUID,
+			Version: params.AttemptedVersion,
+			Reason:  params.Error,
+		})
+		resp := FailureResponse{Released: failure.Release}
+		for group, reason := range paused {
+			autoPausesTotal.Inc(group, pauseCauseReportedFailure)
+			sc.recordAutoPause(group, nodeIdentity.UUID, reason)
+			logrus.WithFields(logrus.Fields{
+				"group":  group,
+				"reason": reason,
+			}).Warn("group paused")
+			resp.PausedGroups = append(resp.PausedGroups, group)
+		}
+		sort.Strings(resp.PausedGroups)
+
+		outcome := audit.OutcomeRetained
+		if failure.Release {
+			outcome = audit.OutcomeReleased
+		}
+		setAuditOutcome(&entry, outcome, "", nil)
+		entry.Message = params.Error
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			logrus.Errorln("failed to write failure response: ", err)
+		}
+	}
+
+	return http.HandlerFunc(handler)
+}
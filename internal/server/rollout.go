@@ -0,0 +1,219 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/lucab/exp-locksmith2/internal/lock"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// RolloutsEndpoint is the endpoint for querying the progress of rollouts.
+	RolloutsEndpoint = "/v1/rollouts"
+)
+
+// RolloutConfig holds the ordered stages of a rollout.
+type RolloutConfig struct {
+	// Stages are lists of groups. Groups in a stage are granted slots
+	// only once all nodes in earlier stages have reported steady-state
+	// on the same `current_version`, i.e. the target version, and only
+	// to nodes not yet on it.
+	Stages [][]string
+}
+
+// RolloutStatus is the progress of a rollout.
+type RolloutStatus struct {
+	Name string `json:"name"`
+	// Stage is the index of the current stage, i.e. the first one not
+	// yet steady on Version, or the number of stages once completed.
+	Stage int `json:"stage"`
+	// Groups are the groups of the current stage.
+	Groups []string `json:"groups,omitempty"`
+	// Version is the common version of all nodes in earlier stages.
+	Version   string `json:"version,omitempty"`
+	Completed bool   `json:"completed"`
+}
+
+// rolloutStatus computes the progress of a rollout from the semaphores of
+// its groups. A stage is complete when no node holds a slot in any of its
+// groups, and all nodes which reported a version since `since` are on the
+// same one as earlier stages. Groups without semaphores have no nodes.
+func rolloutStatus(name string, rc RolloutConfig, sems map[string]*lock.Semaphore, since time.Time) RolloutStatus {
+	status := RolloutStatus{Name: name}
+	version := ""
+	for i, stage := range rc.Stages {
+		for _, group := range stage {
+			sem := sems[group]
+			if sem == nil {
+				continue
+			}
+			steady := len(sem.Holders) == 0
+			for _, v := range sem.CurrentVersions(since) {
+				if version == "" {
+					version = v
+				}
+				steady = steady && v == version
+			}
+			if !steady {
+				status.Stage, status.Groups = i, stage
+				if i > 0 {
+					status.Version = version
+				}
+				return status
+			}
+		}
+	}
+
+	status.Stage, status.Version, status.Completed = len(rc.Stages), version, true
+	return status
+}
+
+// versionsSince returns the time since which reported versions are
+// still tracked, or zero if they never expire.
+func (sc *ServerConfig) versionsSince() time.Time {
+	if sc.VersionTTL <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(-sc.VersionTTL)
+}
+
+// rolloutStage returns the rollout and stage index of a group, if any.
+func (sc *ServerConfig) rolloutStage(group string) (string, int, bool) {
+	for name, rc := range sc.Rollouts {
+		for i, stage := range rc.Stages {
+			for _, g := range stage {
+				if g == group {
+					return name, i, true
+				}
+			}
+		}
+	}
+
+	return "", 0, false
+}
+
+// checkRollouts validates rollout stages, which must be non-empty and
+// must not share groups.
+func (sc *ServerConfig) checkRollouts() error {
+	seen := map[string]string{}
+	for name, rc := range sc.Rollouts {
+		if len(rc.Stages) == 0 {
+			return fmt.Errorf("rollout %q has no stages", name)
+		}
+		for i, stage := range rc.Stages {
+			if len(stage) == 0 {
+				return fmt.Errorf("stage %d of rollout %q has no groups", i, name)
+			}
+			for _, group := range stage {
+				if other, ok := seen[group]; ok {
+					return fmt.Errorf("group %q is in several rollout stages (%s and %s)", group, other, name)
+				}
+				seen[group] = name
+			}
+		}
+	}
+
+	return nil
+}
+
+// rolloutGuard refuses slots in a stage of a rollout to nodes of `group`
+// until all earlier stages are complete, on a target version other than
+// the one the node reported. Thus a stage which is steady on the version
+// a node updates from, e.g. before the first stage started updating, does
+// not let the node through.
+func (sc *ServerConfig) rolloutGuard(name string, stage int, group string) (lock.Guard, []string) {
+	earlier := RolloutConfig{sc.Rollouts[name].Stages[:stage]}
+	observed := []string{}
+	for _, groups := range earlier.Stages {
+		observed = append(observed, groups...)
+	}
+
+	guard := func(id string, sems map[string]*lock.Semaphore) error {
+		current := ""
+		if sem := sems[group]; sem != nil {
+			current = sem.Versions[id]
+		}
+		status := rolloutStatus(name, earlier, sems, sc.versionsSince())
+		var err error
+		switch {
+		case current == "":
+			err = fmt.Errorf("node %q has not reported a current_version, waiting before stage %d of rollout %q", id, stage, name)
+		case !status.Completed:
+			err = fmt.Errorf("rollout %q is at stage %d (groups %v), waiting before stage %d", name, status.Stage, status.Groups, stage)
+		case status.Version == "" || status.Version == current:
+			err = fmt.Errorf("rollout %q has no target version newer than %q in earlier stages, waiting before stage %d", name, current, stage)
+		default:
+			return nil
+		}
+		return &requestError{errKindRolloutPending, http.StatusConflict, err}
+	}
+
+	return guard, observed
+}
+
+// checkRolloutVersion requires lock requests in later stages of a rollout
+// to report their `current_version`, which the rollout guard compares to
+// the target version.
+func (sc *ServerConfig) checkRolloutVersion(groups []string, version string) error {
+	if version != "" {
+		return nil
+	}
+	for _, group := range groups {
+		if name, stage, ok := sc.rolloutStage(group); ok && stage > 0 {
+			err := fmt.Errorf("group %q is in stage %d of rollout %q, requests must report a current_version", group, stage, name)
+			return &requestError{errKindInvalidRequest, http.StatusBadRequest, err}
+		}
+	}
+
+	return nil
+}
+
+// RolloutsStatus is the handler for the `/v1/rollouts` endpoint, listing the
+// current stage of every configured rollout.
+func (sc *ServerConfig) RolloutsStatus() http.Handler {
+	handler := func(w http.ResponseWriter, req *http.Request) {
+		logrus.Debug("got rollouts query")
+		if sc == nil {
+			http.Error(w, errNilServerConfig.Error(), 500)
+			return
+		}
+		if req.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if sc.Backend == nil {
+			http.Error(w, lock.ErrNilBackend.Error(), 500)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(req.Context(), sc.LockTimeout)
+		defer cancel()
+		sems, _, err := sc.Backend.List(ctx)
+		if err != nil {
+			logrus.Errorln("failed to list semaphores: ", err)
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		since := sc.versionsSince()
+		statuses := []RolloutStatus{}
+		for name, rc := range sc.Rollouts {
+			statuses = append(statuses, rolloutStatus(name, rc, sems, since))
+		}
+		sort.Slice(statuses, func(i, j int) bool {
+			return statuses[i].Name < statuses[j].Name
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(statuses); err != nil {
+			logrus.Errorln("failed to write rollouts: ", err)
+		}
+	}
+
+	return http.HandlerFunc(handler)
+}
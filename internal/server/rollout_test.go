@@ -0,0 +1,146 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lucab/exp-locksmith2/internal/lock"
+)
+
+func TestRolloutStatus(t *testing.T) {
+	rc := RolloutConfig{Stages: [][]string{{"staging"}, {"canary"}, {"prod-a", "prod-b"}}}
+	sem := func(holders []string, versions map[string]string) *lock.Semaphore {
+		s := lock.NewSemaphore(1)
+		s.Holders, s.Versions = holders, versions
+		return s
+	}
+
+	tests := []struct {
+		sems      map[string]*lock.Semaphore
+		stage     int
+		version   string
+		completed bool
+	}{
+		{map[string]*lock.Semaphore{}, 3, "", true},
+		{map[string]*lock.Semaphore{
+			"staging": sem([]string{"a"}, map[string]string{"a": "1"}),
+		}, 0, "", false},
+		{map[string]*lock.Semaphore{
+			"staging": sem(nil, map[string]string{"a": "2", "b": "1"}),
+		}, 0, "", false},
+		{map[string]*lock.Semaphore{
+			"staging": sem(nil, map[string]string{"a": "2", "b": "2"}),
+			"canary":  sem(nil, map[string]string{"c": "1"}),
+		}, 1, "2", false},
+		{map[string]*lock.Semaphore{
+			"staging": sem(nil, map[string]string{"a": "2"}),
+			"canary":  sem(nil, map[string]string{"c": "2"}),
+			"prod-b":  sem(nil, map[string]string{"d": "1"}),
+		}, 2, "2", false},
+		{map[string]*lock.Semaphore{
+			"staging": sem(nil, map[string]string{"a": "2"}),
+			"canary":  sem(nil, map[string]string{"c": "2"}),
+			"prod-a":  sem(nil, map[string]string{"d": "2"}),
+		}, 3, "2", true},
+	}
+
+	for i, tt := range tests {
+		status := rolloutStatus("os", rc, tt.sems, time.Time{})
+		if status.Stage != tt.stage || status.Version != tt.version || status.Completed != tt.completed {
+			t.Errorf("case %d: unexpected status %+v", i, status)
+		}
+	}
+
+	// Nodes which did not report for long, e.g. decommissioned ones,
+	// do not block later stages.
+	staging := lock.NewSemaphore(1)
+	staging.Versions = map[string]string{"a": "2", "gone": "1"}
+	staging.Reported = map[string]int64{"a": time.Now().Unix(), "gone": time.Now().Add(-2 * time.Hour).Unix()}
+	sems := map[string]*lock.Semaphore{"staging": staging}
+	if status := rolloutStatus("os", rc, sems, time.Time{}); status.Stage != 0 {
+		t.Errorf("unexpected status with all versions: %+v", status)
+	}
+	if status := rolloutStatus("os", rc, sems, time.Now().Add(-time.Hour)); status.Stage != 3 || status.Version != "2" {
+		t.Errorf("unexpected status without expired versions: %+v", status)
+	}
+}
+
+func TestRolloutStages(t *testing.T) {
+	sc := newTestServerConfig()
+	sc.Rollouts = map[string]RolloutConfig{
+		"os": {Stages: [][]string{{"staging"}, {"production"}}},
+	}
+	if err := sc.EnsureGroups(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	preReboot, steadyState := sc.PreReboot(), sc.SteadyState()
+	doVersionRequest := func(h http.Handler, endpoint, node, group, version string) *httptest.ResponseRecorder {
+		body := fmt.Sprintf(`{"client_params":{"node_uuid":%q,"group":%q,"current_version":%q}}`, node, group, version)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("POST", endpoint, strings.NewReader(body)))
+		return w
+	}
+
+	// Production must wait before staging started, and while staging is
+	// steady on the version production updates from.
+	if w := doVersionRequest(preReboot, PreRebootEndpoint, testNodeB, "production", "1"); w.Code != http.StatusConflict {
+		t.Errorf("unexpected status for production before staging: %d %s", w.Code, w.Body)
+	}
+	if w := doVersionRequest(steadyState, SteadyStateEndpoint, testNodeA, "staging", "1"); w.Code != 200 {
+		t.Fatalf("unexpected status for staging steady-state: %d %s", w.Code, w.Body)
+	}
+	if w := doVersionRequest(preReboot, PreRebootEndpoint, testNodeB, "production", "1"); w.Code != http.StatusConflict {
+		t.Errorf("unexpected status for production with staging on the same version: %d %s", w.Code, w.Body)
+	}
+	if w := doVersionRequest(preReboot, PreRebootEndpoint, testNodeB, "production", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("unexpected status for production without version: %d %s", w.Code, w.Body)
+	}
+
+	// Staging starts updating from 1 to 2, production must wait.
+	if w := doVersionRequest(preReboot, PreRebootEndpoint, testNodeA, "staging", "1"); w.Code != 200 {
+		t.Fatalf("unexpected status for staging lock: %d %s", w.Code, w.Body)
+	}
+	if w := doVersionRequest(preReboot, PreRebootEndpoint, testNodeB, "production", "1"); w.Code != http.StatusConflict {
+		t.Errorf("unexpected status for production during staging: %d %s", w.Code, w.Body)
+	}
+
+	rollouts := func() []RolloutStatus {
+		w := httptest.NewRecorder()
+		sc.RolloutsStatus().ServeHTTP(w, httptest.NewRequest("GET", RolloutsEndpoint, nil))
+		var statuses []RolloutStatus
+		if err := json.Unmarshal(w.Body.Bytes(), &statuses); err != nil {
+			t.Fatal(err)
+		}
+		return statuses
+	}
+	if statuses := rollouts(); len(statuses) != 1 || statuses[0].Stage != 0 {
+		t.Errorf("unexpected rollouts during staging: %+v", statuses)
+	}
+
+	if w := doVersionRequest(steadyState, SteadyStateEndpoint, testNodeA, "staging", "2"); w.Code != 200 {
+		t.Fatalf("unexpected status for staging unlock: %d %s", w.Code, w.Body)
+	}
+	if statuses := rollouts(); len(statuses) != 1 || statuses[0].Stage != 1 || statuses[0].Version != "2" {
+		t.Errorf("unexpected rollouts after staging: %+v", statuses)
+	}
+	if w := doVersionRequest(preReboot, PreRebootEndpoint, testNodeB, "production", "1"); w.Code != 200 {
+		t.Errorf("unexpected status for production after staging: %d %s", w.Code, w.Body)
+	}
+
+	for _, rollouts := range []map[string]RolloutConfig{
+		{"empty": {}},
+		{"a": {Stages: [][]string{{"x"}}}, "b": {Stages: [][]string{{"x"}}}},
+	} {
+		bad := newTestServerConfig()
+		bad.Rollouts = rollouts
+		if err := bad.EnsureGroups(context.Background()); err == nil {
+			t.Errorf("unexpected success with invalid rollouts: %v", rollouts)
+		}
+	}
+}
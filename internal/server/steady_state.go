@@ -4,7 +4,7 @@ import (
 	"context"
 	"net/http"
 
-	"github.com/lucab/exp-locksmith2/internal/lock"
+	"github.com/lucab/exp-locksmith2/internal/audit"
 	"github.com/sirupsen/logrus"
 )
 
@@ -21,13 +21,28 @@ func (sc *ServerConfig) SteadyState() http.Handler {
 			http.Error(w, errNilServerConfig.Error(), 500)
 			return
 		}
+		if req.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		entry := audit.Entry{
+			Action:    audit.ActionSteadyState,
+			Requester: req.RemoteAddr,
+		}
+		defer sc.recordAudit(&entry)
 
-		nodeIdentity, err := validateIdentity(req)
+		nodeIdentity, params, err := sc.validateRequest(req)
 		if err != nil {
-			logrus.Errorln("failed to validate client identity: ", err)
-			http.Error(w, err.Error(), 400)
+			errKind, code := errorStatus(err, errKindInvalidRequest, 400)
+			logrus.WithField("kind", errKind).Errorln("failed to validate client identity: ", err)
+			setAuditOutcome(&entry, audit.OutcomeRefused, errKind, err)
+			setRetryAfter(w, err)
+			http.Error(w, err.Error(), code)
 			return
 		}
+		entry.Group, entry.Groups, entry.Node = nodeIdentity.Group, nodeIdentity.Groups, nodeIdentity.UUID
 		logrus.WithFields(logrus.Fields{
 			"group": nodeIdentity.Group,
 			"UUID":  nodeIdentity.UUID,
@@ -35,20 +50,35 @@ func (sc *ServerConfig) SteadyState() http.Handler {
 
 		ctx, cancel := context.WithTimeout(context.Background(), sc.LockTimeout)
 		defer cancel()
-		lockManager, err := lock.NewManager(ctx, sc.EtcdURLs, nodeIdentity.Group, sc.SemaphoreSlots)
+		lockManager, err := sc.lockManager(ctx, nodeIdentity.groups())
 		if err != nil {
-			logrus.Errorln("failed to initialize semaphore manager: ", err)
-			http.Error(w, err.Error(), 500)
+			errKind, code := errorStatus(err, errKindInternal, 500)
+			logrus.WithField("kind", errKind).Errorln("failed to initialize semaphore manager: ", err)
+			outcome := audit.OutcomeFailed
+			if code != 500 {
+				outcome = audit.OutcomeRefused
+			}
+			setAuditOutcome(&entry, outcome, errKind, err)
+			http.Error(w, err.Error(), code)
 			return
 		}
-		defer lockManager.Close()
 
 		err = lockManager.UnlockIfHeld(ctx, nodeIdentity.UUID)
 		if err != nil {
 			logrus.Errorln("failed to release any semaphore lock: ", err)
+			setAuditOutcome(&entry, audit.OutcomeFailed, lockErrorKind(err), err)
 			http.Error(w, err.Error(), 500)
 			return
 		}
+		if params.CurrentVersion != "" {
+			if err := lockManager.ReportVersion(ctx, nodeIdentity.UUID, params.CurrentVersion); err != nil {
+				logrus.Errorln("failed to record node version: ", err)
+				setAuditOutcome(&entry, audit.OutcomeFailed, lockErrorKind(err), err)
+				http.Error(w, err.Error(), 500)
+				return
+			}
+		}
+		setAuditOutcome(&entry, audit.OutcomeReleased, "", nil)
 
 		logrus.WithFields(logrus.Fields{
 			"group": nodeIdentity.Group,
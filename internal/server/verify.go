@@ -0,0 +1,81 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/lucab/exp-locksmith2/internal/lock"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// VerifyEndpoint is the endpoint for checking a fencing token.
+	VerifyEndpoint = "/v1/verify"
+)
+
+// Verify is the handler for the `/v1/verify` endpoint.
+//
+// It answers 200 if the `fencing_token` in the request is the one of the
+// slot currently held by the node, and 409 otherwise. Verifications do
+// not change any state, thus they are not recorded in the audit trail.
+func (sc *ServerConfig) Verify() http.Handler {
+	handler := func(w http.ResponseWriter, req *http.Request) {
+		logrus.Debug("got verify request")
+		if sc == nil {
+			http.Error(w, errNilServerConfig.Error(), 500)
+			return
+		}
+		if req.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		nodeIdentity, params, err := sc.validateRequest(req)
+		if err == nil && params.FencingToken <= 0 {
+			err = &requestError{errKindInvalidRequest, http.StatusBadRequest, errors.New("missing fencing token")}
+		}
+		if err != nil {
+			errKind, code := errorStatus(err, errKindInvalidRequest, 400)
+			logrus.WithField("kind", errKind).Errorln("failed to validate verify request: ", err)
+			setRetryAfter(w, err)
+			http.Error(w, err.Error(), code)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), sc.LockTimeout)
+		defer cancel()
+		lockManager, err := sc.lockManager(ctx, nodeIdentity.groups())
+		if err != nil {
+			errKind, code := errorStatus(err, errKindInternal, 500)
+			logrus.WithField("kind", errKind).Errorln("failed to initialize semaphore manager: ", err)
+			http.Error(w, err.Error(), code)
+			return
+		}
+
+		err = lockManager.Verify(ctx, nodeIdentity.UUID, params.FencingToken)
+		if err == lock.ErrStaleToken {
+			logrus.WithFields(logrus.Fields{
+				"group":         nodeIdentity.Group,
+				"UUID":          nodeIdentity.UUID,
+				"fencing_token": params.FencingToken,
+			}).Debug("stale fencing token")
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			logrus.Errorln("failed to verify fencing token: ", err)
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(LockResponse{params.FencingToken}); err != nil {
+			logrus.Errorln("failed to write verify response: ", err)
+		}
+	}
+
+	return http.HandlerFunc(handler)
+}
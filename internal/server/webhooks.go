@@ -0,0 +1,26 @@
+package server
+
+import (
+	"github.com/lucab/exp-locksmith2/internal/lock"
+	"github.com/lucab/exp-locksmith2/internal/webhook"
+)
+
+// EnableWebhookEvents forwards the semaphore events caused by this server
+// to webhooks, by wrapping its backend. Replicas sharing a backend each
+// deliver the events of their own writes, so that receivers get every
+// event once; writes by `ctl` commands are not delivered. It is a no-op
+// without webhooks, and must be called before serving requests.
+func (sc *ServerConfig) EnableWebhookEvents() {
+	if sc == nil || sc.Webhooks == nil || sc.Backend == nil {
+		return
+	}
+
+	sc.Backend = lock.NewWriteEventsBackend(sc.Backend, func(ev lock.Event) {
+		sc.Webhooks.Notify(webhook.Event{
+			Kind:   string(ev.Kind),
+			Group:  ev.Group,
+			Node:   ev.Node,
+			Reason: ev.Reason,
+		})
+	})
+}
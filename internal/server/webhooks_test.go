@@ -0,0 +1,106 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lucab/exp-locksmith2/internal/lock"
+	"github.com/lucab/exp-locksmith2/internal/webhook"
+)
+
+func TestWebhookNotifications(t *testing.T) {
+	events := make(chan webhook.Event, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		var event webhook.Event
+		if err := json.Unmarshal(body, &event); err != nil {
+			t.Errorf("invalid webhook body %s: %s", body, err)
+		}
+		events <- event
+	}))
+	defer receiver.Close()
+
+	dispatcher, err := webhook.NewDispatcher([]webhook.Hook{{
+		Name:   "test",
+		URL:    receiver.URL,
+		Events: []string{"acquired", "paused", webhook.EventRefused, webhook.EventFailed},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := newTestServerConfig()
+	sc.Webhooks = dispatcher
+	replica := sc.Backend
+	sc.EnableWebhookEvents()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go dispatcher.Run(ctx, time.Second)
+
+	next := func(kind string) webhook.Event {
+		select {
+		case event := <-events:
+			if event.Kind != kind {
+				t.Fatalf("unexpected event, expected %q: %+v", kind, event)
+			}
+			return event
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %q event", kind)
+			return webhook.Event{}
+		}
+	}
+
+	preReboot := sc.PreReboot()
+	if w := doLockRequest(preReboot, PreRebootEndpoint, testNodeA, "workers"); w.Code != 200 {
+		t.Fatalf("unexpected status for lock: %d %s", w.Code, w.Body)
+	}
+	if event := next("acquired"); event.Group != "workers" || event.Node != testNodeA {
+		t.Errorf("unexpected acquired event: %+v", event)
+	}
+
+	// Writes by other replicas are delivered by them.
+	other, err := lock.OpenManager(ctx, replica, "workers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Pause(ctx, "elsewhere"); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Resume(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	manager, err := lock.OpenManager(ctx, sc.Backend, "workers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := manager.Pause(ctx, "maintenance"); err != nil {
+		t.Fatal(err)
+	}
+	if event := next("paused"); event.Reason != "maintenance" {
+		t.Errorf("unexpected paused event: %+v", event)
+	}
+	if w := doLockRequest(preReboot, PreRebootEndpoint, testNodeB, "workers"); w.Code != http.StatusLocked {
+		t.Fatalf("unexpected status for lock on paused group: %d %s", w.Code, w.Body)
+	}
+	if event := next(webhook.EventRefused); event.Node != testNodeB {
+		t.Errorf("unexpected refused event: %+v", event)
+	}
+
+	body := fmt.Sprintf(`{"client_params":{"node_uuid":%q,"group":"workers","error":"boom","attempted_version":"2"}}`, testNodeA)
+	w := httptest.NewRecorder()
+	sc.ReportFailure().ServeHTTP(w, httptest.NewRequest("POST", ReportFailureEndpoint, strings.NewReader(body)))
+	if w.Code != 200 {
+		t.Fatalf("unexpected status for failure report: %d %s", w.Code, w.Body)
+	}
+	if event := next(webhook.EventFailed); event.Version != "2" || event.Reason != "boom" {
+		t.Errorf("unexpected failed event: %+v", event)
+	}
+}
@@ -0,0 +1,199 @@
+package tlsutil
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrNilReloader is returned on nil reloader.
+	ErrNilReloader = errors.New("nil Reloader")
+)
+
+// Reloader keeps a key pair and an optional CA bundle loaded from files,
+// reloading them whenever the files change on disk.
+type Reloader struct {
+	certFile string
+	keyFile  string
+	caFile   string
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	caPool   *x509.CertPool
+	modTimes map[string]time.Time
+}
+
+// NewReloader loads a key pair (if `certFile` is set) and a CA bundle
+// (if `caFile` is set), failing if any of them cannot be loaded.
+func NewReloader(certFile, keyFile, caFile string) (*Reloader, error) {
+	if (certFile == "") != (keyFile == "") {
+		return nil, errors.New("certificate and key must be specified together")
+	}
+	if certFile == "" && caFile == "" {
+		return nil, errors.New("no TLS files specified")
+	}
+
+	r := &Reloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		caFile:   caFile,
+		modTimes: map[string]time.Time{},
+	}
+	if _, err := r.Reload(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Reload re-reads all files if any of them changed since last load,
+// returning whether a reload happened. On failure, the previously
+// loaded material is kept.
+func (r *Reloader) Reload() (bool, error) {
+	if r == nil {
+		return false, ErrNilReloader
+	}
+
+	modTimes := map[string]time.Time{}
+	changed := false
+	for _, path := range []string{r.certFile, r.keyFile, r.caFile} {
+		if path == "" {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return false, err
+		}
+		modTimes[path] = info.ModTime()
+
+		r.mu.RLock()
+		prev, ok := r.modTimes[path]
+		r.mu.RUnlock()
+		if !ok || !prev.Equal(info.ModTime()) {
+			changed = true
+		}
+	}
+	if !changed {
+		return false, nil
+	}
+
+	var cert *tls.Certificate
+	if r.certFile != "" {
+		pair, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+		if err != nil {
+			return false, fmt.Errorf("failed to load key pair %q: %s", r.certFile, err)
+		}
+		cert = &pair
+	}
+
+	var caPool *x509.CertPool
+	if r.caFile != "" {
+		pem, err := ioutil.ReadFile(r.caFile)
+		if err != nil {
+			return false, err
+		}
+		caPool = x509.NewCertPool()
+		if !caPool.AppendCertsFromPEM(pem) {
+			return false, fmt.Errorf("no valid certificates in CA bundle %q", r.caFile)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = cert
+	r.caPool = caPool
+	r.modTimes = modTimes
+
+	return true, nil
+}
+
+// Run periodically checks files for changes, until the context is canceled.
+func (r *Reloader) Run(ctx context.Context, interval time.Duration) {
+	if r == nil || interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		reloaded, err := r.Reload()
+		if err != nil {
+			logrus.Errorln("failed to reload TLS files: ", err)
+			continue
+		}
+		if reloaded {
+			logrus.WithFields(logrus.Fields{
+				"cert": r.certFile,
+				"ca":   r.caFile,
+			}).Info("reloaded TLS files")
+		}
+	}
+}
+
+// Certificate returns the current key pair, if any.
+func (r *Reloader) Certificate() *tls.Certificate {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert
+}
+
+// CAPool returns the current CA bundle, if any.
+func (r *Reloader) CAPool() *x509.CertPool {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.caPool
+}
+
+// ServerConfig returns a TLS configuration for servers, always serving
+// the current key pair. If a CA bundle is loaded, client certificates are
+// verified against it when presented; handlers which need one must check
+// for a verified chain, so that probes and metrics scrapers can still
+// connect without a certificate.
+func (r *Reloader) ServerConfig() *tls.Config {
+	getCertificate := func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		cert := r.Certificate()
+		if cert == nil {
+			return nil, errors.New("no server certificate loaded")
+		}
+		return cert, nil
+	}
+
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: getCertificate,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cfg := &tls.Config{
+				MinVersion:     tls.VersionTLS12,
+				GetCertificate: getCertificate,
+			}
+			if pool := r.CAPool(); pool != nil {
+				cfg.ClientCAs = pool
+				cfg.ClientAuth = tls.VerifyClientCertIfGiven
+			}
+			return cfg, nil
+		},
+	}
+}
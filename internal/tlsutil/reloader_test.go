@@ -0,0 +1,125 @@
+package tlsutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeSelfSigned writes a self-signed key pair for `cn` into `dir`.
+func writeSelfSigned(t *testing.T, dir, cn string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err := ioutil.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return certFile, keyFile
+}
+
+func TestReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "locksmith2-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeSelfSigned(t, dir, "first")
+	r, err := NewReloader(certFile, keyFile, certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.CAPool() == nil {
+		t.Error("missing CA pool")
+	}
+	cfg, err := r.ServerConfig().GetConfigForClient(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ClientCAs == nil || cfg.ClientAuth != tls.VerifyClientCertIfGiven {
+		t.Errorf("unexpected client authentication: %v", cfg.ClientAuth)
+	}
+	first, err := x509.ParseCertificate(r.Certificate().Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Subject.CommonName != "first" {
+		t.Errorf("unexpected CN: %s", first.Subject.CommonName)
+	}
+
+	reloaded, err := r.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded {
+		t.Error("unexpected reload without changes")
+	}
+
+	writeSelfSigned(t, dir, "second")
+	future := time.Now().Add(time.Minute)
+	for _, path := range []string{certFile, keyFile} {
+		if err := os.Chtimes(path, future, future); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reloaded, err = r.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reloaded {
+		t.Error("expected reload after changes")
+	}
+	second, err := x509.ParseCertificate(r.Certificate().Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.Subject.CommonName != "second" {
+		t.Errorf("unexpected CN after reload: %s", second.Subject.CommonName)
+	}
+}
+
+func TestReloaderMismatchedFiles(t *testing.T) {
+	if _, err := NewReloader("cert.pem", "", ""); err == nil {
+		t.Error("expected error on missing key")
+	}
+	if _, err := NewReloader("", "", ""); err == nil {
+		t.Error("expected error on no files")
+	}
+}
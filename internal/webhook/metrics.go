@@ -0,0 +1,18 @@
+package webhook
+
+import (
+	"github.com/lucab/exp-locksmith2/internal/metrics"
+)
+
+var (
+	queueLength = metrics.NewGaugeVec(
+		"locksmith2_webhook_queue_length",
+		"Number of events waiting for delivery, per webhook.",
+		"webhook",
+	)
+	deliveriesTotal = metrics.NewCounterVec(
+		"locksmith2_webhook_deliveries_total",
+		"Number of webhook events, per webhook and outcome (delivered, failed or dropped).",
+		"webhook", "outcome",
+	)
+)
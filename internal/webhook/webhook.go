@@ -0,0 +1,367 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/lucab/exp-locksmith2/internal/lock"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// SignatureHeader carries the hex-encoded HMAC-SHA256 of the body of
+	// a delivery, if the hook has a secret.
+	SignatureHeader = "X-Locksmith2-Webhook-Signature"
+	// EventHeader carries the kind of the delivered event.
+	EventHeader = "X-Locksmith2-Webhook-Event"
+
+	// EventRefused is a lock request refused because a group is paused.
+	EventRefused = "refused"
+	// EventFailed is a failed update reported by a node.
+	EventFailed = "failed"
+
+	// DefaultQueueSize is the default number of pending deliveries per hook.
+	DefaultQueueSize = 100
+	// DefaultMaxAttempts is the default number of delivery attempts.
+	DefaultMaxAttempts = 5
+	// DefaultTimeout is the default timeout of a single delivery attempt.
+	DefaultTimeout = 10 * time.Second
+
+	// initialBackoff and maxBackoff bound the delay between attempts.
+	initialBackoff = time.Second
+	maxBackoff     = time.Minute
+)
+
+var (
+	// eventKinds are all kinds of delivered events.
+	eventKinds = []string{
+		string(lock.EventAcquired),
+		string(lock.EventReleased),
+		string(lock.EventResized),
+		string(lock.EventPaused),
+		string(lock.EventResumed),
+		string(lock.EventOverdue),
+		string(lock.EventExpired),
+		EventRefused,
+		EventFailed,
+	}
+)
+
+// Event is a notification about a lock decision or semaphore change.
+// Kinds are the ones of semaphore events (e.g. "acquired", "paused"),
+// plus `EventRefused` and `EventFailed`.
+type Event struct {
+	Kind      string    `json:"kind"`
+	Group     string    `json:"group"`
+	Node      string    `json:"node,omitempty"`
+	Version   string    `json:"version,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Hook is an outbound webhook.
+type Hook struct {
+	// Name identifies the hook in logs and metrics.
+	Name string
+	// URL receives events as POST requests.
+	URL string
+	// Events, if set, lists the event kinds to deliver.
+	Events []string
+	// Template, if set, renders the JSON body from the event, instead
+	// of the event itself. It can use `json` to encode values.
+	Template *template.Template
+	// Secret, if set, signs the body in `SignatureHeader`.
+	Secret []byte
+	// QueueSize bounds pending deliveries (default `DefaultQueueSize`).
+	// Events are dropped while the queue is full.
+	QueueSize int
+	// MaxAttempts bounds delivery attempts (default `DefaultMaxAttempts`).
+	MaxAttempts int
+	// Timeout bounds a single attempt (default `DefaultTimeout`).
+	Timeout time.Duration
+}
+
+// NewTemplate parses a body template for a hook.
+func NewTemplate(name, text string) (*template.Template, error) {
+	funcs := template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+	}
+	return template.New(name).Funcs(funcs).Option("missingkey=error").Parse(text)
+}
+
+// Dispatcher delivers events to hooks asynchronously, each hook from its
+// own bounded queue, so that a slow receiver only delays its own events.
+type Dispatcher struct {
+	hooks  []*hookQueue
+	client *http.Client
+	// backoff is the delay before the first retry, doubled on each one.
+	backoff time.Duration
+
+	wg sync.WaitGroup
+}
+
+// hookQueue is a hook with its pending deliveries.
+type hookQueue struct {
+	Hook
+	queue chan Event
+}
+
+// NewDispatcher returns a dispatcher for the given hooks, validating them.
+// Deliveries start with Run.
+func NewDispatcher(hooks []Hook) (*Dispatcher, error) {
+	d := Dispatcher{
+		client:  &http.Client{},
+		backoff: initialBackoff,
+	}
+	names := map[string]bool{}
+	for _, hook := range hooks {
+		if hook.Name == "" {
+			return nil, errors.New("webhook without name")
+		}
+		if names[hook.Name] {
+			return nil, fmt.Errorf("duplicate webhook %q", hook.Name)
+		}
+		names[hook.Name] = true
+		for _, kind := range hook.Events {
+			if !containsString(eventKinds, kind) {
+				return nil, fmt.Errorf("unknown event %q for webhook %q", kind, hook.Name)
+			}
+		}
+		u, err := url.Parse(hook.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid URL for webhook %q", hook.Name)
+		}
+		if hook.QueueSize <= 0 {
+			hook.QueueSize = DefaultQueueSize
+		}
+		if hook.MaxAttempts <= 0 {
+			hook.MaxAttempts = DefaultMaxAttempts
+		}
+		if hook.Timeout <= 0 {
+			hook.Timeout = DefaultTimeout
+		}
+		d.hooks = append(d.hooks, &hookQueue{hook, make(chan Event, hook.QueueSize)})
+	}
+
+	return &d, nil
+}
+
+// Notify queues an event for all hooks interested in its kind, without
+// blocking. It is a no-op on a nil dispatcher.
+func (d *Dispatcher) Notify(event Event) {
+	if d == nil {
+		return
+	}
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now()
+	}
+
+	for _, hq := range d.hooks {
+		if !hq.wants(event.Kind) {
+			continue
+		}
+		select {
+		case hq.queue <- event:
+			queueLength.Set(float64(len(hq.queue)), hq.Name)
+		default:
+			deliveriesTotal.Inc(hq.Name, "dropped")
+			logrus.WithFields(logrus.Fields{
+				"webhook": hq.Name,
+				"kind":    event.Kind,
+			}).Warn("webhook queue full, dropping event")
+		}
+	}
+}
+
+// Run delivers queued events until the context is canceled, then keeps
+// delivering the events queued so far, for at most `drainTimeout`, so that
+// the events of the last requests served are not lost on shutdown. Events
+// still queued after that are dropped.
+func (d *Dispatcher) Run(ctx context.Context, drainTimeout time.Duration) {
+	if d == nil {
+		return
+	}
+
+	// Deliveries in progress are only aborted once draining times out.
+	deliverCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-deliverCtx.Done():
+			return
+		case <-ctx.Done():
+		}
+		timer := time.NewTimer(drainTimeout)
+		defer timer.Stop()
+		select {
+		case <-deliverCtx.Done():
+		case <-timer.C:
+			cancel()
+		}
+	}()
+
+	for _, hq := range d.hooks {
+		d.wg.Add(1)
+		go func(hq *hookQueue) {
+			defer d.wg.Done()
+			d.run(ctx, deliverCtx, hq)
+		}(hq)
+	}
+	d.wg.Wait()
+}
+
+// run delivers the events of a hook until `ctx` is canceled, then the
+// ones still queued, until the queue is empty or `deliverCtx` is canceled.
+func (d *Dispatcher) run(ctx, deliverCtx context.Context, hq *hookQueue) {
+	for {
+		select {
+		case <-ctx.Done():
+			d.drain(deliverCtx, hq)
+			return
+		case event := <-hq.queue:
+			d.process(deliverCtx, hq, event)
+		}
+	}
+}
+
+// drain delivers the events still queued for a hook.
+func (d *Dispatcher) drain(ctx context.Context, hq *hookQueue) {
+	for {
+		select {
+		case event := <-hq.queue:
+			if ctx.Err() != nil {
+				logrus.WithField("webhook", hq.Name).Warnf("dropping %d queued events on shutdown", len(hq.queue)+1)
+				return
+			}
+			d.process(ctx, hq, event)
+		default:
+			return
+		}
+	}
+}
+
+// process delivers a dequeued event, counting the outcome.
+func (d *Dispatcher) process(ctx context.Context, hq *hookQueue, event Event) {
+	queueLength.Set(float64(len(hq.queue)), hq.Name)
+	outcome := "delivered"
+	if err := d.deliver(ctx, hq, event); err != nil {
+		outcome = "failed"
+		logrus.WithFields(logrus.Fields{
+			"webhook": hq.Name,
+			"kind":    event.Kind,
+		}).Errorln("failed to deliver webhook: ", err)
+	}
+	deliveriesTotal.Inc(hq.Name, outcome)
+}
+
+// deliver sends an event, retrying with exponential backoff on network
+// errors, server errors and throttling.
+func (d *Dispatcher) deliver(ctx context.Context, hq *hookQueue, event Event) error {
+	body, err := hq.render(event)
+	if err != nil {
+		return err
+	}
+
+	backoff := d.backoff
+	for attempt := 1; ; attempt++ {
+		retry, err := d.post(ctx, hq, event.Kind, body)
+		if err == nil || !retry || attempt >= hq.MaxAttempts {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// post makes a single delivery attempt, returning whether a failure is
+// worth retrying.
+func (d *Dispatcher) post(ctx context.Context, hq *hookQueue, kind string, body []byte) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, hq.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodPost, hq.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, kind)
+	if len(hq.Secret) > 0 {
+		req.Header.Set(SignatureHeader, Sign(hq.Secret, body))
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("receiver returned %s", resp.Status)
+	default:
+		return false, fmt.Errorf("receiver returned %s", resp.Status)
+	}
+}
+
+// wants returns whether the hook delivers events of the given kind.
+func (hq *hookQueue) wants(kind string) bool {
+	return len(hq.Events) == 0 || containsString(hq.Events, kind)
+}
+
+// containsString returns whether a string is in a list.
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// render returns the JSON body for an event.
+func (hq *hookQueue) render(event Event) ([]byte, error) {
+	if hq.Template == nil {
+		return json.Marshal(event)
+	}
+
+	var buf bytes.Buffer
+	if err := hq.Template.Execute(&buf, event); err != nil {
+		return nil, err
+	}
+	if !json.Valid(buf.Bytes()) {
+		return nil, errors.New("template rendered invalid JSON")
+	}
+	return buf.Bytes(), nil
+}
+
+// Sign computes the hex-encoded HMAC-SHA256 of a body, as sent in
+// `SignatureHeader`.
+func Sign(secret []byte, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,181 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// receiver records the bodies of webhook deliveries, failing the first
+// `failures` requests.
+type receiver struct {
+	mu       sync.Mutex
+	failures int
+	requests int
+	bodies   chan []byte
+	headers  chan http.Header
+}
+
+func newReceiver(failures int) (*receiver, *httptest.Server) {
+	r := &receiver{
+		failures: failures,
+		bodies:   make(chan []byte, 10),
+		headers:  make(chan http.Header, 10),
+	}
+	return r, httptest.NewServer(r)
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	r.requests++
+	fail := r.requests <= r.failures
+	r.mu.Unlock()
+	if fail {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	body, _ := ioutil.ReadAll(req.Body)
+	r.headers <- req.Header
+	r.bodies <- body
+}
+
+func (r *receiver) next(t *testing.T) ([]byte, http.Header) {
+	select {
+	case body := <-r.bodies:
+		return body, <-r.headers
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for delivery")
+		return nil, nil
+	}
+}
+
+func TestDispatcherDelivery(t *testing.T) {
+	r, srv := newReceiver(2)
+	defer srv.Close()
+
+	tmpl, err := NewTemplate("chat", `{"text": {{json (printf "%s %s in %s" .Node .Kind .Group)}}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := NewDispatcher([]Hook{
+		{Name: "all", URL: srv.URL, Secret: []byte("s3cr3t")},
+		{Name: "chat", URL: srv.URL + "/chat", Events: []string{"paused"}, Template: tmpl},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.backoff = time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		d.Run(ctx, time.Second)
+		close(done)
+	}()
+
+	// The first two attempts fail, and are retried.
+	d.Notify(Event{Kind: "acquired", Group: "workers", Node: "a"})
+	body, headers := r.next(t)
+	var event Event
+	if err := json.Unmarshal(body, &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Kind != "acquired" || event.Node != "a" || event.Timestamp.IsZero() {
+		t.Errorf("unexpected event: %+v", event)
+	}
+	if headers.Get(SignatureHeader) != Sign([]byte("s3cr3t"), body) || headers.Get(EventHeader) != "acquired" {
+		t.Errorf("unexpected headers: %v", headers)
+	}
+
+	d.Notify(Event{Kind: "paused", Group: "workers", Node: "a"})
+	bodies := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		body, headers := r.next(t)
+		bodies[string(body)] = headers.Get(SignatureHeader) != ""
+	}
+	if signed, ok := bodies[`{"text": "a paused in workers"}`]; !ok || signed {
+		t.Errorf("unexpected deliveries: %v", bodies)
+	}
+
+	cancel()
+	<-done
+}
+
+func TestDispatcherDrain(t *testing.T) {
+	r, srv := newReceiver(0)
+	defer srv.Close()
+	d, err := NewDispatcher([]Hook{{Name: "all", URL: srv.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Events queued before shutdown are still delivered.
+	d.Notify(Event{Kind: "acquired", Node: "a"})
+	d.Notify(Event{Kind: "released", Node: "a"})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	d.Run(ctx, 5*time.Second)
+	for _, kind := range []string{"acquired", "released"} {
+		var event Event
+		body, _ := r.next(t)
+		if err := json.Unmarshal(body, &event); err != nil {
+			t.Fatal(err)
+		}
+		if event.Kind != kind {
+			t.Errorf("unexpected event, expected %q: %+v", kind, event)
+		}
+	}
+
+	// Once draining times out, the remaining events are dropped.
+	release := make(chan struct{})
+	blocked := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-release
+	}))
+	defer blocked.Close()
+	defer close(release)
+	d, err = NewDispatcher([]Hook{{Name: "blocked", URL: blocked.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Notify(Event{Kind: "acquired", Node: "a"})
+	d.Notify(Event{Kind: "released", Node: "a"})
+	d.Run(ctx, 100*time.Millisecond)
+	if l := len(d.hooks[0].queue); l != 0 {
+		t.Errorf("unexpected queue length after draining: %d", l)
+	}
+}
+
+func TestDispatcherQueue(t *testing.T) {
+	d, err := NewDispatcher([]Hook{{Name: "slow", URL: "http://127.0.0.1:1/", QueueSize: 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a running dispatcher, events beyond the queue size are dropped.
+	for i := 0; i < 5; i++ {
+		d.Notify(Event{Kind: "acquired"})
+	}
+	if l := len(d.hooks[0].queue); l != 2 {
+		t.Errorf("unexpected queue length: %d", l)
+	}
+
+	var nilDispatcher *Dispatcher
+	nilDispatcher.Notify(Event{Kind: "acquired"})
+
+	for _, hooks := range [][]Hook{
+		{{URL: "http://example.com"}},
+		{{Name: "a", URL: "ftp://example.com"}},
+		{{Name: "a", URL: "http://example.com", Events: []string{"rebooted"}}},
+		{{Name: "a", URL: "http://example.com"}, {Name: "a", URL: "http://example.com"}},
+	} {
+		if _, err := NewDispatcher(hooks); err == nil {
+			t.Errorf("unexpected success with invalid hooks: %+v", hooks)
+		}
+	}
+}